@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Parses a list of CIDRs or bare IP addresses, skipping invalid entries and returning them
+// separately. A nil list stays nil (everyone is allowed), an empty one allows nobody.
+func parseAcl(entries []string) ([]*net.IPNet, []string) {
+	if entries == nil {
+		return nil, nil
+	}
+	acl := []*net.IPNet{}
+	var invalid []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, err := parseAclEntry(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		acl = append(acl, network)
+	}
+	return acl, invalid
+}
+
+func parseAclEntry(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+// Parses an ACL flag. Invalid entries are fatal: leaving them out would change who is allowed.
+func parseAclFlag(name string, value string) []*net.IPNet {
+	acl, invalid := parseAcl(splitTrim(value, ","))
+	if len(invalid) > 0 {
+		log.Fatalf("Invalid --%s entries: %s", name, strings.Join(invalid, ", "))
+	}
+	return acl
+}
+
+// The invalid entries of the ACLs of a section, as problems at their location in the answers
+func aclProblems(key string, client ClientAnswers) []error {
+	var problems []error
+	acls := []struct {
+		field   string
+		entries []string
+	}{{"allow-query", client.AllowQuery}, {"allow-recursion", client.AllowRecursion}}
+	for _, acl := range acls {
+		for i, entry := range acl.entries {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			if _, err := parseAclEntry(entry); err != nil {
+				location := fmt.Sprintf("%s.%s[%d]", sectionLocation(key), acl.field, i)
+				problems = append(problems, AnswersProblem{Location: location, Message: fmt.Sprintf("invalid network %q", entry)})
+			}
+		}
+	}
+	return problems
+}
+
+// Rejects answers with invalid ACL entries, whatever --strict-answers says: an ACL without them
+// may refuse everyone, or allow more than it should
+func validateAcls(answers Answers) error {
+	keys := make([]string, 0, len(answers))
+	for key := range answers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if problems := aclProblems(key, answers[key]); len(problems) > 0 {
+			return problems[0]
+		}
+	}
+	return nil
+}
+
+// Whether ip is in the list. An empty (nil) list allows everyone.
+func aclAllows(acl []*net.IPNet, clientIp string) bool {
+	if acl == nil {
+		return true
+	}
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The ACLs of a section, parsed once when the answers are published. Answers with invalid entries
+// are rejected when they are loaded.
+type clientAcls struct {
+	query     []*net.IPNet
+	recursion []*net.IPNet
+}
+
+func compileAcls(answers Answers) map[string]clientAcls {
+	acls := make(map[string]clientAcls)
+	for key, client := range answers {
+		if client.AllowQuery == nil && client.AllowRecursion == nil {
+			continue
+		}
+		var c clientAcls
+		c.query, _ = parseAcl(client.AllowQuery)
+		c.recursion, _ = parseAcl(client.AllowRecursion)
+		acls[key] = c
+	}
+	return acls
+}
+
+// The ACL that applies to a client: the section of its address's, then the default section's,
+// then the flag's. Never the section of the UUID in the query name, which clients choose
+// themselves.
+func (s *Snapshot) acl(clientIp string, list func(clientAcls) []*net.IPNet, flagAcl []*net.IPNet) []*net.IPNet {
+	var acls map[string]clientAcls
+	if s.index != nil {
+		acls = s.index.acls
+	} else {
+		acls = compileAcls(s.Answers)
+	}
+	for _, key := range []string{clientIp, DEFAULT_KEY} {
+		if c, ok := acls[key]; ok && list(c) != nil {
+			return list(c)
+		}
+	}
+	return flagAcl
+}
+
+// Whether the client may query this server at all
+func (s *Snapshot) QueryAllowed(clientIp string) bool {
+	acl := s.acl(clientIp, func(c clientAcls) []*net.IPNet { return c.query }, allowQueryAcl)
+	return aclAllows(acl, clientIp)
+}
+
+// Whether the client may get answers for names we are not authoritative for
+func (s *Snapshot) RecursionAllowed(clientIp string) bool {
+	acl := s.acl(clientIp, func(c clientAcls) []*net.IPNet { return c.recursion }, allowRecursionAcl)
+	return aclAllows(acl, clientIp)
+}
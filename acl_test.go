@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAclFromAnswersFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "answers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+default:
+  allow-recursion: ["10.42.0.0/16", "192.0.2.1"]
+10.42.1.5:
+  allow-recursion: []
+`)
+	f.Close()
+
+	answers, err := ParseAnswers(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !unindexed(answers).RecursionAllowed("10.42.1.6") {
+		t.Fatal("10.42.1.6 should be allowed to recurse by the default section")
+	}
+	if !unindexed(answers).RecursionAllowed("192.0.2.1") {
+		t.Fatal("192.0.2.1 should be allowed to recurse by the default section")
+	}
+	if unindexed(answers).RecursionAllowed("198.51.100.1") {
+		t.Fatal("198.51.100.1 should not be allowed to recurse")
+	}
+	if unindexed(answers).RecursionAllowed("10.42.1.5") {
+		t.Fatal("10.42.1.5 has an empty list of its own and should not be allowed to recurse")
+	}
+	if !unindexed(answers).QueryAllowed("198.51.100.1") {
+		t.Fatal("Everyone should be allowed to query without an allow-query list")
+	}
+}
+
+func TestAclCompiledWithSnapshot(t *testing.T) {
+	oldSnapshot := loadSnapshot()
+	defer storeSnapshot(oldSnapshot)
+
+	answers := Answers{DEFAULT_KEY: ClientAnswers{AllowRecursion: []string{"10.0.0.0/33", " 10.42.0.0/16"}}}
+	storeSnapshot(&Snapshot{Answers: answers, index: compileIndex(answers)})
+	served := snapshot()
+
+	// Parsed once for the snapshot, skipping invalid entries
+	if acl := snapshot().index.acls[DEFAULT_KEY].recursion; len(acl) != 1 || acl[0].String() != "10.42.0.0/16" {
+		t.Fatalf("Unexpected compiled ACL [%v]", acl)
+	}
+	if !served.RecursionAllowed("10.42.1.6") || served.RecursionAllowed("10.0.0.1") {
+		t.Fatal("Expected the compiled ACL to be used")
+	}
+}
+
+func TestAclRejectedAtLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "answers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+10.42.1.5:
+  allow-recursion: ["10.42.0.0/33"]
+`)
+	f.Close()
+
+	if _, err := ParseAnswers(f.Name()); err == nil || !strings.Contains(err.Error(), `"10.42.1.5".allow-recursion[0]`) {
+		t.Fatalf("Expected the invalid entry to be rejected, got %v", err)
+	}
+}
+
+func TestAclBySourceAddress(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY:    ClientAnswers{AllowRecursion: []string{"10.42.0.0/16"}},
+		"198.51.100.2": ClientAnswers{AllowRecursion: []string{"198.51.100.0/24"}},
+		"abcdef01-123": ClientAnswers{AllowRecursion: []string{"0.0.0.0/0"}},
+	}
+	// Sections keyed by a UUID, which clients put in query names themselves, never apply
+	if unindexed(answers).RecursionAllowed("198.51.100.1") {
+		t.Fatal("198.51.100.1 should only get the default section's ACL")
+	}
+	if !unindexed(answers).RecursionAllowed("198.51.100.2") {
+		t.Fatal("198.51.100.2 should get the ACL of its address's section")
+	}
+}
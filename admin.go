@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Roles of admin listener clients, each one allowed everything the previous one is
+const (
+	ROLE_NONE = iota
+	ROLE_READ
+	ROLE_WRITE
+)
+
+var roleNames = map[string]int{"read": ROLE_READ, "write": ROLE_WRITE}
+
+type adminToken struct {
+	name  string
+	role  int
+	token []byte
+}
+
+// Authenticates and authorizes requests to the admin (reload) listener, and keeps the audit log
+// of mutating calls. Without tokens or client certificates, everyone may do everything.
+type AdminAuth struct {
+	tokens      []adminToken
+	clientCerts bool
+	writerCNs   map[string]bool
+	audit       *log.Logger
+}
+
+// Reads the admin tokens file, with one "name role token" line per token. Roles are read and write.
+func loadAdminTokens(path string) ([]adminToken, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []adminToken
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, role and token", path, line)
+		}
+		role, ok := roleNames[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown role %q, expected read or write", path, line, fields[1])
+		}
+		tokens = append(tokens, adminToken{name: fields[0], role: role, token: []byte(fields[2])})
+	}
+	return tokens, scanner.Err()
+}
+
+func NewAdminAuth(tokensFile string, clientCerts bool, writerCNs []string, auditFile string) (*AdminAuth, error) {
+	a := &AdminAuth{clientCerts: clientCerts, writerCNs: make(map[string]bool), audit: log.StandardLogger()}
+	if tokensFile != "" {
+		tokens, err := loadAdminTokens(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+	for _, cn := range writerCNs {
+		if cn != "" {
+			a.writerCNs[cn] = true
+		}
+	}
+	if auditFile != "" {
+		output, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.audit = &log.Logger{Out: output, Formatter: &log.JSONFormatter{}, Hooks: make(log.LevelHooks), Level: log.InfoLevel}
+	}
+	return a, nil
+}
+
+func (a *AdminAuth) enabled() bool {
+	return len(a.tokens) > 0 || a.clientCerts
+}
+
+// Who sent the request and what they may do, from a bearer token or a verified client certificate
+func (a *AdminAuth) identify(req *http.Request) (string, int) {
+	if !a.enabled() {
+		return "anonymous", ROLE_WRITE
+	}
+
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		presented := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(presented, t.token) == 1 {
+				return "token:" + t.name, t.role
+			}
+		}
+		return "", ROLE_NONE
+	}
+
+	if a.clientCerts && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		if a.writerCNs[cn] {
+			return "cert:" + cn, ROLE_WRITE
+		}
+		return "cert:" + cn, ROLE_READ
+	}
+	return "", ROLE_NONE
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Wraps a handler so that only clients with at least role can call it. Calls to handlers that
+// need the write role are audited, whether they are allowed or not.
+func (a *AdminAuth) Require(role int, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		identity, granted := a.identify(req)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+
+		switch {
+		case granted == ROLE_NONE:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rec, "authentication required", http.StatusUnauthorized)
+		case granted < role:
+			http.Error(rec, "permission denied", http.StatusForbidden)
+		default:
+			h(rec, req)
+		}
+
+		if role == ROLE_WRITE {
+			a.audit.WithFields(log.Fields{
+				"audit":    true,
+				"identity": identity,
+				"remote":   req.RemoteAddr,
+				"method":   req.Method,
+				"path":     req.URL.RequestURI(),
+				"status":   rec.status,
+				"duration": time.Since(start).String(),
+			}).Info("Admin call")
+		} else if rec.status == http.StatusUnauthorized || rec.status == http.StatusForbidden {
+			log.WithFields(log.Fields{"identity": identity, "remote": req.RemoteAddr, "path": req.URL.Path}).Warn("Refused admin call")
+		}
+	}
+}
+
+// TLS configuration of the admin listener. Client certificates are verified against caFile when
+// given, but not required, so that token clients can connect too.
+func adminTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Whether a listen address only accepts connections from this host. Tokens sent to other
+// addresses without TLS could be read on the way.
+func loopbackListener(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokens := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(tokens, []byte(`
+# name role token
+monitoring read r3ad-0nly
+deploy     write wr1te
+`), 0600)
+	audit := filepath.Join(dir, "audit.log")
+
+	auth, err := NewAdminAuth(tokens, true, []string{"ops"}, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called bool
+	handler := func(w http.ResponseWriter, req *http.Request) { called = true }
+
+	cert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+	tests := []struct {
+		role   int
+		token  string
+		tls    *tls.ConnectionState
+		status int
+	}{
+		{ROLE_READ, "", nil, http.StatusUnauthorized},
+		{ROLE_READ, "wrong", nil, http.StatusUnauthorized},
+		{ROLE_READ, "r3ad-0nly", nil, http.StatusOK},
+		{ROLE_WRITE, "r3ad-0nly", nil, http.StatusForbidden},
+		{ROLE_WRITE, "wr1te", nil, http.StatusOK},
+		{ROLE_READ, "", cert("dashboard"), http.StatusOK},
+		{ROLE_WRITE, "", cert("dashboard"), http.StatusForbidden},
+		{ROLE_WRITE, "", cert("ops"), http.StatusOK},
+		// Certificates that weren't verified are not enough
+		{ROLE_READ, "", &tls.ConnectionState{}, http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		called = false
+		req := httptest.NewRequest("POST", "/v1/reload", nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		req.TLS = test.tls
+		w := httptest.NewRecorder()
+		auth.Require(test.role, handler)(w, req)
+		if w.Code != test.status || called != (test.status == http.StatusOK) {
+			t.Fatalf("Test %d: expected %d, got %d (handler called: %v)", i, test.status, w.Code, called)
+		}
+	}
+
+	data, err := ioutil.ReadFile(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 4 {
+		t.Fatalf("Expected the 4 write calls to be audited, got %d:\n%s", len(lines), data)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[3], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["identity"] != "cert:ops" || entry["status"] != float64(200) || entry["path"] != "/v1/reload" {
+		t.Fatalf("Unexpected audit entry %v", entry)
+	}
+	if bytes.Contains(data, []byte("wr1te")) {
+		t.Fatal("Tokens should not be written to the audit log")
+	}
+
+	// Without tokens or client certificates everyone may do everything
+	open, err := NewAdminAuth("", false, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	open.Require(ROLE_WRITE, handler)(w, httptest.NewRequest("POST", "/v1/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected an open listener, got %d", w.Code)
+	}
+}
+
+func TestLoopbackListener(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8113": true,
+		"[::1]:8113":     true,
+		"localhost:8113": true,
+		":8113":          false,
+		"0.0.0.0:8113":   false,
+		"10.42.1.5:8113": false,
+		"127.0.0.1":      false,
+	} {
+		if loopbackListener(addr) != expected {
+			t.Errorf("Expected loopback %v for %s", expected, addr)
+		}
+	}
+}
@@ -45,6 +45,49 @@ func (answers *Answers) recursersFor(clientUUID string) []string {
 	return hosts
 }
 
+// Response rate limits for a client, by its address
+func (answers *Answers) RateLimits(clientIp string) RateLimit {
+	var limits RateLimit
+	for _, key := range []string{clientIp, DEFAULT_KEY} {
+		client, ok := (*answers)[key]
+		if !ok || client.RateLimit == nil {
+			continue
+		}
+		if limits.Client == nil {
+			limits.Client = client.RateLimit.Client
+		}
+		if limits.Name == nil {
+			limits.Name = client.RateLimit.Name
+		}
+		if limits.Slip == nil {
+			limits.Slip = client.RateLimit.Slip
+		}
+	}
+
+	return limits
+}
+
+func (limits RateLimit) clientRate() uint {
+	if limits.Client != nil {
+		return *limits.Client
+	}
+	return *rrlClientRate
+}
+
+func (limits RateLimit) nameRate() uint {
+	if limits.Name != nil {
+		return *limits.Name
+	}
+	return *rrlNameRate
+}
+
+func (limits RateLimit) slip() uint {
+	if limits.Slip != nil {
+		return *limits.Slip
+	}
+	return *rrlSlip
+}
+
 // Search suffixes
 func (answers *Answers) SearchSuffixes(clientUUID string) []string {
 	var suffixes []string
@@ -59,9 +102,12 @@ func (answers *Answers) SearchSuffixes(clientUUID string) []string {
 }
 
 // Authoritative suffixes
-func (answers *Answers) AuthoritativeSuffixes() []string {
+func (s *Snapshot) AuthoritativeSuffixes() []string {
+	if s.index != nil {
+		return s.index.authoritative
+	}
 	var suffixes []string
-	client, ok := (*answers)[DEFAULT_KEY]
+	client, ok := s.Answers[DEFAULT_KEY]
 	if ok && len(client.Authoritative) > 0 {
 		for _, suffix := range client.Authoritative {
 			withDots := "." + strings.Trim(suffix, ".") + "."
@@ -72,7 +118,26 @@ func (answers *Answers) AuthoritativeSuffixes() []string {
 	return suffixes
 }
 
-func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+// Whether we are authoritative for a suffix of fqdn
+func (s *Snapshot) IsAuthoritative(fqdn string) bool {
+	for _, suffix := range s.AuthoritativeSuffixes() {
+		if strings.HasSuffix(fqdn, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Snapshot) Addresses(clientUUID string, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+	return s.AddressesOfType(dns.TypeA, clientUUID, fqdn, answerFqdn, cnameParents, depth)
+}
+
+// Like Addresses, for A or AAAA records
+func (s *Snapshot) AddressesOfType(qtype uint16, clientUUID string, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+	return s.addresses(nil, qtype, clientUUID, fqdn, answerFqdn, cnameParents, depth)
+}
+
+func (s *Snapshot) addresses(trace *Trace, qtype uint16, clientUUID string, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
 	fqdn = dns.Fqdn(fqdn)
 
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying to resolve addresses")
@@ -80,24 +145,27 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 	// Limit recursing for non-obvious loops
 	if len(cnameParents) >= MAX_DEPTH {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Warn("Followed CNAME too many times ", cnameParents)
+		trace.add("cname", "followed %d CNAMEs, giving up at %s", len(cnameParents), fqdn)
 		return nil, false
 	}
 
 	// Look for a CNAME entry
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying CNAME Records")
-	result, ok := answers.Matching(dns.TypeCNAME, clientUUID, fqdn, answerFqdn)
+	result, ok := s.matching(trace, dns.TypeCNAME, clientUUID, fqdn, answerFqdn)
 	if ok && len(result) > 0 {
 		cname := result[0].(*dns.CNAME)
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Matched CNAME ", cname.Target)
+		trace.add("cname", "%s -> %s", fqdn, cname.Target)
 
 		// Stop obvious loops
 		if dns.Fqdn(cname.Target) == fqdn {
 			log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Warn("CNAME is a loop ", cname.Target)
+			trace.add("cname", "%s is a CNAME to itself", fqdn)
 			return nil, false
 		}
 
 		// Recurse to find the eventual A for this CNAME
-		children, ok := answers.Addresses(clientUUID, dns.Fqdn(cname.Target), dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
+		children, ok := s.addresses(trace, qtype, clientUUID, dns.Fqdn(cname.Target), dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
 		if ok && len(children) > 0 {
 			log.WithFields(log.Fields{"fqdn": fqdn, "target": cname.Target, "client": clientUUID, "depth": depth}).Debug("Resolved CNAME ", children)
 			records = append(records, cname)
@@ -106,11 +174,12 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 		}
 	}
 
-	// Look for an A entry
-	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying A Records")
-	result, ok = answers.Matching(dns.TypeA, clientUUID, fqdn, answerFqdn)
+	// Look for an A (or AAAA) entry
+	rrString := dns.Type(qtype).String()
+	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying ", rrString, " Records")
+	result, ok = s.matching(trace, qtype, clientUUID, fqdn, answerFqdn)
 	if ok && len(result) > 0 {
-		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Matched A ", result)
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Matched ", rrString, " ", result)
 		shuffle(&result)
 		return result, true
 	}
@@ -118,9 +187,15 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 	// When resolving CNAMES, check recursive server
 	if len(cnameParents) > 0 {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying recursive servers")
+		if trace != nil {
+			// Explaining never sends queries
+			trace.add("recurse", "would resolve CNAME target %s %s with %s", fqdn, dns.Type(qtype).String(), strings.Join(s.Recursers(clientUUID), ", "))
+			trace.Upstream = append(trace.Upstream, fqdn)
+			return nil, false
+		}
 		r := new(dns.Msg)
-		r.SetQuestion(fqdn, dns.TypeA)
-		msg, err := ResolveTryAll(r, answers.Recursers(clientUUID))
+		r.SetQuestion(fqdn, qtype)
+		msg, err := ResolveTryAll(upstreamRequest(r, nil), s.Recursers(clientUUID))
 		if err == nil {
 			return msg.Answer, true
 		}
@@ -130,42 +205,52 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 	return nil, false
 }
 
-func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
-	authoritativeFor := answers.AuthoritativeSuffixes()
-	authoritative := false
-	for _, suffix := range authoritativeFor {
-		if strings.HasSuffix(fqdn, suffix) {
-			authoritative = true
-			break
-		}
-	}
+func (s *Snapshot) Matching(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	return s.matching(nil, qtype, clientUUID, fqdn, answerFqdn)
+}
+
+func (s *Snapshot) matching(trace *Trace, qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	authoritative := s.IsAuthoritative(fqdn)
 
 	// If we are authoritative for a suffix the label has, there's no point trying alternate search suffixes
 	var clientSearches []string
 	if authoritative {
+		trace.add("authoritative", "%s is in an authoritative zone, not using the client's search suffixes", fqdn)
 		clientSearches = []string{}
 	} else {
-		clientSearches = answers.SearchSuffixes(clientUUID)
+		clientSearches = s.SearchSuffixes(clientUUID)
 	}
 
 	// Client answers, client search
-	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying client answers, client search")
-	records, ok = answers.MatchingSearch(qtype, clientUUID, fqdn, answerFqdn, []string{})
+	if debugging() {
+		log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying client answers, client search")
+	}
+	records, ok = s.matchingSearch(trace, qtype, clientUUID, fqdn, answerFqdn, []string{})
 	if ok {
 		return
 	}
 
+	// The index has the default answers through the client's search suffixes, then the default
+	// ones, merged. Explaining tries each suffix, to trace them.
+	if s.index != nil && trace == nil {
+		return s.index.search(qtype, clientUUID, authoritative, fqdn, answerFqdn)
+	}
+
 	// Default answers, client search
-	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, client search")
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, clientSearches)
+	if debugging() {
+		log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, client search")
+	}
+	records, ok = s.matchingSearch(trace, qtype, DEFAULT_KEY, fqdn, answerFqdn, clientSearches)
 	if ok {
 		return
 	}
 
 	// Default answers, default search
-	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, default search")
-	defaultSearches := answers.SearchSuffixes(DEFAULT_KEY)
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, defaultSearches)
+	if debugging() {
+		log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, default search")
+	}
+	defaultSearches := s.SearchSuffixes(DEFAULT_KEY)
+	records, ok = s.matchingSearch(trace, qtype, DEFAULT_KEY, fqdn, answerFqdn, defaultSearches)
 	if ok {
 		return
 	}
@@ -173,24 +258,69 @@ func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, a
 	return nil, false
 }
 
-func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn string, answerFqdn string, searches []string) (records []dns.RR, ok bool) {
-	records, ok = answers.MatchingExact(qtype, clientUUID, fqdn, answerFqdn)
+// Local records of any type for ANY queries. Unless all is set, only one representative
+// RRset is returned (RFC 8482).
+func (s *Snapshot) Any(clientUUID string, fqdn string, answerFqdn string, all bool) (records []dns.RR, ok bool) {
+	for _, qtype := range []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypePTR, dns.TypeSRV} {
+		found, ok := s.Matching(qtype, clientUUID, fqdn, answerFqdn)
+		if !ok {
+			continue
+		}
+		if !all {
+			return found, true
+		}
+		records = append(records, found...)
+	}
+
+	return records, len(records) > 0
+}
+
+// The types of the local records for a name, for NSEC bitmaps
+func (s *Snapshot) Types(clientUUID string, fqdn string) []uint16 {
+	var types []uint16
+	records, _ := s.Any(clientUUID, fqdn, fqdn, true)
+	for _, rr := range records {
+		t := rr.Header().Rrtype
+		if len(types) == 0 || types[len(types)-1] != t {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (s *Snapshot) MatchingSearch(qtype uint16, clientUUID string, fqdn string, answerFqdn string, searches []string) (records []dns.RR, ok bool) {
+	return s.matchingSearch(nil, qtype, clientUUID, fqdn, answerFqdn, searches)
+}
+
+func (s *Snapshot) matchingSearch(trace *Trace, qtype uint16, clientUUID string, fqdn string, answerFqdn string, searches []string) (records []dns.RR, ok bool) {
+	records, ok = s.MatchingExact(qtype, clientUUID, fqdn, answerFqdn)
+	trace.lookup(qtype, clientUUID, fqdn, "", records)
 	if ok {
-		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID}).Debug("Matched exact FQDN")
+		if debugging() {
+			log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID}).Debug("Matched exact FQDN")
+		}
 		return
 	}
 
 	base := strings.TrimRight(fqdn, ".")
 	limit := int(*ndots)
+	if limit != 0 && strings.Count(base, ".") >= limit && len(searches) > 0 {
+		trace.add("search", "%s has at least %d dots, not using search suffixes", fqdn, limit)
+	}
 	if limit == 0 || strings.Count(base, ".") < limit {
 		if searches != nil && len(searches) > 0 {
 			for _, suffix := range searches {
 				newFqdn := base + "." + strings.TrimRight(suffix, ".") + "."
-				log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Trying alternate suffix")
+				if debugging() {
+					log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Trying alternate suffix")
+				}
 
-				records, ok = answers.MatchingExact(qtype, clientUUID, newFqdn, answerFqdn)
+				records, ok = s.MatchingExact(qtype, clientUUID, newFqdn, answerFqdn)
+				trace.lookup(qtype, clientUUID, newFqdn, suffix, records)
 				if ok {
-					log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Matched alternate suffix")
+					if debugging() {
+						log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Matched alternate suffix")
+					}
 					return
 				}
 			}
@@ -200,7 +330,15 @@ func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn str
 	return nil, false
 }
 
-func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+func (s *Snapshot) MatchingExact(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	if s.index != nil {
+		return s.index.exact(qtype, clientUUID, fqdn, answerFqdn)
+	}
+	return s.buildExact(qtype, clientUUID, fqdn, answerFqdn)
+}
+
+// Builds the records for fqdn from the answers
+func (answers *Answers) buildExact(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
 	client, ok := (*answers)[clientUUID]
 	if ok {
 		switch qtype {
@@ -216,6 +354,10 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 				for i := 0; i < len(res.Answer); i++ {
 					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
 					ip := net.ParseIP(res.Answer[i])
+					if ip == nil {
+						log.WithFields(log.Fields{"qtype": "A", "client": clientUUID, "fqdn": fqdn}).Warn("Invalid address: ", res.Answer[i])
+						continue
+					}
 					record := &dns.A{Hdr: hdr, A: ip}
 					records = append(records, record)
 				}
@@ -223,6 +365,28 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 				shuffle(&records)
 			}
 
+		case dns.TypeAAAA:
+			res, ok := client.Aaaa[fqdn]
+			if ok && len(res.Answer) > 0 {
+				ttl := uint32(*defaultTtl)
+				if res.Ttl != nil {
+					ttl = *res.Ttl
+				}
+
+				for i := 0; i < len(res.Answer); i++ {
+					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+					ip := net.ParseIP(res.Answer[i])
+					if ip == nil {
+						log.WithFields(log.Fields{"qtype": "AAAA", "client": clientUUID, "fqdn": fqdn}).Warn("Invalid address: ", res.Answer[i])
+						continue
+					}
+					record := &dns.AAAA{Hdr: hdr, AAAA: ip}
+					records = append(records, record)
+				}
+
+				shuffle(&records)
+			}
+
 		case dns.TypeCNAME:
 			//log.WithFields(log.Fields{"qtype": "CNAME", "client": clientUUID, "fqdn": fqdn}).Debug("Searching for CNAME")
 			res, ok := client.Cname[fqdn]
@@ -262,12 +426,28 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 			if ok {
 				for i := 0; i < len(res.Answer); i++ {
 					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
-					str := res.Answer[i]
-					if len(str) > 255 {
-						log.WithFields(log.Fields{"qtype": "TXT", "client": clientUUID, "fqdn": fqdn}).Warn("TXT record too long: ", str)
-						return nil, false
+					for _, str := range res.Answer[i] {
+						if len(str) > 255 {
+							log.WithFields(log.Fields{"qtype": "TXT", "client": clientUUID, "fqdn": fqdn}).Warn("TXT record too long: ", str)
+							return nil, false
+						}
 					}
-					record := &dns.TXT{Hdr: hdr, Txt: []string{str}}
+					record := &dns.TXT{Hdr: hdr, Txt: res.Answer[i]}
+					records = append(records, record)
+				}
+			}
+
+		case dns.TypeSRV:
+			res, ok := client.Srv[fqdn]
+			ttl := uint32(*defaultTtl)
+			if res.Ttl != nil {
+				ttl = *res.Ttl
+			}
+
+			if ok {
+				for _, target := range res.Answer {
+					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl}
+					record := &dns.SRV{Hdr: hdr, Priority: target.Priority, Weight: target.Weight, Port: target.Port, Target: target.Target}
 					records = append(records, record)
 				}
 			}
@@ -281,20 +461,29 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 	}
 }
 
-// Shuffles the sub-section of the supplied slice starting from the first A or AAAA record and going
-// until the end. In other words, doesn't shuffle CNAME records at the start of the slice whose order
-// should be maintained.
+// Whether debug messages are logged. Lookups check before building their fields, which costs
+// more than the lookups themselves.
+func debugging() bool {
+	return log.GetLevel() >= log.DebugLevel
+}
+
+// Shuffles the A and AAAA records of each RRset among the positions of that RRset, leaving every
+// other record where it is: CNAMEs keep leading up to their targets, and signatures stay right
+// after the RRset they cover.
 func shuffle(items *[]dns.RR) {
-	max := len(*items)
-	foundA := false
+	positions := make(map[string][]int)
+	for i, rr := range *items {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA {
+			key := rrsetKey(hdr.Name, hdr.Rrtype)
+			positions[key] = append(positions[key], i)
+		}
+	}
 
-	for i := 0; i < max; i++ {
-		record := (*items)[i].Header()
-		if !foundA && record.Rrtype != dns.TypeA && record.Rrtype != dns.TypeAAAA {
-			continue
+	for _, rrset := range positions {
+		for i := len(rrset) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			(*items)[rrset[i]], (*items)[rrset[j]] = (*items)[rrset[j]], (*items)[rrset[i]]
 		}
-		foundA = true
-		j := i + rand.Intn(max-i)
-		(*items)[i], (*items)[j] = (*items)[j], (*items)[i]
 	}
 }
@@ -76,20 +76,20 @@ func (t *Tests) testShuffle(aType uint16, c *check.C) {
 		Ttl:    100,
 	}
 	arecord1 := &dns.RR_Header{
-		Name:   "arecord1",
-		Rrtype: dns.TypeA,
+		Name:   "arecord",
+		Rrtype: aType,
 		Class:  dns.ClassINET,
 		Ttl:    100,
 	}
 	arecord2 := &dns.RR_Header{
-		Name:   "arecord2",
-		Rrtype: dns.TypeA,
+		Name:   "arecord",
+		Rrtype: aType,
 		Class:  dns.ClassINET,
 		Ttl:    100,
 	}
 	arecord3 := &dns.RR_Header{
-		Name:   "arecord3",
-		Rrtype: dns.TypeA,
+		Name:   "arecord",
+		Rrtype: aType,
 		Class:  dns.ClassINET,
 		Ttl:    100,
 	}
@@ -108,13 +108,13 @@ func (t *Tests) testShuffle(aType uint16, c *check.C) {
 	for i := 0; i < 100; i++ {
 		shuffle(&records)
 		c.Check(records[:2], check.DeepEquals, expected)
-		if records[2].Header().Name == "arecord1" {
+		if records[2] == arecord1 {
 			aRecord1First = true
 		}
-		if records[2].Header().Name == "arecord2" {
+		if records[2] == arecord2 {
 			aRecord2First = true
 		}
-		if records[2].Header().Name == "arecord3" {
+		if records[2] == arecord3 {
 			aRecord3First = true
 		}
 	}
@@ -124,3 +124,26 @@ func (t *Tests) testShuffle(aType uint16, c *check.C) {
 	c.Check(aRecord2First, check.Equals, true)
 	c.Check(aRecord3First, check.Equals, true)
 }
+
+func (t *Tests) TestAny(c *check.C) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A:   map[string]RecordA{"web.": {Answer: []string{"10.1.2.3", "10.1.2.4"}}},
+			Txt: map[string]RecordTxt{"web.": {Answer: []AnswerStrings{{"hello"}}}},
+		},
+	}
+
+	records, ok := unindexed(answers).Any("10.1.2.2", "web.", "web.", false)
+	c.Assert(ok, check.Equals, true)
+	c.Check(len(records), check.Equals, 2)
+	for _, rr := range records {
+		c.Check(rr.Header().Rrtype, check.Equals, dns.TypeA)
+	}
+
+	records, ok = unindexed(answers).Any("10.1.2.2", "web.", "web.", true)
+	c.Assert(ok, check.Equals, true)
+	c.Check(len(records), check.Equals, 3)
+
+	_, ok = unindexed(answers).Any("10.1.2.2", "nothere.", "nothere.", true)
+	c.Check(ok, check.Equals, false)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -20,21 +22,44 @@ func getClientCache(clientUUID string) *cache.Cache {
 	return clientCache
 }
 
-func globalCacheHit(req *dns.Msg) (*dns.Msg, time.Time) {
-	return globalCache.Hit(req.Question[0], false, false, req.MsgHdr.Id)
+// The ECS scope prefix lengths answers have been cached with, so that lookups only try those
+var cachedScopes [129]uint32
+
+func globalCacheHit(req *dns.Msg, subnet *dns.EDNS0_SUBNET) (*dns.Msg, time.Time) {
+	msg, exp := globalCache.Hit(req.Question[0], validating(req), false, req.MsgHdr.Id)
+	if msg != nil || subnet == nil {
+		return msg, exp
+	}
+	// Answers that are only valid for a network the client's subnet is in, the most specific first
+	for scope := int(subnet.SourceNetmask); scope > 0; scope-- {
+		if atomic.LoadUint32(&cachedScopes[scope]) == 0 {
+			continue
+		}
+		key := cache.KeySubnet(req.Question[0], validating(req), false, subnetNetwork(subnet, uint8(scope)))
+		if msg, exp := globalCache.HitKey(key, req.MsgHdr.Id); msg != nil {
+			return msg, exp
+		}
+	}
+	return nil, time.Time{}
 }
 
+// Signed responses (with the NSEC records of their denials) are kept apart from the others
 func clientSpecificCacheHit(clientUUID string, req *dns.Msg) (*dns.Msg, time.Time) {
-	return getClientCache(clientUUID).Hit(req.Question[0], false, false, req.MsgHdr.Id)
+	return getClientCache(clientUUID).Hit(req.Question[0], signing(req), false, req.MsgHdr.Id)
 }
 
-func addToCache(req, msg *dns.Msg, clientUUID ...string) {
-	var currCache *cache.Cache
-	if len(clientUUID) == 0 {
-		currCache = globalCache
-	} else {
-		currCache = getClientCache(clientUUID[0])
+// Like clientSpecificCacheHit, without creating a cache for clients that don't have one
+func peekClientSpecificCache(clientUUID string, req *dns.Msg) (*dns.Msg, time.Time) {
+	clientSpecificCachesMutex.RLock()
+	clientCache, ok := clientSpecificCaches[clientUUID]
+	clientSpecificCachesMutex.RUnlock()
+	if !ok {
+		return nil, time.Time{}
 	}
+	return clientCache.Hit(req.Question[0], signing(req), false, req.MsgHdr.Id)
+}
+
+func addToCache(currCache *cache.Cache, key string, msg *dns.Msg) {
 	ttl := currCache.GetTTL()
 	if len(msg.Answer) > 0 {
 		var requestTtl = time.Duration(msg.Answer[0].Header().Ttl) * time.Second
@@ -42,16 +67,32 @@ func addToCache(req, msg *dns.Msg, clientUUID ...string) {
 			ttl = requestTtl
 		}
 	}
-	key := cache.Key(req.Question[0], false, false)
 	currCache.InsertMessage(key, msg, ttl)
 }
 
-func addToGlobalCache(req, msg *dns.Msg) {
-	addToCache(req, msg)
+func addToGlobalCache(req, msg *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	// An answer with a non-zero ECS scope is only valid for the network of that scope, which can't
+	// be more specific than the subnet that was asked
+	var network *net.IPNet
+	if e := clientSubnetOption(msg); subnet != nil && e != nil && e.SourceScope > 0 {
+		scope := e.SourceScope
+		if scope > subnet.SourceNetmask {
+			scope = subnet.SourceNetmask
+		}
+		network = subnetNetwork(subnet, scope)
+		atomic.StoreUint32(&cachedScopes[scope], 1)
+	}
+	// Validated answers are kept apart from unvalidated ones
+	addToCache(globalCache, cache.KeySubnet(req.Question[0], validating(req), false, network), msg)
 }
 
+// Responses to be signed are cached signed, so that their signatures are made with the original
+// TTLs rather than the ones counted down by the cache
 func addToClientSpecificCache(clientUUID string, req, msg *dns.Msg) {
-	addToCache(req, msg, clientUUID)
+	if signing(req) {
+		signer.Sign(msg)
+	}
+	addToCache(getClientCache(clientUUID), cache.Key(req.Question[0], signing(req), false), msg)
 }
 
 func clearClientSpecificCaches() {
@@ -59,3 +100,9 @@ func clearClientSpecificCaches() {
 	clientSpecificCaches = make(map[string]*cache.Cache)
 	clientSpecificCachesMutex.Unlock()
 }
+
+func clearGlobalCache() {
+	if globalCache != nil {
+		globalCache.Clear()
+	}
+}
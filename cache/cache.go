@@ -11,6 +11,7 @@ package cache
 
 import (
 	"crypto/sha1"
+	"net"
 	"sync"
 	"time"
 
@@ -51,6 +52,13 @@ func (c *Cache) Remove(s string) {
 	c.Unlock()
 }
 
+// Clear removes all members of the cache.
+func (c *Cache) Clear() {
+	c.Lock()
+	c.m = make(map[string]*elem)
+	c.Unlock()
+}
+
 // EvictRandom removes a random member a the cache.
 // Must be called under a write lock.
 func (c *Cache) EvictRandom() {
@@ -122,6 +130,12 @@ func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
 // Key creates a hash key from a question section. It creates a different key
 // for requests with DNSSEC.
 func Key(q dns.Question, dnssec, tcp bool) string {
+	return KeySubnet(q, dnssec, tcp, nil)
+}
+
+// KeySubnet is like Key, but also takes the client subnet an EDNS Client Subnet
+// answer is valid for. A nil subnet gives the same key as Key.
+func KeySubnet(q dns.Question, dnssec, tcp bool, subnet *net.IPNet) string {
 	h := sha1.New()
 	i := append([]byte(q.Name), packUint16(q.Qtype)...)
 	if dnssec {
@@ -130,14 +144,19 @@ func Key(q dns.Question, dnssec, tcp bool) string {
 	if tcp {
 		i = append(i, byte(254))
 	}
+	if subnet != nil {
+		i = append(i, []byte(subnet.String())...)
+	}
 	return string(h.Sum(i))
 }
 
-// Key uses the name, type and rdata, which is serialized and then hashed as the key for the lookup.
+// Key uses the name, type, TTL and rdata, which is serialized and then hashed as the key for the lookup.
+// The TTL is part of it since signatures cover the original TTL.
 func KeyRRset(rrs []dns.RR) string {
 	h := sha1.New()
 	i := []byte(rrs[0].Header().Name)
 	i = append(i, packUint16(rrs[0].Header().Rrtype)...)
+	i = append(i, packUint32(rrs[0].Header().Ttl)...)
 	for _, r := range rrs {
 		switch t := r.(type) { // we only do a few type, serialize these manually
 		case *dns.SOA:
@@ -146,7 +165,7 @@ func KeyRRset(rrs []dns.RR) string {
 		case *dns.SRV:
 			i = append(i, packUint16(t.Priority)...)
 			i = append(i, packUint16(t.Weight)...)
-			i = append(i, packUint16(t.Weight)...)
+			i = append(i, packUint16(t.Port)...)
 			i = append(i, []byte(t.Target)...)
 		case *dns.A:
 			i = append(i, []byte(t.A)...)
@@ -155,9 +174,24 @@ func KeyRRset(rrs []dns.RR) string {
 		case *dns.NSEC3:
 			i = append(i, []byte(t.NextDomain)...)
 			// Bitmap does not differentiate in SkyDNS.
+		case *dns.CNAME:
+			i = append(i, []byte(t.Target)...)
+		case *dns.PTR:
+			i = append(i, []byte(t.Ptr)...)
+		case *dns.TXT:
+			// Length prefixed, so that the boundaries between strings count
+			for _, txt := range t.Txt {
+				i = append(i, packUint16(uint16(len(txt)))...)
+				i = append(i, []byte(txt)...)
+			}
+		case *dns.NSEC:
+			i = append(i, []byte(t.NextDomain)...)
+			for _, typ := range t.TypeBitMap {
+				i = append(i, packUint16(typ)...)
+			}
 		case *dns.DNSKEY:
+			i = append(i, packUint16(t.KeyTag())...)
 		case *dns.NS:
-		case *dns.TXT:
 		}
 	}
 	return string(h.Sum(i))
@@ -13,7 +13,11 @@ import (
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
 // is returned and the message is removed from the cache.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) (*dns.Msg, time.Time) {
-	key := Key(question, dnssec, tcp)
+	return c.HitKey(Key(question, dnssec, tcp), msgid)
+}
+
+// HitKey is like Hit, but looks up a key that was already computed, e.g. by KeySubnet.
+func (c *Cache) HitKey(key string, msgid uint16) (*dns.Msg, time.Time) {
 	m1, exp, hit := c.Search(key)
 	if hit {
 		// Cache hit! \o/
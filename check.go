@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A problem found in an answers file, at a location like default.a["mysql."].answer[1]
+type AnswersProblem struct {
+	Location string
+	Message  string
+}
+
+func (p AnswersProblem) Error() string {
+	if p.Location == "" {
+		return p.Message
+	}
+	return p.Location + ": " + p.Message
+}
+
+type answersChecker struct {
+	problems []error
+}
+
+func (c *answersChecker) add(location string, format string, args ...interface{}) {
+	c.problems = append(c.problems, AnswersProblem{Location: location, Message: fmt.Sprintf(format, args...)})
+}
+
+var plainSectionKey = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_-]*$")
+
+func sectionLocation(key string) string {
+	if plainSectionKey.MatchString(key) {
+		return key
+	}
+	return fmt.Sprintf("%q", key)
+}
+
+func recordLocation(section string, field string, name string) string {
+	return fmt.Sprintf("%s.%s[%q]", sectionLocation(section), field, name)
+}
+
+// Returns every problem in the content of an answers file: syntax errors, unknown fields,
+// invalid addresses and networks, names that can never match, CNAME loops and TXT strings that
+// are too long.
+func CheckAnswers(data []byte) []error {
+	c := &answersChecker{}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		c.add("", "%v", err)
+		return c.problems
+	}
+	var answers Answers
+	if err := yaml.Unmarshal(data, &answers); err != nil {
+		c.add("", "%v", err)
+		return c.problems
+	}
+
+	sections := make([]string, 0, len(answers))
+	for key := range answers {
+		sections = append(sections, key)
+	}
+	sort.Strings(sections)
+
+	for _, key := range sections {
+		c.checkFields(raw[key], reflect.TypeOf(ClientAnswers{}), sectionLocation(key))
+		c.checkSection(key, answers[key], answers[DEFAULT_KEY])
+	}
+	return c.problems
+}
+
+// Reports keys that don't correspond to a field of t
+func (c *answersChecker) checkFields(raw interface{}, t reflect.Type, location string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.ToLower(f.Name)
+			if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; tag != "" {
+				name = tag
+			}
+			fields[name] = f.Type
+		}
+		for _, k := range sortedKeys(m) {
+			ft, ok := fields[k]
+			if !ok {
+				c.add(location, "unknown field %q", k)
+				continue
+			}
+			c.checkFields(m[k], ft, location+"."+k)
+		}
+	case reflect.Map:
+		m, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for _, k := range sortedKeys(m) {
+			c.checkFields(m[k], t.Elem(), fmt.Sprintf("%s[%q]", location, k))
+		}
+	case reflect.Slice:
+		s, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, v := range s {
+			c.checkFields(v, t.Elem(), fmt.Sprintf("%s[%d]", location, i))
+		}
+	}
+}
+
+func sortedKeys(m map[interface{}]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, fmt.Sprint(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reports names that can't match a query: queries are always fully qualified and lowercased
+func (c *answersChecker) checkName(location string, name string, what string) {
+	if !strings.HasSuffix(name, ".") {
+		c.add(location, "%s %q is not fully qualified (missing trailing dot)", what, name)
+	}
+	if strings.ToLower(name) != name {
+		c.add(location, "%s %q is not lowercase", what, name)
+	}
+}
+
+func (c *answersChecker) checkSection(key string, client ClientAnswers, def ClientAnswers) {
+	for _, name := range sortedRecordKeys(client.A) {
+		location := recordLocation(key, "a", name)
+		c.checkName(location, name, "name")
+		for i, answer := range client.A[name].Answer {
+			if ip := net.ParseIP(answer); ip == nil || ip.To4() == nil {
+				c.add(fmt.Sprintf("%s.answer[%d]", location, i), "invalid IPv4 address %q", answer)
+			}
+		}
+	}
+
+	for _, name := range sortedRecordKeys(client.Aaaa) {
+		location := recordLocation(key, "aaaa", name)
+		c.checkName(location, name, "name")
+		for i, answer := range client.Aaaa[name].Answer {
+			if ip := net.ParseIP(answer); ip == nil || ip.To4() != nil {
+				c.add(fmt.Sprintf("%s.answer[%d]", location, i), "invalid IPv6 address %q", answer)
+			}
+		}
+	}
+
+	for _, name := range sortedRecordKeys(client.Cname) {
+		location := recordLocation(key, "cname", name)
+		c.checkName(location, name, "name")
+		c.checkName(location+".answer", client.Cname[name].Answer, "target")
+		if loop := cnameLoop(name, client, def); loop != nil {
+			c.add(location, "CNAME loop %s", strings.Join(loop, " -> "))
+		}
+	}
+
+	for _, name := range sortedRecordKeys(client.Ptr) {
+		location := recordLocation(key, "ptr", name)
+		if net.ParseIP(name) == nil {
+			c.checkName(location, name, "name")
+			if !strings.HasSuffix(name, ".arpa.") {
+				c.add(location, "%q is neither an IP address nor a reverse (.arpa.) name", name)
+			}
+		}
+		c.checkName(location+".answer", client.Ptr[name].Answer, "target")
+	}
+
+	for _, name := range sortedRecordKeys(client.Txt) {
+		location := recordLocation(key, "txt", name)
+		c.checkName(location, name, "name")
+		for i, answer := range client.Txt[name].Answer {
+			for j, str := range answer {
+				answerLocation := fmt.Sprintf("%s.answer[%d]", location, i)
+				if len(answer) > 1 {
+					answerLocation += fmt.Sprintf("[%d]", j)
+				}
+				if len(str) > 255 {
+					c.add(answerLocation, "TXT string is %d bytes long, the maximum is 255", len(str))
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedRecordKeys(client.Srv) {
+		location := recordLocation(key, "srv", name)
+		c.checkName(location, name, "name")
+		for i, answer := range client.Srv[name].Answer {
+			c.checkName(fmt.Sprintf("%s.answer[%d].target", location, i), answer.Target, "target")
+		}
+	}
+
+	for _, name := range sortedRecordKeys(client.Soa) {
+		c.checkName(recordLocation(key, "soa", name), name, "zone")
+	}
+
+	c.problems = append(c.problems, aclProblems(key, client)...)
+
+	for i, hosts := range client.Hosts {
+		if hosts.Path == "" {
+			c.add(fmt.Sprintf("%s.hosts[%d]", sectionLocation(key), i), "missing path")
+		}
+	}
+	for i, zone := range client.Zones {
+		if zone.Path == "" {
+			c.add(fmt.Sprintf("%s.zones[%d]", sectionLocation(key), i), "missing path")
+		}
+	}
+}
+
+// The CNAME chain from name back to itself, if name is part of a loop. Loops are only reported
+// for their first name (in sort order), so that each loop is reported once.
+func cnameLoop(name string, client ClientAnswers, def ClientAnswers) []string {
+	chain := []string{name}
+	target := name
+	for i := 0; i <= len(client.Cname)+len(def.Cname); i++ {
+		rec, ok := client.Cname[target]
+		if !ok {
+			if rec, ok = def.Cname[target]; !ok {
+				return nil
+			}
+		}
+		target = rec.Answer
+		chain = append(chain, target)
+		if target == name {
+			for _, n := range chain {
+				if n < name {
+					return nil
+				}
+			}
+			return chain
+		}
+	}
+	return nil
+}
+
+func sortedRecordKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reads the hosts and zone files each section includes, the way loading merges them
+func checkIncludes(answers Answers) []error {
+	c := &answersChecker{}
+	sections := make([]string, 0, len(answers))
+	for key := range answers {
+		sections = append(sections, key)
+	}
+	sort.Strings(sections)
+
+	for _, key := range sections {
+		section := Answers{key: answers[key]}
+		if err := MergeHosts(&section); err != nil {
+			c.add(sectionLocation(key)+".hosts", "%v", err)
+		}
+		if err := MergeZones(&section); err != nil {
+			c.add(sectionLocation(key)+".zones", "%v", err)
+		}
+	}
+	return c.problems
+}
+
+// Checks an answers file and the files it includes, printing every problem found. Returns the
+// exit status for --check.
+func checkAnswersFile(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+
+	problems := CheckAnswers(data)
+	var answers Answers
+	if err := yaml.Unmarshal(data, &answers); err == nil {
+		problems = append(problems, checkIncludes(answers)...)
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %v\n", path, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problem(s) found\n", path, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", path)
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAnswers(t *testing.T) {
+	problems := CheckAnswers([]byte(`
+default:
+  recurse: ["8.8.8.8"]
+  serach: ["discover.internal."]
+  a:
+    mysql.:
+      answer: ["10.1.2.3", "10.1.2.x", "fd00::1"]
+    Web:
+      answer: ["10.1.2.4"]
+      tll: 42
+  aaaa:
+    web.:
+      answer: ["10.1.2.4"]
+  cname:
+    a.:
+      answer: b.
+    b.:
+      answer: a.
+    self.:
+      answer: self.
+  ptr:
+    10.1.2.3:
+      answer: mysql
+  txt:
+    long.:
+      answer: ["` + strings.Repeat("x", 256) + `"]
+"10.42.1.2":
+  allow-query: ["10.0.0.0/33"]
+`))
+
+	expected := []string{
+		`default: unknown field "serach"`,
+		`default.a["Web"]: unknown field "tll"`,
+		`default.a["Web"]: name "Web" is not fully qualified (missing trailing dot)`,
+		`default.a["Web"]: name "Web" is not lowercase`,
+		`default.a["mysql."].answer[1]: invalid IPv4 address "10.1.2.x"`,
+		`default.a["mysql."].answer[2]: invalid IPv4 address "fd00::1"`,
+		`default.aaaa["web."].answer[0]: invalid IPv6 address "10.1.2.4"`,
+		`default.cname["a."]: CNAME loop a. -> b. -> a.`,
+		`default.cname["self."]: CNAME loop self. -> self.`,
+		`default.ptr["10.1.2.3"].answer: target "mysql" is not fully qualified (missing trailing dot)`,
+		`default.txt["long."].answer[0]: TXT string is 256 bytes long, the maximum is 255`,
+		`"10.42.1.2".allow-query[0]: invalid network "10.0.0.0/33"`,
+	}
+
+	found := make(map[string]bool)
+	for _, p := range problems {
+		found[p.Error()] = true
+	}
+	for _, e := range expected {
+		if !found[e] {
+			t.Errorf("Missing problem: %s", e)
+		}
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+
+	if problems := CheckAnswers([]byte("default: [")); len(problems) != 1 {
+		t.Errorf("Expected a syntax error [%v]", problems)
+	}
+	if problems := CheckAnswers([]byte(`{"default": {"a": {"web.": {"answer": ["10.1.2.4"], "ttl": 42}}}}`)); len(problems) != 0 {
+		t.Errorf("Expected no problems [%v]", problems)
+	}
+}
+
+func TestCheckIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte("10.1.2.3 db\n"), 0644)
+	zone := filepath.Join(dir, "example.com.zone")
+	ioutil.WriteFile(zone, []byte("www IN A 10.1.2.x\n"), 0644)
+
+	problems := checkIncludes(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Hosts: []HostsFile{{Path: hosts}},
+			Zones: []ZoneFile{{Path: zone, Origin: "example.com."}},
+		},
+		"10.42.1.2": ClientAnswers{
+			Hosts: []HostsFile{{Path: filepath.Join(dir, "missing")}},
+		},
+	})
+	if len(problems) != 2 {
+		t.Fatalf("Expected the bad zone and the missing hosts file [%v]", problems)
+	}
+	if !strings.HasPrefix(problems[0].Error(), `"10.42.1.2".hosts: `) || !strings.HasPrefix(problems[1].Error(), "default.zones: ") {
+		t.Errorf("Expected the problems by section [%v]", problems)
+	}
+}
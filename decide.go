@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How a query is answered, in the order route tries them
+const (
+	DECISION_REFUSED           = iota // the client may not query this server
+	DECISION_ANSWER                   // answered locally, not cached (ANY, DNSKEY)
+	DECISION_CLIENT_CACHE             // the client's cached response
+	DECISION_LOCAL                    // answered from the answers, cached for the client
+	DECISION_RECURSION_REFUSED        // not found locally, and the client may not recurse
+	DECISION_POLICY                   // a response policy answers instead
+	DECISION_GLOBAL_CACHE             // a cached recursive response
+	DECISION_NXDOMAIN                 // not found in a zone we are authoritative for
+	DECISION_RECURSE                  // the recursers answer
+)
+
+// A query as route and Explain see it
+type query struct {
+	req        *dns.Msg
+	clientIp   string
+	clientUUID string
+	fqdn       string // lower case
+	tcp        bool
+	// Set when explaining: the steps are traced, and caches are only looked at
+	trace *Trace
+}
+
+type decision struct {
+	action int
+	// Why, for the logs of answers that aren't looked up
+	reason string
+	// The cached response, and when it expires
+	msg *dns.Msg
+	exp time.Time
+	// The answer is a denial, signed with NSEC records when the client wants DNSSEC
+	deny bool
+	// The policy zones, the rule that answers and whether a PASSTHRU rule applies
+	policies Policies
+	rule     *rpzRule
+	passthru bool
+	subnet   *dns.EDNS0_SUBNET
+}
+
+// Decides how to answer a query, filling in m (a reply to it) when it's answered from the
+// answers. Nothing is sent, recursed, or added to caches here.
+func (s *Snapshot) decide(q *query, m *dns.Msg) decision {
+	t := q.trace
+	qtype := q.req.Question[0].Qtype
+	clientUUID := q.clientUUID
+	fqdn := q.fqdn
+	lookupFqdn := formatFqdn(clientUUID, fqdn)
+
+	if !s.QueryAllowed(q.clientIp) {
+		t.add("acl", "%s is not allowed to query", q.clientIp)
+		m.Authoritative = false
+		m.RecursionAvailable = false
+		m.Rcode = dns.RcodeRefused
+		return decision{action: DECISION_REFUSED}
+	}
+	recursionAllowed := s.RecursionAllowed(q.clientIp)
+	m.RecursionAvailable = recursionAllowed
+	if !recursionAllowed {
+		t.add("acl", "%s is not allowed to recurse", q.clientIp)
+	}
+
+	// ANY queries get a minimal response (RFC 8482)
+	if qtype == dns.TypeANY {
+		if found, ok := s.Any(clientUUID, lookupFqdn, fqdn, q.tcp && *anyTcpFull); ok {
+			t.add("answer", "answered ANY locally")
+			m.Answer = found
+			return decision{action: DECISION_ANSWER, reason: "Answered ANY locally"}
+		}
+		if !s.IsAuthoritative(fqdn) {
+			t.add("answer", "not found locally, answered ANY with HINFO")
+			m.Authoritative = false
+			hdr := dns.RR_Header{Name: q.req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+			m.Answer = []dns.RR{&dns.HINFO{Hdr: hdr, Cpu: "RFC8482", Os: ""}}
+			return decision{action: DECISION_ANSWER, reason: "Answered ANY with HINFO"}
+		}
+		// Unknown names we are authoritative for get the usual NXDOMAIN below
+	}
+
+	// Keys of the zones we sign are served at their apex
+	if signer != nil && qtype == dns.TypeDNSKEY {
+		if keys := signer.Keys(fqdn); keys != nil {
+			t.add("answer", "answered with the keys of zone %s", fqdn)
+			m.Answer = keys
+			return decision{action: DECISION_ANSWER, reason: "Answered DNSKEY"}
+		}
+	}
+
+	if t == nil {
+		if msg, exp := clientSpecificCacheHit(clientUUID, q.req); msg != nil {
+			return decision{action: DECISION_CLIENT_CACHE, msg: msg, exp: exp}
+		}
+	} else if clientSpecificCaches != nil {
+		if msg, exp := peekClientSpecificCache(clientUUID, q.req); msg != nil {
+			t.add("cache", "client cache hit, expires in %s", untilSecond(exp))
+			return decision{action: DECISION_CLIENT_CACHE, msg: msg, exp: exp}
+		}
+		t.add("cache", "not in the client cache")
+	}
+
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		// May return CNAME answer(s) plus address answer(s)
+		if found, ok := s.addresses(t, qtype, clientUUID, lookupFqdn, fqdn, nil, 1); ok && len(found) > 0 {
+			t.add("answer", "answered locally")
+			m.Answer = found
+			return decision{action: DECISION_LOCAL}
+		}
+		// Names with only IPv4 addresses get an empty answer
+		if qtype == dns.TypeAAAA {
+			if _, ok := s.addresses(t, dns.TypeA, clientUUID, lookupFqdn, fqdn, nil, 1); ok {
+				t.add("answer", "%s only has IPv4 addresses, empty answer", fqdn)
+				m.Authoritative = true
+				m.Rcode = dns.RcodeSuccess
+				return decision{action: DECISION_LOCAL, deny: true}
+			}
+		}
+	default:
+		// Specific request for another kind of record
+		for _, key := range []string{clientUUID, DEFAULT_KEY} {
+			if found, ok := s.matching(t, qtype, key, lookupFqdn, fqdn); ok {
+				t.add("answer", "answered locally from section %s", key)
+				m.Answer = found
+				return decision{action: DECISION_LOCAL}
+			}
+		}
+	}
+
+	// Only local answers for clients that may not recurse
+	if !recursionAllowed && !s.IsAuthoritative(fqdn) {
+		t.add("answer", "not found locally and recursion is not allowed, REFUSED")
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		return decision{action: DECISION_RECURSION_REFUSED}
+	}
+
+	// Response policy zones, by client and query name. PASSTHRU responses skip the checks of the
+	// addresses in the response, so they are not cached for other clients.
+	d := decision{policies: currentPolicies(), subnet: upstreamSubnet(q.req, q.clientIp)}
+	if rule := d.policies.Query(fqdn, q.clientIp); rule != nil {
+		t.add("policy", "trigger %s in policy zone %s: %s", rule.trigger, rule.zone, rpzActionNames[rule.action])
+		if rule.action != RPZ_PASSTHRU {
+			d.action, d.rule = DECISION_POLICY, rule
+			return d
+		}
+		d.passthru = true
+	}
+
+	if globalCache != nil {
+		if msg, exp := globalCacheHit(q.req, d.subnet); msg != nil {
+			t.add("cache", "global cache hit, expires in %s", untilSecond(exp))
+			d.action, d.msg, d.exp = DECISION_GLOBAL_CACHE, msg, exp
+			return d
+		}
+		t.add("cache", "not in the global cache")
+	}
+
+	// If we are authoritative for a suffix the label has, there's no point trying the recursive DNS
+	for _, suffix := range s.AuthoritativeSuffixes() {
+		zone := strings.TrimLeft(suffix, ".")
+		if strings.HasSuffix(fqdn, suffix) {
+			t.add("authoritative", "not found locally in authoritative zone %s, NXDOMAIN", zone)
+			m.Authoritative = true
+			m.RecursionAvailable = false
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, s.SOA(clientUUID, zone))
+			d.action, d.reason, d.deny = DECISION_NXDOMAIN, "Not answered locally, but I am authoritative for "+zone, true
+			return d
+		}
+		t.add("authoritative", "not authoritative for %s", zone)
+	}
+
+	d.action = DECISION_RECURSE
+	return d
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Changes to one client section of the answers. Records are named by type and name, like
+// "A mysql.", and settings (search, recurse, ...) by their key in the answers file.
+type SectionDiff struct {
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Changed  []string `json:"changed,omitempty"`
+	Settings []string `json:"settings,omitempty"`
+}
+
+// Changes between two versions of the answers, by client section. Unchanged sections are left out.
+type AnswersDiff map[string]*SectionDiff
+
+// The records of a section by "TYPE name", and its other fields by key
+func sectionContents(client ClientAnswers) (records map[string]interface{}, settings map[string]interface{}) {
+	records = make(map[string]interface{})
+	settings = make(map[string]interface{})
+
+	v := reflect.ValueOf(client)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		value := v.Field(i)
+		if f.Type.Kind() == reflect.Map && f.Type.Key().Kind() == reflect.String {
+			for _, k := range value.MapKeys() {
+				records[strings.ToUpper(f.Name)+" "+k.String()] = value.MapIndex(k).Interface()
+			}
+			continue
+		}
+
+		key := strings.ToLower(f.Name)
+		if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; tag != "" {
+			key = tag
+		}
+		// Unset and empty are the same to queries
+		if !isEmptyValue(value) {
+			settings[key] = value.Interface()
+		}
+	}
+	return records, settings
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func diffKeys(old map[string]interface{}, new map[string]interface{}) (added []string, removed []string, changed []string) {
+	for key, value := range new {
+		if oldValue, ok := old[key]; !ok {
+			added = append(added, key)
+		} else if !reflect.DeepEqual(oldValue, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// Compares two versions of the answers
+func DiffAnswers(old Answers, new Answers) AnswersDiff {
+	diff := make(AnswersDiff)
+	keys := make(map[string]bool)
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		oldRecords, oldSettings := sectionContents(old[key])
+		newRecords, newSettings := sectionContents(new[key])
+
+		d := &SectionDiff{}
+		d.Added, d.Removed, d.Changed = diffKeys(oldRecords, newRecords)
+		added, removed, changed := diffKeys(oldSettings, newSettings)
+		d.Settings = append(append(added, removed...), changed...)
+		sort.Strings(d.Settings)
+
+		if len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.Settings) > 0 {
+			diff[key] = d
+		}
+	}
+	return diff
+}
+
+func (d AnswersDiff) sections() []string {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Summary like "default: +2 -1 ~1 settings [recurse]"
+func (d AnswersDiff) String() string {
+	if len(d) == 0 {
+		return "no changes"
+	}
+	var parts []string
+	for _, key := range d.sections() {
+		s := d[key]
+		part := fmt.Sprintf("%s: +%d -%d ~%d", key, len(s.Added), len(s.Removed), len(s.Changed))
+		if len(s.Settings) > 0 {
+			part += fmt.Sprintf(" settings %v", s.Settings)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Logs what changed in each section at info level
+func (d AnswersDiff) Log() {
+	if len(d) == 0 {
+		log.Info("Reloaded answers, nothing changed")
+		return
+	}
+	for _, key := range d.sections() {
+		s := d[key]
+		log.WithFields(log.Fields{
+			"section":  key,
+			"added":    s.Added,
+			"removed":  s.Removed,
+			"changed":  s.Changed,
+			"settings": s.Settings,
+		}).Info("Answers changed")
+	}
+}
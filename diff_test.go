@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDiffAnswers(t *testing.T) {
+	ttl := uint32(30)
+	old := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8"},
+			A: map[string]RecordA{
+				"web.":   {Answer: []string{"10.1.0.1"}},
+				"db.":    {Answer: []string{"10.1.0.2"}},
+				"cache.": {Answer: []string{"10.1.0.3"}},
+			},
+			Cname: map[string]RecordCname{"www.": {Answer: "web."}},
+		},
+		"10.42.1.5": ClientAnswers{
+			Search: []string{"stack.svc."},
+			A:      map[string]RecordA{"api.": {Answer: []string{"10.1.0.9"}}},
+		},
+	}
+	new := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"1.1.1.1"},
+			Search:  []string{},
+			A: map[string]RecordA{
+				"web.":   {Answer: []string{"10.1.0.1"}},
+				"db.":    {Answer: []string{"10.1.0.7"}},
+				"cache.": {Ttl: &ttl, Answer: []string{"10.1.0.3"}},
+				"queue.": {Answer: []string{"10.1.0.4"}},
+			},
+			Txt: map[string]RecordTxt{"www.": {Answer: []AnswerStrings{{"hello"}}}},
+		},
+		"10.42.1.6": ClientAnswers{
+			Search: []string{"stack.svc."},
+		},
+	}
+
+	diff := DiffAnswers(old, new)
+	expected := AnswersDiff{
+		DEFAULT_KEY: {
+			Added:    []string{"A queue.", "TXT www."},
+			Removed:  []string{"CNAME www."},
+			Changed:  []string{"A cache.", "A db."},
+			Settings: []string{"recurse"},
+		},
+		"10.42.1.5": {Removed: []string{"A api."}, Settings: []string{"search"}},
+		"10.42.1.6": {Settings: []string{"search"}},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		b, _ := json.Marshal(diff)
+		t.Fatalf("Unexpected diff %s", b)
+	}
+	if s := diff.String(); s != "10.42.1.5: +0 -1 ~0 settings [search], 10.42.1.6: +0 -0 ~0 settings [search], default: +2 -1 ~2 settings [recurse]" {
+		t.Fatalf("Unexpected summary %q", s)
+	}
+	if diff := DiffAnswers(old, old); len(diff) != 0 {
+		t.Fatalf("Expected no changes [%v]", diff)
+	}
+}
+
+func TestHttpReloadDiff(t *testing.T) {
+	oldChan := reloadChan
+	defer func() { reloadChan = oldChan }()
+	reloadChan = make(chan chan reloadResult)
+	go func() {
+		resp := <-reloadChan
+		resp <- reloadResult{diff: AnswersDiff{DEFAULT_KEY: {Added: []string{"A queue."}}}}
+	}()
+
+	w := httptest.NewRecorder()
+	newReloadRouter().ServeHTTP(w, httptest.NewRequest("POST", "/v1/reload", nil))
+	var body struct {
+		Status  string
+		Changes map[string]map[string][]string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Status != "OK" || body.Changes[DEFAULT_KEY]["added"][0] != "A queue." {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// How long to wait before following the events again after losing them
+	dockerRetryDelay = 5 * time.Second
+)
+
+// Only the fields of the Docker Engine API objects we use
+type dockerEndpoint struct {
+	NetworkID         string   `json:"NetworkID"`
+	IPAddress         string   `json:"IPAddress"`
+	GlobalIPv6Address string   `json:"GlobalIPv6Address"`
+	Aliases           []string `json:"Aliases"`
+	Links             []string `json:"Links"` // container:alias
+}
+
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	HostConfig struct {
+		Links []string `json:"Links"` // /container:/name/alias
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]dockerEndpoint `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerNetwork struct {
+	ID      string            `json:"Id"`
+	Name    string            `json:"Name"`
+	Options map[string]string `json:"Options"`
+}
+
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// Containers on the default bridge (and the host and none networks) don't resolve each other's
+// names, only their links
+func (n dockerNetwork) resolvesNames() bool {
+	if n.Options["com.docker.network.bridge.default_bridge"] == "true" {
+		return false
+	}
+	return n.Name != "bridge" && n.Name != "host" && n.Name != "none"
+}
+
+// Talks to the Docker Engine API over its unix socket
+type DockerClient struct {
+	client *http.Client
+}
+
+func NewDockerClient(socket string) *DockerClient {
+	socket = strings.TrimPrefix(socket, "unix://")
+	return &DockerClient{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// Requests path, cancelled when stop is closed. Missing objects are returned with their status.
+func (c *DockerClient) get(path string, query url.Values, stop <-chan struct{}) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if stop != nil {
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	req, err := http.NewRequest("GET", "http://docker"+path+"?"+query.Encode(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%s %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// Cancels the request of a response body when it's closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (c *DockerClient) getJSON(path string, query url.Values, v interface{}) (found bool, err error) {
+	resp, err := c.get(path, query, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return true, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// The IDs of the running containers
+func (c *DockerClient) Containers() ([]string, error) {
+	var list []struct {
+		ID string `json:"Id"`
+	}
+	if _, err := c.getJSON("/containers/json", nil, &list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list))
+	for _, container := range list {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+// The container, or nil if it's gone
+func (c *DockerClient) Inspect(id string) (*dockerContainer, error) {
+	var container dockerContainer
+	found, err := c.getJSON("/containers/"+url.PathEscape(id)+"/json", nil, &container)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &container, nil
+}
+
+func (c *DockerClient) Networks() ([]dockerNetwork, error) {
+	var networks []dockerNetwork
+	_, err := c.getJSON("/networks", nil, &networks)
+	return networks, err
+}
+
+// Passes the container and network events since since to handle, until the stream ends or stop
+// is closed
+func (c *DockerClient) Events(since time.Time, stop <-chan struct{}, handle func(dockerEvent)) error {
+	filters, _ := json.Marshal(map[string][]string{"type": {"container", "network"}})
+	query := url.Values{
+		"since":   {strconv.FormatInt(since.Unix(), 10)},
+		"filters": {string(filters)},
+	}
+	resp, err := c.get("/events", query, stop)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e dockerEvent
+		if err := decoder.Decode(&e); err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			if err == io.EOF {
+				return fmt.Errorf("The events stream ended")
+			}
+			return err
+		}
+		handle(e)
+	}
+}
+
+// Builds answers from the containers of the local Docker daemon, kept up to date by following its
+// events
+type DockerSource struct {
+	client     *DockerClient
+	mutex      sync.Mutex
+	containers map[string]*dockerContainer // running, by ID
+	networks   map[string]dockerNetwork    // by ID
+	since      time.Time
+	changed    chan struct{}
+
+	// What the last answers were built from, so that events only rebuild what they touch. Answers
+	// that were handed out are never modified, records and sections are replaced instead.
+	records  map[string]dockerRecords // by network ID, shared by the sections of its containers
+	sections map[string]ClientAnswers // by container ID
+	touched  dockerTouched
+	all      bool // everything needs to be rebuilt
+}
+
+// The names of the containers on a network that resolves them
+type dockerRecords struct {
+	a    map[string]RecordA
+	aaaa map[string]RecordA
+}
+
+// The containers, networks and container names changed since the last answers
+type dockerTouched struct {
+	containers map[string]bool
+	networks   map[string]bool
+	names      map[string]bool
+}
+
+func NewDockerSource(client *DockerClient) *DockerSource {
+	return &DockerSource{
+		client:     client,
+		containers: make(map[string]*dockerContainer),
+		networks:   make(map[string]dockerNetwork),
+		changed:    make(chan struct{}, 1),
+		records:    make(map[string]dockerRecords),
+		sections:   make(map[string]ClientAnswers),
+		touched:    newDockerTouched(),
+		all:        true,
+	}
+}
+
+func newDockerTouched() dockerTouched {
+	return dockerTouched{containers: make(map[string]bool), networks: make(map[string]bool), names: make(map[string]bool)}
+}
+
+// Marks what a change of container affects: its own section, the networks it's on, and the
+// containers linking to it. Call with the mutex held, before and after the change.
+func (d *DockerSource) touch(id string, container *dockerContainer) {
+	d.touched.containers[id] = true
+	if container == nil {
+		return
+	}
+	d.touched.names[dockerName(container.Name)] = true
+	for _, endpoint := range container.NetworkSettings.Networks {
+		d.touched.networks[endpoint.NetworkID] = true
+	}
+}
+
+// Signalled when the containers change; several changes may be signalled once
+func (d *DockerSource) Changes() <-chan struct{} {
+	return d.changed
+}
+
+func (d *DockerSource) signal() {
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Lists the networks and the running containers
+func (d *DockerSource) Sync() error {
+	since := time.Now()
+	if err := d.syncNetworks(); err != nil {
+		return err
+	}
+	ids, err := d.client.Containers()
+	if err != nil {
+		return fmt.Errorf("Failed to list containers: %v", err)
+	}
+	containers := make(map[string]*dockerContainer, len(ids))
+	for _, id := range ids {
+		container, err := d.client.Inspect(id)
+		if err != nil {
+			return fmt.Errorf("Failed to inspect container %s: %v", id, err)
+		}
+		if container != nil && container.State.Running {
+			containers[id] = container
+		}
+	}
+
+	d.mutex.Lock()
+	d.containers = containers
+	d.since = since
+	d.all = true
+	d.mutex.Unlock()
+	log.Debugf("Listed %d containers", len(containers))
+	d.signal()
+	return nil
+}
+
+func (d *DockerSource) syncNetworks() error {
+	list, err := d.client.Networks()
+	if err != nil {
+		return fmt.Errorf("Failed to list networks: %v", err)
+	}
+	networks := make(map[string]dockerNetwork, len(list))
+	for _, network := range list {
+		networks[network.ID] = network
+	}
+	d.mutex.Lock()
+	d.networks = networks
+	d.all = true
+	d.mutex.Unlock()
+	return nil
+}
+
+// Follows the events until stop is closed, listing everything again whenever they are lost. Sync
+// first.
+func (d *DockerSource) Run(stop <-chan struct{}) {
+	for {
+		d.mutex.Lock()
+		since := d.since
+		d.mutex.Unlock()
+
+		err := d.client.Events(since, stop, d.handle)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Errorf("Lost the Docker events: %v", err)
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(dockerRetryDelay):
+			}
+			if err := d.Sync(); err != nil {
+				log.Errorf("Failed to list Docker containers: %v", err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (d *DockerSource) handle(e dockerEvent) {
+	var err error
+	switch {
+	case e.Type == "container" && (e.Action == "start" || e.Action == "rename" || e.Action == "unpause"):
+		err = d.refresh(e.Actor.ID)
+	case e.Type == "container" && (e.Action == "die" || e.Action == "stop" || e.Action == "destroy"):
+		d.remove(e.Actor.ID)
+	case e.Type == "network" && (e.Action == "connect" || e.Action == "disconnect"):
+		err = d.refresh(e.Actor.Attributes["container"])
+	case e.Type == "network" && (e.Action == "create" || e.Action == "destroy"):
+		err = d.syncNetworks()
+	default:
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to handle Docker %s %s event: %v", e.Type, e.Action, err)
+		return
+	}
+	log.Debugf("Docker %s %s %s", e.Type, e.Action, e.Actor.ID)
+	d.signal()
+}
+
+// Inspects a container again
+func (d *DockerSource) refresh(id string) error {
+	if id == "" {
+		return nil
+	}
+	container, err := d.client.Inspect(id)
+	if err != nil {
+		return err
+	}
+	if container == nil || !container.State.Running {
+		d.remove(id)
+		return nil
+	}
+	d.mutex.Lock()
+	d.touch(id, d.containers[id])
+	d.containers[id] = container
+	d.touch(id, container)
+	d.mutex.Unlock()
+	return nil
+}
+
+func (d *DockerSource) remove(id string) {
+	d.mutex.Lock()
+	d.touch(id, d.containers[id])
+	delete(d.containers, id)
+	d.mutex.Unlock()
+}
+
+func (d *DockerSource) Name() string {
+	return "docker"
+}
+
+// The answers for the containers. Sync first.
+func (d *DockerSource) Load() (Answers, error) {
+	return d.GenerateAnswers()
+}
+
+// Follows the events for as long as the process runs
+func (d *DockerSource) Watch(changed func()) error {
+	go d.Run(nil)
+	go relayChanges(d.Changes(), changed)
+	return nil
+}
+
+// The answers for the containers: a section for each container IP with the names it can resolve
+// (the containers on its networks by name and alias, and its links), and PTR records for every
+// container in the default section. Only the sections of the containers changed since the last
+// answers are rebuilt.
+func (d *DockerSource) GenerateAnswers() (Answers, error) {
+	recurse, err := getGlobalRecurse()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.all {
+		d.records = make(map[string]dockerRecords)
+		d.sections = make(map[string]ClientAnswers)
+		for id, container := range d.containers {
+			d.touch(id, container)
+		}
+		d.all = false
+	}
+	touched := d.touched
+	d.touched = newDockerTouched()
+
+	// In order, so that addresses that are reused get the same PTR record
+	ids := make([]string, 0, len(d.containers))
+	for id := range d.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	byName := make(map[string]*dockerContainer, len(ids))
+	for _, id := range ids {
+		byName[dockerName(d.containers[id].Name)] = d.containers[id]
+	}
+
+	// The records of the networks that changed
+	for network := range touched.networks {
+		delete(d.records, network)
+	}
+	for _, id := range ids {
+		container := d.containers[id]
+		name := dockerName(container.Name)
+		for networkName, endpoint := range container.NetworkSettings.Networks {
+			if !touched.networks[endpoint.NetworkID] || !d.resolvesNames(networkName, endpoint) {
+				continue
+			}
+			records, ok := d.records[endpoint.NetworkID]
+			if !ok {
+				records = dockerRecords{a: make(map[string]RecordA), aaaa: make(map[string]RecordA)}
+				d.records[endpoint.NetworkID] = records
+			}
+			addDockerRecords(records, name, endpoint.IPAddress, endpoint.GlobalIPv6Address)
+			for _, alias := range endpoint.Aliases {
+				addDockerRecords(records, dockerName(alias), endpoint.IPAddress, endpoint.GlobalIPv6Address)
+			}
+		}
+	}
+	for network := range touched.networks {
+		if records, ok := d.records[network]; ok {
+			sortRecords(records.a)
+			sortRecords(records.aaaa)
+		}
+	}
+
+	// The sections of the containers that changed, that are on a network that changed, or that
+	// link to a container that changed
+	for id := range touched.containers {
+		if _, ok := d.containers[id]; !ok {
+			delete(d.sections, id)
+		}
+	}
+	for _, id := range ids {
+		container := d.containers[id]
+		links := dockerLinks(container)
+		rebuild := touched.containers[id]
+		for _, endpoint := range container.NetworkSettings.Networks {
+			rebuild = rebuild || touched.networks[endpoint.NetworkID]
+		}
+		for _, name := range links {
+			rebuild = rebuild || touched.names[name]
+		}
+		if rebuild {
+			d.sections[id] = d.section(container, links, byName)
+		}
+	}
+
+	def := ClientAnswers{
+		Recurse: recurse,
+		Ptr:     make(map[string]RecordPtr),
+	}
+	answers := Answers{DEFAULT_KEY: def}
+	for _, id := range ids {
+		container := d.containers[id]
+		name := dockerName(container.Name)
+		for _, endpoint := range container.NetworkSettings.Networks {
+			for _, ip := range []string{endpoint.IPAddress, endpoint.GlobalIPv6Address} {
+				if ip != "" {
+					def.Ptr[reverseAddr(ip)] = RecordPtr{Answer: name + "."}
+					answers[ip] = d.sections[id]
+				}
+			}
+		}
+	}
+	return answers, nil
+}
+
+// The links of a container, from their aliases to the names of the containers they link to
+func dockerLinks(container *dockerContainer) map[string]string {
+	links := make(map[string]string)
+	for _, link := range container.HostConfig.Links {
+		if parts := strings.SplitN(link, ":", 2); len(parts) == 2 {
+			links[dockerName(parts[1])] = dockerName(parts[0])
+		}
+	}
+	for _, endpoint := range container.NetworkSettings.Networks {
+		for _, link := range endpoint.Links {
+			parts := strings.SplitN(link, ":", 2)
+			alias := parts[len(parts)-1]
+			links[dockerName(alias)] = dockerName(parts[0])
+		}
+	}
+	return links
+}
+
+// The section of a container. A container on a single network without links gets the records of
+// its network as they are; otherwise they are merged into records of its own.
+func (d *DockerSource) section(container *dockerContainer, links map[string]string, byName map[string]*dockerContainer) ClientAnswers {
+	var shared []dockerRecords
+	for networkName, endpoint := range container.NetworkSettings.Networks {
+		if records, ok := d.records[endpoint.NetworkID]; ok && d.resolvesNames(networkName, endpoint) {
+			shared = append(shared, records)
+		}
+	}
+	if len(shared) == 1 && len(links) == 0 {
+		return ClientAnswers{A: shared[0].a, Aaaa: shared[0].aaaa}
+	}
+
+	records := dockerRecords{a: make(map[string]RecordA), aaaa: make(map[string]RecordA)}
+	for _, network := range shared {
+		// Copied, so that the shared records are left alone
+		for name, rec := range network.a {
+			merged := records.a[name]
+			merged.Answer = append(merged.Answer, rec.Answer...)
+			records.a[name] = merged
+		}
+		for name, rec := range network.aaaa {
+			merged := records.aaaa[name]
+			merged.Answer = append(merged.Answer, rec.Answer...)
+			records.aaaa[name] = merged
+		}
+	}
+
+	// Links resolve by alias and by the name of the container they link to
+	for alias, name := range links {
+		target, ok := byName[name]
+		if !ok {
+			continue
+		}
+		ip, ip6 := linkAddresses(container, target)
+		addDockerRecords(records, alias, ip, ip6)
+		addDockerRecords(records, name, ip, ip6)
+	}
+	sortRecords(records.a)
+	sortRecords(records.aaaa)
+	return ClientAnswers{A: records.a, Aaaa: records.aaaa}
+}
+
+func (d *DockerSource) resolvesNames(networkName string, endpoint dockerEndpoint) bool {
+	if network, ok := d.networks[endpoint.NetworkID]; ok {
+		return network.resolvesNames()
+	}
+	return dockerNetwork{Name: networkName}.resolvesNames()
+}
+
+// The addresses of target on a network it shares with container, or its first ones
+func linkAddresses(container *dockerContainer, target *dockerContainer) (string, string) {
+	var ip, ip6 string
+	for _, network := range sortedEndpointNames(target.NetworkSettings.Networks) {
+		endpoint := target.NetworkSettings.Networks[network]
+		if _, shared := container.NetworkSettings.Networks[network]; shared {
+			return endpoint.IPAddress, endpoint.GlobalIPv6Address
+		}
+		if ip == "" && ip6 == "" {
+			ip, ip6 = endpoint.IPAddress, endpoint.GlobalIPv6Address
+		}
+	}
+	return ip, ip6
+}
+
+func sortedEndpointNames(endpoints map[string]dockerEndpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func addDockerRecords(records dockerRecords, name string, ip string, ip6 string) {
+	fqdn := name + "."
+	if ip != "" {
+		rec := records.a[fqdn]
+		rec.Answer = append(rec.Answer, ip)
+		records.a[fqdn] = rec
+	}
+	if ip6 != "" {
+		rec := records.aaaa[fqdn]
+		rec.Answer = append(rec.Answer, ip6)
+		records.aaaa[fqdn] = rec
+	}
+}
+
+func sortRecords(records map[string]RecordA) {
+	for name, rec := range records {
+		records[name] = RecordA{Answer: uniqueSorted(rec.Answer)}
+	}
+}
+
+// Container names and link aliases are paths like /web or /web/db, we want the last part
+func dockerName(name string) string {
+	return strings.ToLower(name[strings.LastIndex(name, "/")+1:])
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	out := values[:0]
+	for _, v := range values {
+		if len(out) == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A Docker daemon on a unix socket, serving the containers it's given and streaming the events
+// pushed to it. Pushing "close" ends the events stream.
+type fakeDocker struct {
+	mutex      sync.Mutex
+	containers map[string]string // inspect JSON by ID
+	networks   string
+	events     chan string
+	lists      int
+}
+
+func (f *fakeDocker) set(id string, inspect string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.containers[id] = inspect
+}
+
+func (f *fakeDocker) listed() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lists
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	switch {
+	case r.URL.Path == "/containers/json":
+		f.lists++
+		var ids []string
+		for id := range f.containers {
+			ids = append(ids, fmt.Sprintf(`{"Id": %q}`, id))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(ids, ","))
+	case strings.HasPrefix(r.URL.Path, "/containers/"):
+		inspect, ok := f.containers[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/json")]
+		if !ok {
+			http.Error(w, `{"message": "No such container"}`, http.StatusNotFound)
+			break
+		}
+		fmt.Fprint(w, inspect)
+	case r.URL.Path == "/networks":
+		fmt.Fprint(w, f.networks)
+	case r.URL.Path == "/events" && r.URL.Query().Get("since") != "":
+		f.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-f.events:
+				if e == "close" {
+					return
+				}
+				fmt.Fprintln(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+	f.mutex.Unlock()
+}
+
+func dockerInspect(id string, name string, running bool, links string, networks string) string {
+	return fmt.Sprintf(`{"Id": %q, "Name": %q, "State": {"Running": %t}, "HostConfig": {"Links": [%s]},
+		"NetworkSettings": {"Networks": {%s}}}`, id, name, running, links, networks)
+}
+
+func TestDockerAnswers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+
+	fake := &fakeDocker{
+		containers: map[string]string{
+			"w1": dockerInspect("w1", "/web", true, "",
+				`"shop": {"NetworkID": "n2", "IPAddress": "172.18.0.2", "Aliases": ["frontend", "w1"]}`),
+			"d1": dockerInspect("d1", "/db", true, "",
+				`"shop": {"NetworkID": "n2", "IPAddress": "172.18.0.3", "GlobalIPv6Address": "fd00:18::3", "Aliases": ["database"]},
+				 "bridge": {"NetworkID": "n1", "IPAddress": "172.17.0.3"}`),
+			"l1": dockerInspect("l1", "/legacy", true, `"/db:/legacy/mysql"`,
+				`"bridge": {"NetworkID": "n1", "IPAddress": "172.17.0.4"}`),
+			"x1": dockerInspect("x1", "/exited", false, "", `"shop": {"NetworkID": "n2", "IPAddress": "172.18.0.9"}`),
+		},
+		networks: `[{"Id": "n1", "Name": "bridge", "Options": {"com.docker.network.bridge.default_bridge": "true"}},
+			{"Id": "n2", "Name": "shop", "Options": {}}]`,
+		events: make(chan string, 10),
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: fake}
+	go server.Serve(listener)
+	defer server.Close()
+
+	source := NewDockerSource(NewDockerClient("unix://" + socket))
+	if err := source.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	<-source.Changes()
+	answers, err := source.GenerateAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Containers on a network resolve each other by name and alias
+	web := answers["172.18.0.2"]
+	for name, ip := range map[string]string{"db.": "172.18.0.3", "database.": "172.18.0.3", "frontend.": "172.18.0.2", "w1.": "172.18.0.2"} {
+		if a := web.A[name].Answer; len(a) != 1 || a[0] != ip {
+			t.Fatalf("Expected %s to be %s [%v]", name, ip, web.A)
+		}
+	}
+	if a := web.Aaaa["database."].Answer; len(a) != 1 || a[0] != "fd00:18::3" {
+		t.Fatalf("Unexpected AAAA record [%v]", web.Aaaa)
+	}
+	if _, ok := answers["172.17.0.3"].A["web."]; !ok {
+		t.Fatal("Expected containers on several networks to have the same section for each address")
+	}
+	if _, ok := answers["172.18.0.9"]; ok {
+		t.Fatal("Expected no section for a container that isn't running")
+	}
+
+	// The default bridge only resolves links, to an address on a network they share
+	legacy := answers["172.17.0.4"]
+	if a := legacy.A["mysql."].Answer; len(a) != 1 || a[0] != "172.17.0.3" {
+		t.Fatalf("Unexpected link [%v]", legacy.A)
+	}
+	if _, ok := legacy.A["web."]; ok || len(legacy.A) != 2 {
+		t.Fatalf("Expected only the link and its container [%v]", legacy.A)
+	}
+	if ptr := answers[DEFAULT_KEY].Ptr["2.0.18.172.in-addr.arpa."].Answer; ptr != "web." {
+		t.Fatalf("Unexpected PTR record [%v]", ptr)
+	}
+
+	// Events update the containers they are about
+	oldDelay := dockerRetryDelay
+	dockerRetryDelay = 10 * time.Millisecond
+	defer func() { dockerRetryDelay = oldDelay }()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		source.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	changed := func() Answers {
+		select {
+		case <-source.Changes():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a change")
+		}
+		answers, err := source.GenerateAnswers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return answers
+	}
+
+	fake.set("c1", dockerInspect("c1", "/cache", true, "", `"shop": {"NetworkID": "n2", "IPAddress": "172.18.0.4"}`))
+	fake.events <- `{"Type": "container", "Action": "start", "Actor": {"ID": "c1"}}`
+	started := changed()
+	if a := started["172.18.0.2"].A["cache."].Answer; len(a) != 1 || a[0] != "172.18.0.4" {
+		t.Fatalf("Expected the started container [%v]", a)
+	}
+	if _, ok := answers["172.18.0.2"].A["cache."]; ok {
+		t.Fatal("Expected the earlier answers to be left alone")
+	}
+
+	// Containers on a single network share its records, and sections the event didn't touch are kept
+	if reflect.ValueOf(started["172.18.0.2"].A).Pointer() != reflect.ValueOf(started["172.18.0.4"].A).Pointer() {
+		t.Fatal("Expected the containers of a network to share its records")
+	}
+	if reflect.ValueOf(started["172.17.0.4"].A).Pointer() != reflect.ValueOf(legacy.A).Pointer() {
+		t.Fatal("Expected the section of a container on another network to be kept")
+	}
+	fake.events <- `{"Type": "container", "Action": "die", "Actor": {"ID": "d1"}}`
+	if _, ok := changed()["172.18.0.2"].A["database."]; ok {
+		t.Fatal("Expected the container that died to be gone")
+	}
+
+	// Everything is listed again when the events are lost
+	lists := fake.listed()
+	fake.events <- "close"
+	changed()
+	if fake.listed() != lists+1 {
+		t.Fatalf("Expected the containers to be listed again, %d lists", fake.listed())
+	}
+}
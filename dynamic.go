@@ -0,0 +1,586 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+)
+
+// How often expired dynamic records are removed
+const DYNAMIC_EXPIRY_INTERVAL = time.Second
+
+var ErrRecordExists = errors.New("Record already exists")
+
+// A record added through the API or by DNS UPDATE, served on top of the answers. Records without
+// an answer hide the RRset of the answers they overlay.
+type DynamicRecord struct {
+	Client  string     `json:"client"`
+	Type    string     `json:"type"`
+	Name    string     `json:"name"`
+	Answer  answerList `json:"answer"`
+	Ttl     *uint32    `json:"ttl,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// A list of answers that can also be given as a single string, as is natural for CNAME and PTR.
+// TXT answers with several strings are given as lists.
+type answerList []AnswerStrings
+
+func (a *answerList) UnmarshalJSON(data []byte) error {
+	// Deleted RRsets have no answers
+	if string(data) == "null" {
+		*a = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = answerList{{s}}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]AnswerStrings)(a))
+}
+
+// The answers of the record types that have a single string each
+func (a answerList) values() []string {
+	values := make([]string, 0, len(a))
+	for _, answer := range a {
+		values = append(values, answer[0])
+	}
+	return values
+}
+
+func (r *DynamicRecord) key() string {
+	return r.Client + "/" + r.Type + "/" + r.Name
+}
+
+func (r *DynamicRecord) expired(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+// Normalizes the client, type and name of a record the way the answers file expects them.
+// PTR records may be named by IP address.
+func (r *DynamicRecord) normalizeKey() error {
+	if r.Client == "" {
+		r.Client = DEFAULT_KEY
+	}
+	r.Type = strings.ToUpper(r.Type)
+	if r.Type == "PTR" {
+		if reverse, err := dns.ReverseAddr(strings.TrimSuffix(r.Name, ".")); err == nil {
+			r.Name = reverse
+		}
+	}
+	r.Name = strings.ToLower(dns.Fqdn(r.Name))
+	if _, ok := dns.IsDomainName(r.Name); !ok || r.Name == "." {
+		return fmt.Errorf("Invalid name %q", r.Name)
+	}
+	switch r.Type {
+	case "A", "AAAA", "CNAME", "PTR", "TXT":
+		return nil
+	}
+	return fmt.Errorf("Unsupported type %q, expected A, AAAA, CNAME, PTR or TXT", r.Type)
+}
+
+func (r *DynamicRecord) validate() error {
+	if err := r.normalizeKey(); err != nil {
+		return err
+	}
+
+	if r.Type != "TXT" {
+		for _, answer := range r.Answer {
+			if len(answer) != 1 {
+				return fmt.Errorf("%s answers are single strings", r.Type)
+			}
+		}
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		for _, answer := range r.Answer.values() {
+			ip := net.ParseIP(answer)
+			if ip == nil || (ip.To4() != nil) != (r.Type == "A") {
+				return fmt.Errorf("Invalid %s address %q", r.Type, answer)
+			}
+		}
+	case "CNAME", "PTR":
+		if len(r.Answer) > 1 {
+			return fmt.Errorf("%s records have a single answer", r.Type)
+		}
+		if len(r.Answer) == 0 {
+			break
+		}
+		r.Answer[0] = AnswerStrings{strings.ToLower(dns.Fqdn(r.Answer[0][0]))}
+		if r.Type == "CNAME" && r.Answer[0][0] == r.Name {
+			return fmt.Errorf("CNAME %s points to itself", r.Name)
+		}
+	case "TXT":
+		for _, answer := range r.Answer {
+			for _, str := range answer {
+				if len(str) > 255 {
+					return fmt.Errorf("TXT string is %d bytes long, the maximum is 255", len(str))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Records added through the API or by DNS UPDATE, kept in a file so that they survive restarts
+type DynamicRecords struct {
+	sync.Mutex
+	path    string
+	records map[string]*DynamicRecord
+	serials map[string]uint32 // SOA serials of the zones changed by UPDATE
+}
+
+// Content of the records file
+type dynamicRecordsFile struct {
+	Records []*DynamicRecord  `json:"records"`
+	Serials map[string]uint32 `json:"serials,omitempty"`
+}
+
+// Loads the records kept in path, if it exists. An empty path keeps records in memory only.
+func LoadDynamicRecords(path string) (*DynamicRecords, error) {
+	d := &DynamicRecords{path: path, records: make(map[string]*DynamicRecord), serials: make(map[string]uint32)}
+	if path == "" {
+		return d, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content dynamicRecordsFile
+	if err := json.Unmarshal(data, &content); err != nil {
+		// Files written before zone serials were kept are a plain list of records
+		if err := json.Unmarshal(data, &content.Records); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+		}
+	}
+	for zone, serial := range content.Serials {
+		d.serials[zone] = serial
+	}
+	for _, r := range content.Records {
+		if err := r.validate(); err != nil {
+			log.Warnf("Ignoring dynamic record %s %s in %s: %v", r.Type, r.Name, path, err)
+			continue
+		}
+		d.records[r.key()] = r
+	}
+	log.Infof("Loaded %d dynamic records from %s", len(d.records), path)
+	return d, nil
+}
+
+// Writes the records to a temporary file renamed over the old one, so that a crash never leaves
+// a partial file behind. Must be called with the lock held.
+func (d *DynamicRecords) save() error {
+	if d.path == "" {
+		return nil
+	}
+	content := dynamicRecordsFile{Serials: d.serials}
+	for _, r := range d.sorted("") {
+		r := r
+		content.Records = append(content.Records, &r)
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), "."+filepath.Base(d.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d *DynamicRecords) sorted(client string) []DynamicRecord {
+	keys := make([]string, 0, len(d.records))
+	for key, r := range d.records {
+		if client == "" || r.Client == client {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	records := make([]DynamicRecord, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, *d.records[key])
+	}
+	return records
+}
+
+// The records for a client key, or all records if client is empty
+func (d *DynamicRecords) List(client string) []DynamicRecord {
+	d.Lock()
+	defer d.Unlock()
+	return d.sorted(client)
+}
+
+func (d *DynamicRecords) Get(client string, rrtype string, name string) (DynamicRecord, bool) {
+	r := DynamicRecord{Client: client, Type: rrtype, Name: name}
+	if r.normalizeKey() != nil {
+		return r, false
+	}
+	d.Lock()
+	defer d.Unlock()
+	found, ok := d.records[r.key()]
+	if !ok {
+		return r, false
+	}
+	return *found, true
+}
+
+// Adds or replaces a validated record. Unless replace is set, existing records are left alone and
+// ErrRecordExists is returned.
+func (d *DynamicRecords) Put(r DynamicRecord, replace bool) (created bool, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	key := r.key()
+	old, exists := d.records[key]
+	if exists && !replace {
+		return false, ErrRecordExists
+	}
+	d.records[key] = &r
+	if err := d.save(); err != nil {
+		if exists {
+			d.records[key] = old
+		} else {
+			delete(d.records, key)
+		}
+		return false, err
+	}
+	return !exists, nil
+}
+
+func (d *DynamicRecords) Delete(client string, rrtype string, name string) (bool, error) {
+	r := DynamicRecord{Client: client, Type: rrtype, Name: name}
+	if r.normalizeKey() != nil {
+		return false, nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	key := r.key()
+	old, ok := d.records[key]
+	if !ok {
+		return false, nil
+	}
+	delete(d.records, key)
+	if err := d.save(); err != nil {
+		d.records[key] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// Sets and removes records as a single change, and bumps the serial of zone past baseSerial
+// (the serial of the zone in the answers) and its last serial.
+func (d *DynamicRecords) Apply(set []DynamicRecord, remove []DynamicRecord, zone string, baseSerial uint32) (uint32, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	oldRecords := make(map[string]*DynamicRecord, len(d.records))
+	for key, r := range d.records {
+		oldRecords[key] = r
+	}
+	oldSerial, hadSerial := d.serials[zone]
+
+	for _, r := range set {
+		r := r
+		d.records[r.key()] = &r
+	}
+	for _, r := range remove {
+		delete(d.records, r.key())
+	}
+	serial := oldSerial
+	if baseSerial > serial {
+		serial = baseSerial
+	}
+	serial++
+	d.serials[zone] = serial
+
+	if err := d.save(); err != nil {
+		d.records = oldRecords
+		if hadSerial {
+			d.serials[zone] = oldSerial
+		} else {
+			delete(d.serials, zone)
+		}
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Removes the records that expired before now. Returns whether there were any.
+func (d *DynamicRecords) Expire(now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	expired := false
+	for key, r := range d.records {
+		if r.expired(now) {
+			log.Infof("Dynamic record %s %s for %s expired", r.Type, r.Name, r.Client)
+			delete(d.records, key)
+			expired = true
+		}
+	}
+	if expired {
+		if err := d.save(); err != nil {
+			log.Errorf("Failed to save dynamic records: %v", err)
+		}
+	}
+	return expired
+}
+
+// Answers with the records on top of base. base itself is not modified.
+func (d *DynamicRecords) Merge(base Answers) Answers {
+	if d == nil {
+		return base
+	}
+	d.Lock()
+	defer d.Unlock()
+	if len(d.records) == 0 && len(d.serials) == 0 {
+		return base
+	}
+
+	merged := make(Answers, len(base))
+	for key, client := range base {
+		merged[key] = client
+	}
+
+	now := time.Now()
+	copied := make(map[string]bool)
+	for _, r := range d.records {
+		if r.expired(now) {
+			continue
+		}
+
+		client := merged[r.Client]
+		if !copied[r.Client] {
+			client.A = copyRecordsA(client.A)
+			client.Aaaa = copyRecordsA(client.Aaaa)
+			client.Cname = copyRecordsCname(client.Cname)
+			client.Ptr = copyRecordsPtr(client.Ptr)
+			client.Txt = copyRecordsTxt(client.Txt)
+			copied[r.Client] = true
+		}
+
+		if len(r.Answer) == 0 {
+			deleteRecord(&client, r.Type, r.Name)
+			merged[r.Client] = client
+			continue
+		}
+		switch r.Type {
+		case "A":
+			client.A[r.Name] = RecordA{Ttl: r.Ttl, Answer: r.Answer.values()}
+		case "AAAA":
+			client.Aaaa[r.Name] = RecordA{Ttl: r.Ttl, Answer: r.Answer.values()}
+		case "CNAME":
+			client.Cname[r.Name] = RecordCname{Ttl: r.Ttl, Answer: r.Answer[0][0]}
+		case "PTR":
+			client.Ptr[r.Name] = RecordPtr{Ttl: r.Ttl, Answer: r.Answer[0][0]}
+		case "TXT":
+			client.Txt[r.Name] = RecordTxt{Ttl: r.Ttl, Answer: r.Answer}
+		}
+		merged[r.Client] = client
+	}
+
+	if len(d.serials) > 0 {
+		client := merged[DEFAULT_KEY]
+		soa := make(map[string]RecordSoa, len(client.Soa)+len(d.serials))
+		for zone, rec := range client.Soa {
+			soa[zone] = rec
+		}
+		for zone, serial := range d.serials {
+			rec, ok := soa[zone]
+			if !ok {
+				// Same as the generated SOA of authoritative zones, with a serial that only changes on updates
+				rec = RecordSoa{Ns: zone, Mbox: zone, Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
+			}
+			if serial > rec.Serial {
+				rec.Serial = serial
+			}
+			soa[zone] = rec
+		}
+		client.Soa = soa
+		merged[DEFAULT_KEY] = client
+	}
+	return merged
+}
+
+func deleteRecord(client *ClientAnswers, rrtype string, name string) {
+	switch rrtype {
+	case "A":
+		delete(client.A, name)
+	case "AAAA":
+		delete(client.Aaaa, name)
+	case "CNAME":
+		delete(client.Cname, name)
+	case "PTR":
+		delete(client.Ptr, name)
+	case "TXT":
+		delete(client.Txt, name)
+	}
+}
+
+func copyRecordsA(records map[string]RecordA) map[string]RecordA {
+	out := make(map[string]RecordA, len(records))
+	for name, rec := range records {
+		out[name] = rec
+	}
+	return out
+}
+
+func copyRecordsCname(records map[string]RecordCname) map[string]RecordCname {
+	out := make(map[string]RecordCname, len(records))
+	for name, rec := range records {
+		out[name] = rec
+	}
+	return out
+}
+
+func copyRecordsPtr(records map[string]RecordPtr) map[string]RecordPtr {
+	out := make(map[string]RecordPtr, len(records))
+	for name, rec := range records {
+		out[name] = rec
+	}
+	return out
+}
+
+func copyRecordsTxt(records map[string]RecordTxt) map[string]RecordTxt {
+	out := make(map[string]RecordTxt, len(records))
+	for name, rec := range records {
+		out[name] = rec
+	}
+	return out
+}
+
+// Removes expired records from the answers as they expire
+func expireDynamicRecords() {
+	for now := range time.Tick(DYNAMIC_EXPIRY_INTERVAL) {
+		if dynamicRecords.Expire(now) {
+			mergeDynamicRecords()
+		}
+	}
+}
+
+// Body of PUT and POST requests
+type dynamicRecordRequest struct {
+	DynamicRecord
+	ExpiresIn *uint `json:"expires-in"` // seconds, instead of an absolute expiry time
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpListRecords(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, dynamicRecords.List(req.URL.Query().Get("client")))
+}
+
+func httpGetRecord(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	r, ok := dynamicRecords.Get(vars["client"], vars["type"], vars["name"])
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, r)
+}
+
+// PUT /v1/records/{client}/{type}/{name} creates or replaces a record, POST /v1/records only creates
+func httpPutRecord(w http.ResponseWriter, req *http.Request) {
+	var body dynamicRecordRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r := body.DynamicRecord
+	vars := mux.Vars(req)
+	replace := vars["name"] != ""
+	if replace {
+		r.Client, r.Type, r.Name = vars["client"], vars["type"], vars["name"]
+	}
+	if body.ExpiresIn != nil {
+		expires := time.Now().Add(time.Duration(*body.ExpiresIn) * time.Second).UTC()
+		r.Expires = &expires
+	}
+	if err := r.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(r.Answer) == 0 {
+		http.Error(w, "No answer", http.StatusBadRequest)
+		return
+	}
+
+	created, err := dynamicRecords.Put(r, replace)
+	if err == ErrRecordExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to save dynamic records: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mergeDynamicRecords()
+
+	log.WithFields(log.Fields{"client": r.Client, "type": r.Type, "name": r.Name, "answer": r.Answer}).Info("Set dynamic record")
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, r)
+}
+
+func httpDeleteRecord(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	deleted, err := dynamicRecords.Delete(vars["client"], vars["type"], vars["name"])
+	if err != nil {
+		log.Errorf("Failed to save dynamic records: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	mergeDynamicRecords()
+
+	log.WithFields(log.Fields{"client": vars["client"], "type": vars["type"], "name": vars["name"]}).Info("Deleted dynamic record")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDynamicRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The directory is created on the first change
+	path := filepath.Join(dir, "state", "dynamic.json")
+
+	oldSnapshot, oldDynamic, oldClients := loadSnapshot(), dynamicRecords, clientSpecificCaches
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches = oldDynamic, oldClients
+	}()
+
+	if dynamicRecords, err = LoadDynamicRecords(path); err != nil {
+		t.Fatal(err)
+	}
+	base := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{"web.": {Answer: []string{"10.1.2.4"}}},
+		},
+	}
+	setAnswers(base, "test")
+
+	router := newReloadRouter()
+	do := func(method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("PUT", "/v1/records/default/a/Preview-1.ci.", `{"answer": ["10.9.0.1"], "ttl": 30}`); w.Code != 201 {
+		t.Fatalf("Expected the record to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/v1/records/default/A/preview-1.ci", `{"answer": ["10.9.0.2"], "ttl": 30}`); w.Code != 200 {
+		t.Fatalf("Expected the record to be replaced, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/records", `{"client": "10.42.1.5", "type": "cname", "name": "web.", "answer": "preview-1.ci."}`); w.Code != 201 {
+		t.Fatalf("Expected the record to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("POST", "/v1/records", `{"client": "10.42.1.5", "type": "CNAME", "name": "web", "answer": "other."}`); w.Code != 409 {
+		t.Fatalf("Expected a conflict, got %d", w.Code)
+	}
+	if w := do("PUT", "/v1/records/default/PTR/10.9.0.2", `{"answer": "preview-1.ci", "expires-in": 3600}`); w.Code != 201 {
+		t.Fatalf("Expected the record to be created, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("PUT", "/v1/records/default/A/bad.", `{"answer": ["10.9.0.x"]}`); w.Code != 400 {
+		t.Fatalf("Expected an invalid address to be rejected, got %d", w.Code)
+	}
+
+	w := do("GET", "/v1/records/default/A/preview-1.ci.", "")
+	var r DynamicRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil || r.Answer[0][0] != "10.9.0.2" || *r.Ttl != 30 {
+		t.Fatalf("Unexpected record %d: %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/v1/records?client=default", "")
+	var list []DynamicRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 2 || list[1].Name != "2.0.9.10.in-addr.arpa." || list[1].Expires == nil {
+		t.Fatalf("Unexpected list: %s", w.Body.String())
+	}
+
+	// Served on top of the base answers, which are left alone
+	records, ok := snapshot().Addresses("10.42.1.5", "web.", "web.", nil, 1)
+	if !ok || len(records) != 2 || records[1].(*dns.A).A.String() != "10.9.0.2" {
+		t.Fatalf("Expected the dynamic CNAME and A records [%v]", records)
+	}
+	if _, ok := base["10.42.1.5"]; ok || len(base[DEFAULT_KEY].A) != 1 {
+		t.Fatalf("The base answers were modified [%v]", base)
+	}
+
+	// Survive reloads and restarts
+	setAnswers(base, "test")
+	if _, ok := snapshot().Matching(dns.TypePTR, "10.42.1.5", "2.0.9.10.in-addr.arpa.", "2.0.9.10.in-addr.arpa."); !ok {
+		t.Fatal("Expected the dynamic PTR record after a reload")
+	}
+	if reloaded, err := LoadDynamicRecords(path); err != nil || len(reloaded.List("")) != 3 {
+		t.Fatalf("Expected the records to be saved [%v] %v", reloaded, err)
+	}
+
+	if w := do("DELETE", "/v1/records/10.42.1.5/CNAME/web.", ""); w.Code != 204 {
+		t.Fatalf("Expected the record to be deleted, got %d", w.Code)
+	}
+	if w := do("DELETE", "/v1/records/10.42.1.5/CNAME/web.", ""); w.Code != 404 {
+		t.Fatalf("Expected the record to be gone, got %d", w.Code)
+	}
+	if records, _ := snapshot().Addresses("10.42.1.5", "web.", "web.", nil, 1); len(records) != 1 || records[0].(*dns.A).A.String() != "10.1.2.4" {
+		t.Fatalf("Expected the base record again [%v]", records)
+	}
+
+	if !dynamicRecords.Expire(time.Now().Add(2 * time.Hour)) {
+		t.Fatal("Expected the PTR record to expire")
+	}
+	if len(dynamicRecords.List("")) != 1 {
+		t.Fatalf("Expected one record left [%v]", dynamicRecords.List(""))
+	}
+}
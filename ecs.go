@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Policies for EDNS Client Subnet options sent by clients (RFC 7871)
+const (
+	ECS_POLICY_STRIP = "strip"
+	ECS_POLICY_HONOR = "honor"
+)
+
+// The client subnet option found in a message, if any
+func clientSubnetOption(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	o := msg.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// The subnet to send upstream for a request from clientIp, or nil if the upstream query
+// should not carry a client subnet.
+func upstreamSubnet(req *dns.Msg, clientIp string) *dns.EDNS0_SUBNET {
+	if e := clientSubnetOption(req); e != nil && *ecsClientPolicy == ECS_POLICY_HONOR {
+		// A source prefix of 0 means the client opted out, pass that on
+		return limitSubnet(e.Address, e.SourceNetmask)
+	}
+
+	if !*ecsEnabled {
+		return nil
+	}
+
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return nil
+	}
+	return limitSubnet(ip, 128)
+}
+
+// Builds a subnet option for ip, never more specific than the configured prefix lengths
+func limitSubnet(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = minPrefix(prefix, *ecsPrefixV4, 32)
+		e.Address = ip4.Mask(net.CIDRMask(int(e.SourceNetmask), 32))
+	} else {
+		e.Family = 2
+		e.SourceNetmask = minPrefix(prefix, *ecsPrefixV6, 128)
+		e.Address = ip.To16().Mask(net.CIDRMask(int(e.SourceNetmask), 128))
+	}
+	return e
+}
+
+func minPrefix(prefix uint8, configured uint, bits uint8) uint8 {
+	if configured < uint(bits) {
+		bits = uint8(configured)
+	}
+	if prefix < bits {
+		return prefix
+	}
+	return bits
+}
+
+// The network an option with the given prefix length applies to
+func subnetNetwork(e *dns.EDNS0_SUBNET, prefix uint8) *net.IPNet {
+	bits := 32
+	ip := e.Address.To4()
+	if e.Family == 2 || ip == nil {
+		bits = 128
+		ip = e.Address.To16()
+	}
+	if int(prefix) > bits {
+		prefix = uint8(bits)
+	}
+	mask := net.CIDRMask(int(prefix), bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Removes client subnet options from msg, returning the scope prefix length of the removed one
+func stripClientSubnet(msg *dns.Msg) (scope uint8) {
+	o := msg.IsEdns0()
+	if o == nil {
+		return 0
+	}
+	options := o.Option[:0]
+	for _, opt := range o.Option {
+		if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			scope = e.SourceScope
+			continue
+		}
+		options = append(options, opt)
+	}
+	o.Option = options
+	return scope
+}
+
+// Echoes the client's subnet option back with the scope of the answer, if the client sent one
+// and we honored it.
+func echoClientSubnet(req, msg *dns.Msg, scope uint8) {
+	e := clientSubnetOption(req)
+	if e == nil || *ecsClientPolicy != ECS_POLICY_HONOR {
+		return
+	}
+	o := msg.IsEdns0()
+	if o == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		o = msg.IsEdns0()
+	}
+	echo := *e
+	echo.SourceScope = scope
+	o.Option = append(o.Option, &echo)
+}
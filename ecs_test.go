@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestUpstreamSubnetFromClientIp(t *testing.T) {
+	defer setEcs(true, ECS_POLICY_STRIP)()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	e := upstreamSubnet(req, "10.42.1.5")
+	if e == nil {
+		t.Fatal("Expected a client subnet")
+	}
+	if e.SourceNetmask != 24 || !e.Address.Equal(net.ParseIP("10.42.1.0")) {
+		t.Fatalf("Incorrect client subnet [%v]", e)
+	}
+
+	up := upstreamRequest(req, e)
+	if up == req {
+		t.Fatal("Expected the request to be copied")
+	}
+	if req.IsEdns0() != nil {
+		t.Fatal("Original request should not be modified")
+	}
+	if got := clientSubnetOption(up); got == nil || got.String() != "10.42.1.0/24/0" {
+		t.Fatalf("Incorrect upstream option [%v]", got)
+	}
+}
+
+func TestUpstreamSubnetPolicy(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	o := req.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.77").To4()})
+
+	restore := setEcs(false, ECS_POLICY_STRIP)
+	if e := upstreamSubnet(req, "10.42.1.5"); e != nil {
+		t.Fatalf("Client subnet should be stripped [%v]", e)
+	}
+	if up := upstreamRequest(req, nil); clientSubnetOption(up) != nil {
+		t.Fatal("Client subnet should not be forwarded")
+	}
+	restore()
+
+	defer setEcs(false, ECS_POLICY_HONOR)()
+	e := upstreamSubnet(req, "10.42.1.5")
+	if e == nil || e.String() != "192.0.2.0/24/0" {
+		t.Fatalf("Client subnet should be honored and limited to /24 [%v]", e)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.SetEdns0(4096, false)
+	ro := resp.IsEdns0()
+	ro.Option = append(ro.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("192.0.2.0").To4()})
+	echoClientSubnet(req, resp, stripClientSubnet(resp))
+	if got := clientSubnetOption(resp); got == nil || got.String() != "192.0.2.77/32/16" {
+		t.Fatalf("Incorrect echoed option [%v]", got)
+	}
+}
+
+func TestGlobalCacheByScope(t *testing.T) {
+	defer setEcs(true, ECS_POLICY_STRIP)()
+	oldGlobal := globalCache
+	defer func() { globalCache = oldGlobal }()
+	globalCache = cache.New(10, 60)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{testRR(t, "example.com. 60 IN A 192.0.2.1")}
+	resp.SetEdns0(4096, false)
+	o := resp.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("10.42.1.0").To4()})
+
+	// The answer is valid for the /16 the upstream scoped it to, not just the /24 that was asked
+	addToGlobalCache(req, resp, upstreamSubnet(req, "10.42.1.5"))
+	if msg, _ := globalCacheHit(req, upstreamSubnet(req, "10.42.7.9")); msg == nil {
+		t.Fatal("Expected a client in the same /16 to share the answer")
+	}
+	if msg, _ := globalCacheHit(req, upstreamSubnet(req, "10.43.1.5")); msg != nil {
+		t.Fatal("Expected a client outside the scope not to get the answer")
+	}
+
+	// Scopes more specific than the subnet that was asked are capped at it
+	o.Option[0].(*dns.EDNS0_SUBNET).SourceScope = 32
+	req.SetQuestion("example.org.", dns.TypeA)
+	addToGlobalCache(req, resp, upstreamSubnet(req, "10.42.1.5"))
+	if msg, _ := globalCacheHit(req, upstreamSubnet(req, "10.42.1.200")); msg == nil {
+		t.Fatal("Expected a scope longer than the source prefix to be capped at it")
+	}
+}
+
+func setEcs(enabled bool, policy string) func() {
+	oldEnabled, oldPolicy := *ecsEnabled, *ecsClientPolicy
+	*ecsEnabled, *ecsClientPolicy = enabled, policy
+	return func() {
+		*ecsEnabled, *ecsClientPolicy = oldEnabled, oldPolicy
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The only EDNS version we speak
+const EDNS_VERSION = 0
+
+// The UDP payload size we advertise, and use for our own queries
+func ednsBufferSize() uint16 {
+	if *ednsUdpSize < dns.MinMsgSize {
+		return dns.MinMsgSize
+	}
+	if *ednsUdpSize > dns.MaxMsgSize {
+		return dns.MaxMsgSize
+	}
+	return uint16(*ednsUdpSize)
+}
+
+// Whether the request uses an EDNS version we don't know about
+func badEdnsVersion(req *dns.Msg) bool {
+	o := req.IsEdns0()
+	return o != nil && o.Version() != EDNS_VERSION
+}
+
+// Removes all OPT records from msg and returns the first one, if any
+func removeEdns0(msg *dns.Msg) *dns.OPT {
+	var opt *dns.OPT
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			if opt == nil {
+				opt = o
+			}
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	msg.Extra = extra
+	return opt
+}
+
+// Replaces whatever OPT record m carries (ours or the upstream's) with one describing this server.
+// Clients that did not use EDNS get no OPT record. The DO bit is only set if the client set it,
+// and the only option passed through is the client subnet echo.
+func setResponseEdns(req, m *dns.Msg) {
+	old := removeEdns0(m)
+	if old != nil && old.ExtendedRcode() != 0 {
+		m.Rcode |= int(old.ExtendedRcode()) << 4
+	}
+
+	o := req.IsEdns0()
+	if o == nil {
+		return
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(ednsBufferSize())
+	opt.SetVersion(EDNS_VERSION)
+	if o.Do() {
+		opt.SetDo()
+	}
+	if old != nil {
+		for _, option := range old.Option {
+			if _, ok := option.(*dns.EDNS0_SUBNET); ok {
+				opt.Option = append(opt.Option, option)
+			}
+		}
+	}
+	m.Extra = append(m.Extra, opt)
+}
+
+// Copy of req to forward upstream. It always uses our own EDNS buffer size whatever the client
+// asked for, keeps the client's DO bit (always set when validating), and carries subnet (if any)
+// as the only option.
+func upstreamRequest(req *dns.Msg, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	r := req.Copy()
+	do := false
+	if o := removeEdns0(r); o != nil {
+		do = o.Do()
+	}
+	if validator != nil {
+		do = true
+	}
+
+	r.SetEdns0(ednsBufferSize(), do)
+	if subnet != nil {
+		o := r.IsEdns0()
+		o.Option = append(o.Option, subnet)
+	}
+	return r
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseEdns(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, true)
+
+	// Upstream answer with its own OPT record
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(512, false)
+	setResponseEdns(req, m)
+
+	if len(m.Extra) != 1 {
+		t.Fatalf("Expected exactly one OPT record [%v]", m.Extra)
+	}
+	o := m.IsEdns0()
+	if o.UDPSize() != ednsBufferSize() || o.Version() != EDNS_VERSION || !o.Do() {
+		t.Fatalf("Incorrect OPT record [%v]", o)
+	}
+
+	// No EDNS from the client, no EDNS in the answer
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	m = new(dns.Msg)
+	m.SetReply(plain)
+	m.SetEdns0(4096, true)
+	setResponseEdns(plain, m)
+	if m.IsEdns0() != nil {
+		t.Fatal("Expected no OPT record")
+	}
+}
+
+func TestBadEdnsVersion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	if badEdnsVersion(req) {
+		t.Fatal("Version 0 should be accepted")
+	}
+
+	req.IsEdns0().SetVersion(1)
+	if !badEdnsVersion(req) {
+		t.Fatal("Version 1 should be rejected")
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeBadVers)
+	setResponseEdns(req, m)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack BADVERS response: %v", err)
+	}
+	out := new(dns.Msg)
+	if err := out.Unpack(buf); err != nil {
+		t.Fatalf("Failed to unpack BADVERS response: %v", err)
+	}
+	if o := out.IsEdns0(); o == nil || o.ExtendedRcode() != 1 || o.Version() != EDNS_VERSION {
+		t.Fatalf("Incorrect BADVERS OPT record [%v]", o)
+	}
+}
+
+func TestUpstreamRequestBufferSize(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(65000, true)
+
+	up := upstreamRequest(req, nil)
+	o := up.IsEdns0()
+	if o.UDPSize() != ednsBufferSize() || !o.Do() {
+		t.Fatalf("Incorrect upstream OPT record [%v]", o)
+	}
+	if req.IsEdns0().UDPSize() != 65000 {
+		t.Fatal("Original request should not be modified")
+	}
+}
@@ -79,6 +79,20 @@ func getAliasFqdn(alias string) string {
 	return fmt.Sprintf("%s.", alias)
 }
 
+func (c *ConfigGenerator) Name() string {
+	return "metadata"
+}
+
+func (c *ConfigGenerator) Load() (Answers, error) {
+	return c.GenerateAnswers()
+}
+
+// Polls the metadata version
+func (c *ConfigGenerator) Watch(changed func()) error {
+	go c.metaFetcher.OnChange(5, func(string) { changed() })
+	return nil
+}
+
 func (c *ConfigGenerator) GenerateAnswers() (Answers, error) {
 	answers := make(Answers)
 	aRecs, cRecs, clientUuidToServiceLinks, clientUuidToContainerLinks, clientUuidToContainer, svcUUIDToSvc, err := c.GetRecords()
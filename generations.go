@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	GENERATION_FILE_PREFIX = "generation-"
+	PINNED_GENERATION_FILE = "pinned"
+)
+
+// A version of the answers (before the dynamic records are merged in), as loaded by a reload
+type Generation struct {
+	Number  uint64    `json:"number"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Served  bool      `json:"served"`
+	Pinned  bool      `json:"pinned"`
+	answers Answers
+	// Recorded for a change event of a source, so the next event amends it rather than adding
+	// a generation
+	amendable bool
+}
+
+// How generations are kept on disk. Answers are stored as YAML, like the answers file, since
+// some of their fields are left out of JSON.
+type storedGeneration struct {
+	Number  uint64  `yaml:"number"`
+	Time    string  `yaml:"time"`
+	Source  string  `yaml:"source"`
+	Answers Answers `yaml:"answers"`
+}
+
+// The last generations of the answers, the one being served and the one pinned, if any
+type Generations struct {
+	sync.Mutex
+	limit  int
+	dir    string
+	list   []*Generation
+	next   uint64
+	served uint64
+	pinned uint64
+}
+
+// Keeps the last limit generations, in dir too unless it's empty. Generations already in dir are
+// loaded, so that numbers keep increasing and earlier generations survive restarts, and so is
+// the pin.
+func LoadGenerations(limit int, dir string) (*Generations, error) {
+	if limit < 1 {
+		limit = 1
+	}
+	g := &Generations{limit: limit, dir: dir, next: 1}
+	if dir == "" {
+		return g, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, GENERATION_FILE_PREFIX+"*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var stored storedGeneration
+		if err := yaml.Unmarshal(data, &stored); err != nil {
+			log.Warnf("Ignoring answers generation %s: %v", path, err)
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339Nano, stored.Time)
+		g.list = append(g.list, &Generation{Number: stored.Number, Time: t, Source: stored.Source, answers: stored.Answers})
+	}
+	sort.Slice(g.list, func(i, j int) bool { return g.list[i].Number < g.list[j].Number })
+	if len(g.list) > 0 {
+		g.next = g.list[len(g.list)-1].Number + 1
+		log.Infof("Loaded %d answers generations from %s", len(g.list), dir)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, PINNED_GENERATION_FILE)); err == nil {
+		number, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || g.get(number) == nil {
+			log.Warnf("Ignoring pinned answers generation %q, not one of the generations in %s", strings.TrimSpace(string(data)), dir)
+		} else {
+			g.pinned = number
+			log.Infof("Answers are pinned to generation %d", number)
+		}
+	}
+	g.prune()
+	return g, nil
+}
+
+func (g *Generations) path(number uint64) string {
+	return filepath.Join(g.dir, fmt.Sprintf("%s%d.yaml", GENERATION_FILE_PREFIX, number))
+}
+
+func (g *Generations) save(gen *Generation) error {
+	if g.dir == "" {
+		return nil
+	}
+	data, err := yaml.Marshal(storedGeneration{Number: gen.Number, Time: gen.Time.Format(time.RFC3339Nano), Source: gen.Source, Answers: gen.answers})
+	if err != nil {
+		return err
+	}
+	temp := g.path(gen.Number) + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, g.path(gen.Number))
+}
+
+// Drops the oldest generations over the limit, except the served and pinned ones. Must be called
+// with the lock held.
+func (g *Generations) prune() {
+	for i := 0; len(g.list) > g.limit && i < len(g.list); {
+		gen := g.list[i]
+		if gen.Number == g.served || gen.Number == g.pinned {
+			i++
+			continue
+		}
+		g.list = append(g.list[:i], g.list[i+1:]...)
+		if g.dir != "" {
+			if err := os.Remove(g.path(gen.Number)); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove answers generation %d: %v", gen.Number, err)
+			}
+		}
+	}
+}
+
+// Records a new generation of the answers. With amend, the answers replace the latest generation
+// instead if it was recorded with amend too and isn't pinned, so that a burst of source events
+// doesn't push out the generations worth going back to.
+func (g *Generations) Add(answers Answers, source string, amend bool) uint64 {
+	g.Lock()
+	defer g.Unlock()
+
+	if n := len(g.list); amend && n > 0 && g.list[n-1].amendable && g.list[n-1].Number != g.pinned {
+		gen := g.list[n-1]
+		gen.Time, gen.Source, gen.answers = time.Now().UTC(), source, answers
+		if err := g.save(gen); err != nil {
+			log.Errorf("Failed to save answers generation %d: %v", gen.Number, err)
+		}
+		return gen.Number
+	}
+
+	gen := &Generation{Number: g.next, Time: time.Now().UTC(), Source: source, answers: answers, amendable: amend}
+	g.next++
+	g.list = append(g.list, gen)
+	if err := g.save(gen); err != nil {
+		log.Errorf("Failed to save answers generation %d: %v", gen.Number, err)
+	}
+	g.prune()
+	return gen.Number
+}
+
+func (g *Generations) get(number uint64) *Generation {
+	for _, gen := range g.list {
+		if gen.Number == number {
+			return gen
+		}
+	}
+	return nil
+}
+
+// The answers of a generation
+func (g *Generations) Get(number uint64) (Answers, bool) {
+	g.Lock()
+	defer g.Unlock()
+	if gen := g.get(number); gen != nil {
+		return gen.answers, true
+	}
+	return nil, false
+}
+
+func (g *Generations) List() []Generation {
+	g.Lock()
+	defer g.Unlock()
+	list := make([]Generation, 0, len(g.list))
+	for _, gen := range g.list {
+		entry := *gen
+		entry.Served = gen.Number == g.served
+		entry.Pinned = gen.Number == g.pinned
+		list = append(list, entry)
+	}
+	return list
+}
+
+// The newest generation, which is served unless another one is pinned
+func (g *Generations) Latest() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.list) == 0 {
+		return 0
+	}
+	return g.list[len(g.list)-1].Number
+}
+
+func (g *Generations) Served() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.served
+}
+
+func (g *Generations) Pinned() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	return g.pinned
+}
+
+func (g *Generations) setServed(number uint64) {
+	g.Lock()
+	g.served = number
+	g.Unlock()
+}
+
+// Keeps the pin in dir too, so that it survives restarts
+func (g *Generations) setPinned(number uint64) {
+	g.Lock()
+	defer g.Unlock()
+	g.pinned = number
+	if g.dir == "" {
+		return
+	}
+	path := filepath.Join(g.dir, PINNED_GENERATION_FILE)
+	var err error
+	if number == 0 {
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", number)), 0644)
+	}
+	if err != nil {
+		log.Errorf("Failed to save the pinned answers generation: %v", err)
+	}
+}
+
+// Held while deciding which generation is served and serving it, so that a pin or rollback
+// can't slip in between a reload's check and what it serves
+var servingMutex sync.Mutex
+
+// Records base as a new generation and serves it, unless another generation is pinned. Returns
+// what changed in the served answers.
+func setAnswers(base Answers, source string) AnswersDiff {
+	return recordAnswers(base, source, false)
+}
+
+// Like setAnswers, for a change event of a source: amends the generation of the previous event
+// rather than adding one
+func amendAnswers(base Answers, source string) AnswersDiff {
+	return recordAnswers(base, source, true)
+}
+
+func recordAnswers(base Answers, source string, amend bool) AnswersDiff {
+	servingMutex.Lock()
+	defer servingMutex.Unlock()
+	number := generations.Add(base, source, amend)
+	if pinned := generations.Pinned(); pinned != 0 {
+		log.Infof("Answers are pinned to generation %d, not serving generation %d from %s", pinned, number, source)
+		if generations.Served() == 0 {
+			// Pinned before a restart
+			diff, _ := serveGenerationLocked(pinned, true)
+			return diff
+		}
+		return AnswersDiff{}
+	}
+	generations.setServed(number)
+	return serveAnswers(base)
+}
+
+// Serves generation number, pinned so that reloads don't replace it if pin is set. Returns what
+// changed in the served answers.
+func serveGeneration(number uint64, pin bool) (AnswersDiff, error) {
+	servingMutex.Lock()
+	defer servingMutex.Unlock()
+	return serveGenerationLocked(number, pin)
+}
+
+// Unpins, serving the latest generation
+func serveLatestGeneration() (AnswersDiff, error) {
+	servingMutex.Lock()
+	defer servingMutex.Unlock()
+	return serveGenerationLocked(generations.Latest(), false)
+}
+
+func serveGenerationLocked(number uint64, pin bool) (AnswersDiff, error) {
+	base, ok := generations.Get(number)
+	if !ok {
+		return nil, fmt.Errorf("No answers generation %d", number)
+	}
+	if pin {
+		generations.setPinned(number)
+	} else {
+		generations.setPinned(0)
+	}
+	generations.setServed(number)
+	diff := serveAnswers(base)
+	// Cached recursive answers may depend on which names were local
+	clearGlobalCache()
+	return diff, nil
+}
+
+func generationVar(req *http.Request, name string) (uint64, error) {
+	value := mux.Vars(req)[name]
+	if value == "latest" {
+		return generations.Latest(), nil
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid generation %q", value)
+	}
+	return number, nil
+}
+
+func httpListGenerations(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, generations.List())
+}
+
+func httpDiffGenerations(w http.ResponseWriter, req *http.Request) {
+	from, err := generationVar(req, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := generationVar(req, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fromAnswers, ok := generations.Get(from)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No answers generation %d", from), http.StatusNotFound)
+		return
+	}
+	toAnswers, ok := generations.Get(to)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No answers generation %d", to), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, DiffAnswers(fromAnswers, toAnswers))
+}
+
+// Serves an earlier generation: pinned until unpinned, or rolled back to until the next reload
+func httpServeGeneration(w http.ResponseWriter, req *http.Request) {
+	number, err := generationVar(req, "number")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pin := strings.HasSuffix(req.URL.Path, "/pin")
+
+	diff, err := serveGeneration(number, pin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	action := "Rolled back"
+	if pin {
+		action = "Pinned"
+	}
+	log.WithFields(log.Fields{"generation": number}).Infof("%s answers to generation %d", action, number)
+	diff.Log()
+	writeJSON(w, http.StatusOK, reloadResponse{Status: "OK", Changes: diff})
+}
+
+// Goes back to serving the latest generation
+func httpUnpinGeneration(w http.ResponseWriter, req *http.Request) {
+	diff, err := serveLatestGeneration()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Info("Unpinned answers, serving the latest generation")
+	diff.Log()
+	writeJSON(w, http.StatusOK, reloadResponse{Status: "OK", Changes: diff})
+}
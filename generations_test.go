@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestGenerations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "generations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldGlobal := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, globalCache
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, globalCache = oldDynamic, oldClients, oldGenerations, oldGlobal
+	}()
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := uint32(42)
+	version := func(ip string) Answers {
+		return Answers{DEFAULT_KEY: ClientAnswers{
+			A:   map[string]RecordA{"web.": {Ttl: &ttl, Answer: []string{ip}}},
+			Ptr: map[string]RecordPtr{"1.0.1.10.in-addr.arpa.": {Answer: "web."}},
+		}}
+	}
+	for _, ip := range []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4"} {
+		setAnswers(version(ip), "test")
+	}
+	served := func() string {
+		return snapshot().Answers[DEFAULT_KEY].A["web."].Answer[0]
+	}
+
+	router := newReloadRouter()
+	do := func(method string, url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		if v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %v: %s", method, url, err, w.Body.String())
+			}
+		}
+		return w.Code
+	}
+
+	var list []Generation
+	do("GET", "/v1/generations", &list)
+	if len(list) != 3 || list[0].Number != 2 || list[2].Number != 4 || !list[2].Served || list[2].Source != "test" {
+		t.Fatalf("Expected the last 3 generations [%+v]", list)
+	}
+
+	var diff map[string]SectionDiff
+	do("GET", "/v1/generations/2/diff/latest", &diff)
+	if d := diff[DEFAULT_KEY]; len(d.Changed) != 1 || d.Changed[0] != "A web." {
+		t.Fatalf("Unexpected diff [%v]", diff)
+	}
+	if code := do("GET", "/v1/generations/1/diff/2", nil); code != 404 {
+		t.Fatalf("Expected pruned generations to be gone, got %d", code)
+	}
+
+	// Pinned generations are served until unpinned, whatever gets loaded
+	globalCache = cache.New(10, 60)
+	globalCache.InsertMessage("cached", new(dns.Msg), time.Minute)
+	if code := do("POST", "/v1/generations/2/pin", nil); code != 200 || served() != "10.1.0.2" {
+		t.Fatalf("Expected generation 2 to be served, got %d [%s]", code, served())
+	}
+	if _, _, ok := globalCache.Search("cached"); ok {
+		t.Fatal("Expected the global cache to be cleared")
+	}
+	setAnswers(version("10.1.0.5"), "test")
+	if served() != "10.1.0.2" {
+		t.Fatalf("Expected the pinned generation to be served [%s]", served())
+	}
+	do("GET", "/v1/generations", &list)
+	if len(list) != 3 || list[0].Number != 2 || !list[0].Pinned || list[2].Number != 5 {
+		t.Fatalf("Expected the pinned generation to be kept [%+v]", list)
+	}
+	if code := do("DELETE", "/v1/generations/pin", nil); code != 200 || served() != "10.1.0.5" {
+		t.Fatalf("Expected the latest generation to be served, got %d [%s]", code, served())
+	}
+
+	// Rolled back generations are served until the next reload
+	if code := do("POST", "/v1/generations/4/rollback", nil); code != 200 || served() != "10.1.0.4" {
+		t.Fatalf("Expected generation 4 to be served, got %d [%s]", code, served())
+	}
+	setAnswers(version("10.1.0.6"), "test")
+	if served() != "10.1.0.6" {
+		t.Fatalf("Expected the new generation to be served [%s]", served())
+	}
+
+	// Generations on disk survive restarts, with the fields JSON leaves out
+	reloaded, err := LoadGenerations(3, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Latest() != 6 || len(reloaded.List()) != 3 {
+		t.Fatalf("Expected the generations to be reloaded [%+v]", reloaded.List())
+	}
+	a, _ := reloaded.Get(6)
+	if rec := a[DEFAULT_KEY].A["web."]; rec.Ttl == nil || *rec.Ttl != 42 || a[DEFAULT_KEY].Ptr["1.0.1.10.in-addr.arpa."].Answer != "web." {
+		t.Fatalf("Unexpected reloaded answers [%v]", a)
+	}
+
+	// So does the pin, and the pinned generation is served after a restart
+	if code := do("POST", "/v1/generations/5/pin", nil); code != 200 {
+		t.Fatalf("Expected generation 5 to be pinned, got %d", code)
+	}
+	if generations, err = LoadGenerations(3, dir); err != nil {
+		t.Fatal(err)
+	}
+	if generations.Pinned() != 5 {
+		t.Fatalf("Expected the pin to be reloaded, got %d", generations.Pinned())
+	}
+	setAnswers(version("10.1.0.7"), "test")
+	if served() != "10.1.0.5" || generations.Served() != 5 {
+		t.Fatalf("Expected the pinned generation to be served after a restart [%s]", served())
+	}
+	do("DELETE", "/v1/generations/pin", nil)
+	if reloaded, err = LoadGenerations(3, dir); err != nil || reloaded.Pinned() != 0 {
+		t.Fatalf("Expected the pin to be removed, got %d %v", reloaded.Pinned(), err)
+	}
+}
+
+func TestAmendedGenerations(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations = oldDynamic, oldClients, oldGenerations
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	version := func(ip string) Answers {
+		return Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{ip}}}}}
+	}
+
+	// A burst of source events is a single generation, after the one of the last reload
+	setAnswers(version("10.1.0.1"), "file")
+	for _, ip := range []string{"10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5"} {
+		amendAnswers(version(ip), "docker")
+	}
+	if list := generations.List(); len(list) != 2 || list[0].Number != 1 || list[1].Number != 2 || !list[1].Served {
+		t.Fatalf("Expected the events to amend a single generation [%+v]", list)
+	}
+	if a, _ := generations.Get(2); a[DEFAULT_KEY].A["web."].Answer[0] != "10.1.0.5" {
+		t.Fatalf("Expected the last event's answers [%v]", a)
+	}
+	if served := snapshot().Answers[DEFAULT_KEY].A["web."].Answer[0]; served != "10.1.0.5" {
+		t.Fatalf("Expected the amended generation to be served [%s]", served)
+	}
+
+	// Reloads add a generation, and pinned generations are never amended
+	setAnswers(version("10.1.0.6"), "file")
+	amendAnswers(version("10.1.0.7"), "docker")
+	if _, err := serveGeneration(4, true); err != nil {
+		t.Fatal(err)
+	}
+	amendAnswers(version("10.1.0.8"), "docker")
+	if a, _ := generations.Get(4); generations.Latest() != 5 || a[DEFAULT_KEY].A["web."].Answer[0] != "10.1.0.7" {
+		t.Fatalf("Expected a new generation after the pinned one [%+v]", generations.List())
+	}
+}
+
+func TestPinDuringReloads(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations = oldDynamic, oldClients, oldGenerations
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(1000, ""); err != nil {
+		t.Fatal(err)
+	}
+	setAnswers(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.1.0.1"}}}}}, "test")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			setAnswers(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{fmt.Sprintf("10.2.%d.%d", i/250, i%250)}}}}}, "test")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			serveGeneration(1, true)
+		}
+	}()
+	wg.Wait()
+
+	// No reload that started before a pin serves its answers after it
+	if a := snapshot().Base[DEFAULT_KEY].A["web."].Answer[0]; generations.Served() != 1 || a != "10.1.0.1" {
+		t.Fatalf("Expected the pinned generation to be served, got generation %d [%s]", generations.Served(), a)
+	}
+}
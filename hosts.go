@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// An /etc/hosts-format file whose entries are merged into a section of the answers
+type HostsFile struct {
+	Path string  `json:"path"`
+	Ttl  *uint32 `json:"ttl"`
+}
+
+type hostsEntry struct {
+	ip    net.IP
+	names []string
+}
+
+// Reads an /etc/hosts-format file: an address followed by its canonical name and aliases
+// on each line, with # comments.
+func ParseHosts(path string) ([]hostsEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []hostsEntry
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := scanner.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			log.Warnf("Ignoring %s:%d: no host name", path, line)
+			continue
+		}
+
+		// Zone indexes (fe80::1%lo0) don't mean anything to DNS
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			log.Warnf("Ignoring %s:%d: invalid address %s", path, line, fields[0])
+			continue
+		}
+
+		entry := hostsEntry{ip: ip}
+		for _, name := range fields[1:] {
+			entry.names = append(entry.names, strings.ToLower(dns.Fqdn(name)))
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Adds the entries of the hosts files listed in each section to that section. Records that are
+// already in the section itself take precedence over hosts file entries.
+func MergeHosts(answers *Answers) error {
+	for key, client := range *answers {
+		if len(client.Hosts) == 0 {
+			continue
+		}
+
+		a := make(map[string]RecordA)
+		aaaa := make(map[string]RecordA)
+		ptr := make(map[string]RecordPtr)
+		for _, hosts := range client.Hosts {
+			entries, err := ParseHosts(hosts.Path)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				forward := a
+				if entry.ip.To4() == nil {
+					forward = aaaa
+				}
+				for _, name := range entry.names {
+					rec := forward[name]
+					rec.Ttl = hosts.Ttl
+					rec.Answer = append(rec.Answer, entry.ip.String())
+					forward[name] = rec
+				}
+
+				// The canonical (first) name is the one addresses map back to
+				reverse, err := dns.ReverseAddr(entry.ip.String())
+				if err == nil {
+					if _, ok := ptr[reverse]; !ok {
+						ptr[reverse] = RecordPtr{Ttl: hosts.Ttl, Answer: entry.names[0]}
+					}
+				}
+			}
+			log.Debugf("Loaded %d hosts entries from %s into %s", len(entries), hosts.Path, key)
+		}
+
+		client.A = mergeRecordsA(client.A, a)
+		client.Aaaa = mergeRecordsA(client.Aaaa, aaaa)
+		if client.Ptr == nil {
+			client.Ptr = make(map[string]RecordPtr)
+		}
+		for name, rec := range ptr {
+			if _, ok := client.Ptr[name]; !ok {
+				client.Ptr[name] = rec
+			}
+		}
+		(*answers)[key] = client
+	}
+
+	return nil
+}
+
+func mergeRecordsA(records map[string]RecordA, more map[string]RecordA) map[string]RecordA {
+	if len(more) == 0 {
+		return records
+	}
+	if records == nil {
+		records = make(map[string]RecordA)
+	}
+	for name, rec := range more {
+		if _, ok := records[name]; !ok {
+			records[name] = rec
+		}
+	}
+	return records
+}
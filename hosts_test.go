@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hosts := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(hosts, []byte(`
+# static entries
+10.1.2.3    db.example.   db
+10.1.2.4    db.example.
+fd00::5     DB.example.   # IPv6 too
+bad-address nothing.
+10.1.2.9    web.
+`), 0644)
+
+	answersFile := filepath.Join(dir, "answers.yaml")
+	ioutil.WriteFile(answersFile, []byte(`
+default:
+  a:
+    web.:
+      answer: ["192.0.2.1"]
+  hosts:
+  - path: `+hosts+`
+    ttl: 42
+`), 0644)
+
+	answers, err := ParseAnswers(answersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := answers[DEFAULT_KEY]
+
+	if a := def.A["db.example."]; len(a.Answer) != 2 || a.Ttl == nil || *a.Ttl != 42 {
+		t.Fatalf("Incorrect A record for db.example. [%v]", a)
+	}
+	if a := def.A["db."]; len(a.Answer) != 1 || a.Answer[0] != "10.1.2.3" {
+		t.Fatalf("Incorrect A record for alias db. [%v]", a)
+	}
+	if a := def.Aaaa["db.example."]; len(a.Answer) != 1 || a.Answer[0] != "fd00::5" {
+		t.Fatalf("Incorrect AAAA record for db.example. [%v]", a)
+	}
+	if a := def.A["web."]; len(a.Answer) != 1 || a.Answer[0] != "192.0.2.1" {
+		t.Fatalf("Records in the answers file should take precedence [%v]", a)
+	}
+	if p := def.Ptr["3.2.1.10.in-addr.arpa."]; p.Answer != "db.example." {
+		t.Fatalf("Incorrect PTR record [%v]", p)
+	}
+	if _, ok := def.Ptr["5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa."]; !ok {
+		t.Fatalf("Missing IPv6 PTR record [%v]", def.Ptr)
+	}
+
+	records, ok := unindexed(answers).AddressesOfType(dns.TypeAAAA, "10.1.2.2", "db.example.", "db.example.", nil, 1)
+	if !ok || len(records) != 1 {
+		t.Fatalf("Expected an AAAA answer [%v]", records)
+	}
+}
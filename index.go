@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+type indexKey struct {
+	client string
+	qtype  uint16
+	fqdn   string
+}
+
+// Lookups compiled from a snapshot of the answers when it's published, so that queries don't
+// recompute suffixes, parse addresses or build records. Immutable once built.
+type AnswersIndex struct {
+	records       map[indexKey][]dns.RR
+	authoritative []string
+	acls          map[string]clientAcls
+	// By the sections with search suffixes of their own, and DEFAULT_KEY for everyone else
+	searches map[string]searchView
+}
+
+type searchKey struct {
+	qtype uint16
+	base  string // the question without its trailing dot
+}
+
+// The default names a question matches through a list of search suffixes, the first suffix that
+// matches taking precedence
+type searchView []searchSuffix
+
+// The default names under a search suffix, by the question they match
+type searchSuffix struct {
+	suffix string
+	names  map[searchKey]string
+}
+
+// Builds the records of every section with their owner names; lookups only copy them to rename
+// them as the question.
+func compileIndex(answers Answers) *AnswersIndex {
+	idx := &AnswersIndex{records: make(map[indexKey][]dns.RR)}
+	idx.authoritative = unindexed(answers).AuthoritativeSuffixes()
+	idx.acls = compileAcls(answers)
+
+	for key, client := range answers {
+		for fqdn := range client.A {
+			idx.add(&answers, dns.TypeA, key, fqdn)
+		}
+		for fqdn := range client.Aaaa {
+			idx.add(&answers, dns.TypeAAAA, key, fqdn)
+		}
+		for fqdn := range client.Cname {
+			idx.add(&answers, dns.TypeCNAME, key, fqdn)
+		}
+		for fqdn := range client.Ptr {
+			idx.add(&answers, dns.TypePTR, key, fqdn)
+		}
+		for fqdn := range client.Txt {
+			idx.add(&answers, dns.TypeTXT, key, fqdn)
+		}
+		for fqdn := range client.Srv {
+			idx.add(&answers, dns.TypeSRV, key, fqdn)
+		}
+	}
+	idx.compileSearches(answers)
+	log.Debugf("Indexed %d RRsets", len(idx.records))
+	return idx
+}
+
+// Merges the client's search suffixes with the default ones for every section that has its own.
+// The names under each suffix are found once and shared by every list the suffix is in.
+func (idx *AnswersIndex) compileSearches(answers Answers) {
+	bySuffix := make(map[string]map[searchKey]string)
+	labels := 0
+	for key := range answers {
+		for _, suffix := range answers.SearchSuffixes(key) {
+			dotted := "." + strings.TrimRight(suffix, ".") + "."
+			bySuffix[dotted] = make(map[searchKey]string)
+			if n := strings.Count(dotted, ".") - 1; n > labels {
+				labels = n
+			}
+		}
+	}
+	for k := range idx.records {
+		if k.client != DEFAULT_KEY {
+			continue
+		}
+		// From the last label up to the longest suffix
+		for i, n := len(k.fqdn)-2, 0; i > 0 && n < labels; i-- {
+			if k.fqdn[i] != '.' {
+				continue
+			}
+			n++
+			if names, ok := bySuffix[k.fqdn[i:]]; ok {
+				names[searchKey{k.qtype, k.fqdn[:i]}] = k.fqdn
+			}
+		}
+	}
+
+	view := func(searches []string) searchView {
+		v := make(searchView, 0, len(searches))
+		for _, suffix := range searches {
+			v = append(v, searchSuffix{suffix, bySuffix["."+strings.TrimRight(suffix, ".")+"."]})
+		}
+		return v
+	}
+	defaultSearches := answers.SearchSuffixes(DEFAULT_KEY)
+	idx.searches = map[string]searchView{DEFAULT_KEY: view(defaultSearches)}
+	for key := range answers {
+		if searches := answers.SearchSuffixes(key); key != DEFAULT_KEY && len(searches) > 0 {
+			idx.searches[key] = view(append(append([]string{}, searches...), defaultSearches...))
+		}
+	}
+}
+
+func (idx *AnswersIndex) add(answers *Answers, qtype uint16, client string, fqdn string) {
+	if records, ok := answers.buildExact(qtype, client, fqdn, fqdn); ok {
+		idx.records[indexKey{client, qtype, fqdn}] = records
+	}
+}
+
+// The default records for fqdn, exactly or through the search suffixes of a client. Names in
+// zones we are authoritative for only use the default search suffixes.
+func (idx *AnswersIndex) search(qtype uint16, clientUUID string, authoritative bool, fqdn string, answerFqdn string) ([]dns.RR, bool) {
+	if records, ok := idx.exact(qtype, DEFAULT_KEY, fqdn, answerFqdn); ok {
+		return records, true
+	}
+
+	base := strings.TrimRight(fqdn, ".")
+	if limit := int(*ndots); limit != 0 && strings.Count(base, ".") >= limit {
+		return nil, false
+	}
+	view, ok := idx.searches[clientUUID]
+	if !ok || authoritative {
+		view = idx.searches[DEFAULT_KEY]
+	}
+	for _, search := range view {
+		if match, ok := search.names[searchKey{qtype, base}]; ok {
+			if debugging() {
+				log.WithFields(log.Fields{"fqdn": match, "client": clientUUID, "suffix": search.suffix}).Debug("Matched alternate suffix")
+			}
+			return idx.exact(qtype, DEFAULT_KEY, match, answerFqdn)
+		}
+	}
+	return nil, false
+}
+
+// The records for fqdn, renamed as answerFqdn. Records are copied so that callers can change them.
+func (idx *AnswersIndex) exact(qtype uint16, clientUUID string, fqdn string, answerFqdn string) ([]dns.RR, bool) {
+	compiled, ok := idx.records[indexKey{clientUUID, qtype, fqdn}]
+	if !ok {
+		return nil, false
+	}
+
+	records := renamed(compiled, answerFqdn)
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		shuffle(&records)
+	}
+	return records, true
+}
+
+// Copies the records we index with a new owner name, into one array for the RRset. Addresses and
+// strings are shared, they are never modified.
+func renamed(compiled []dns.RR, name string) []dns.RR {
+	records := make([]dns.RR, len(compiled))
+	switch compiled[0].(type) {
+	case *dns.A:
+		copies := make([]dns.A, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.A)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	case *dns.AAAA:
+		copies := make([]dns.AAAA, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.AAAA)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	case *dns.TXT:
+		copies := make([]dns.TXT, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.TXT)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	case *dns.CNAME:
+		copies := make([]dns.CNAME, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.CNAME)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	case *dns.PTR:
+		copies := make([]dns.PTR, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.PTR)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	case *dns.SRV:
+		copies := make([]dns.SRV, len(compiled))
+		for i, rr := range compiled {
+			copies[i] = *rr.(*dns.SRV)
+			copies[i].Hdr.Name = name
+			records[i] = &copies[i]
+		}
+	default:
+		for i, rr := range compiled {
+			records[i] = dns.Copy(rr)
+			records[i].Header().Name = name
+		}
+	}
+	return records
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func indexedAnswers(t testing.TB, names int) Answers {
+	ttl := uint32(60)
+	def := ClientAnswers{
+		Authoritative: []string{"lab.example."},
+		Search:        []string{"svc.example"},
+		A:             make(map[string]RecordA),
+		Aaaa:          make(map[string]RecordA),
+		Cname:         make(map[string]RecordCname),
+		Ptr:           make(map[string]RecordPtr),
+		Txt:           make(map[string]RecordTxt),
+	}
+	for i := 0; i < names; i++ {
+		name := fmt.Sprintf("host-%d.svc.example.", i)
+		def.A[name] = RecordA{Ttl: &ttl, Answer: []string{fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), "10.2.0.1", "10.2.0.2"}}
+		def.Aaaa[name] = RecordA{Answer: []string{fmt.Sprintf("fd00::%x", i+1)}}
+		def.Ptr[fmt.Sprintf("%d.%d.1.10.in-addr.arpa.", i%250+1, i/250)] = RecordPtr{Answer: name}
+		def.Cname[fmt.Sprintf("alias-%d.lab.example.", i)] = RecordCname{Answer: name}
+		def.Txt[fmt.Sprintf("alias-%d.lab.example.", i)] = RecordTxt{Answer: []AnswerStrings{{"v=1"}, {"owner=ops"}}}
+	}
+	def.A["bad.svc.example."] = RecordA{Answer: []string{"10.1.0.x", "10.1.0.1"}}
+
+	client := ClientAnswers{
+		Search: []string{"team.example.", "svc.example."},
+		A:      map[string]RecordA{"host-1.team.example.": {Answer: []string{"10.3.0.1"}}},
+	}
+	return Answers{DEFAULT_KEY: def, "10.42.1.5": client}
+}
+
+func sortedRecords(records []dns.RR) []string {
+	var strs []string
+	for _, rr := range records {
+		strs = append(strs, rr.String())
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func TestIndexMatchesAnswers(t *testing.T) {
+	oldSnapshot, oldDynamic := loadSnapshot(), dynamicRecords
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords = oldDynamic
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not published, so looked up without an index
+	plain := unindexed(indexedAnswers(t, 20))
+	publish(indexedAnswers(t, 20))
+	indexed := snapshot()
+	if indexed.index == nil {
+		t.Fatal("Expected the published answers to be indexed")
+	}
+	if !reflect.DeepEqual(plain.AuthoritativeSuffixes(), indexed.AuthoritativeSuffixes()) {
+		t.Fatalf("Authoritative suffixes differ [%v] [%v]", plain.AuthoritativeSuffixes(), indexed.AuthoritativeSuffixes())
+	}
+
+	questions := []struct {
+		qtype  uint16
+		client string
+		fqdn   string
+	}{
+		{dns.TypeA, "10.42.1.9", "host-3.svc.example."},
+		{dns.TypeA, "10.42.1.9", "host-3."},
+		{dns.TypeA, "10.42.1.5", "host-1."},
+		{dns.TypeA, "10.42.1.5", "host-2."},
+		{dns.TypeAAAA, "10.42.1.5", "host-4."},
+		{dns.TypeA, "10.42.1.5", "missing."},
+		{dns.TypeA, "10.42.1.5", "host-5.lab.example."},
+		{dns.TypeA, "10.42.1.9", "bad.svc.example."},
+		{dns.TypeA, "10.42.1.9", "missing.svc.example."},
+		{dns.TypeAAAA, "10.42.1.9", "host-4.svc.example."},
+		{dns.TypeCNAME, "10.42.1.5", "alias-5.lab.example."},
+		{dns.TypeTXT, "10.42.1.9", "alias-6.lab.example."},
+		{dns.TypePTR, "10.42.1.9", "8.0.1.10.in-addr.arpa."},
+	}
+	for _, q := range questions {
+		want, wantOk := plain.Matching(q.qtype, q.client, q.fqdn, q.fqdn)
+		got, gotOk := indexed.Matching(q.qtype, q.client, q.fqdn, q.fqdn)
+		if wantOk != gotOk || !reflect.DeepEqual(sortedRecords(want), sortedRecords(got)) {
+			t.Errorf("%s %s from %s: expected %v, got %v", dns.TypeToString[q.qtype], q.fqdn, q.client, want, got)
+		}
+	}
+
+	// Callers get their own copies of the indexed records
+	records, _ := indexed.Matching(dns.TypeA, "10.42.1.9", "host-3.", "host-3.")
+	records[0].Header().Ttl = 1
+	if again, _ := indexed.Matching(dns.TypeA, "10.42.1.9", "host-3.", "host-3."); again[0].Header().Ttl != 60 || again[0].Header().Name != "host-3." {
+		t.Fatalf("The index was modified [%v]", again)
+	}
+}
+
+// Looks up the names of 5000 services, from a client with search suffixes or, with exact, only
+// the exact names in the default answers
+func benchmarkMatching(b *testing.B, indexed bool, exact bool) {
+	oldSnapshot, oldDynamic := loadSnapshot(), dynamicRecords
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords = oldDynamic
+	}()
+	dynamicRecords, _ = LoadDynamicRecords("")
+
+	answers := unindexed(indexedAnswers(b, 5000))
+	if indexed {
+		publish(answers.Answers)
+		answers = snapshot()
+	}
+	type question struct {
+		qtype uint16
+		fqdn  string
+	}
+	var questions []question
+	for n := 0; n < 5000; n++ {
+		questions = append(questions,
+			question{dns.TypeA, fmt.Sprintf("host-%d.svc.example.", n)},
+			question{dns.TypeAAAA, fmt.Sprintf("host-%d.svc.example.", n)},
+			question{dns.TypePTR, fmt.Sprintf("%d.%d.1.10.in-addr.arpa.", n%250+1, n/250)},
+			question{dns.TypeTXT, fmt.Sprintf("alias-%d.lab.example.", n)},
+		)
+		if !exact {
+			questions = append(questions, question{dns.TypeA, fmt.Sprintf("host-%d.", n)})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q := questions[i%len(questions)]
+		var ok bool
+		if exact {
+			_, ok = answers.MatchingExact(q.qtype, DEFAULT_KEY, q.fqdn, q.fqdn)
+		} else {
+			_, ok = answers.Matching(q.qtype, "10.42.1.5", q.fqdn, q.fqdn)
+		}
+		if !ok {
+			b.Fatalf("No answer for %s", q.fqdn)
+		}
+	}
+}
+
+func BenchmarkMatching(b *testing.B)             { benchmarkMatching(b, false, false) }
+func BenchmarkMatchingIndexed(b *testing.B)      { benchmarkMatching(b, true, false) }
+func BenchmarkMatchingExact(b *testing.B)        { benchmarkMatching(b, false, true) }
+func BenchmarkMatchingExactIndexed(b *testing.B) { benchmarkMatching(b, true, true) }
+
+// Many sections with search lists of their own, each compiled into a view
+func BenchmarkCompileIndex(b *testing.B) {
+	answers := indexedAnswers(b, 10000)
+	for i := 0; i < 200; i++ {
+		answers[fmt.Sprintf("10.42.2.%d", i)] = ClientAnswers{Search: []string{fmt.Sprintf("team-%d.example.", i), "svc.example."}}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compileIndex(answers)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const KUBE_IN_CLUSTER = "in-cluster"
+
+// How long to wait for the informers to list every resource
+var kubeSyncTimeout = 30 * time.Second
+
+// A client for the API server at server, or for the pod's own cluster with its service account
+func NewKubernetesClient(server string) (kubernetes.Interface, error) {
+	config := &rest.Config{Host: server}
+	if server == KUBE_IN_CLUSTER {
+		var err error
+		if config, err = rest.InClusterConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// Builds answers from the Services, Endpoints and Pods of a cluster, kept up to date by informers
+type KubernetesSource struct {
+	domain    string
+	factory   informers.SharedInformerFactory
+	services  listers.ServiceLister
+	endpoints listers.EndpointsLister
+	pods      listers.PodLister
+	synced    []cache.InformerSynced
+	stop      chan struct{}
+	changed   chan struct{}
+}
+
+func NewKubernetesSource(client kubernetes.Interface, domain string) *KubernetesSource {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	core := factory.Core().V1()
+	k := &KubernetesSource{
+		domain:    strings.ToLower(strings.Trim(domain, ".")),
+		factory:   factory,
+		services:  core.Services().Lister(),
+		endpoints: core.Endpoints().Lister(),
+		pods:      core.Pods().Lister(),
+		stop:      make(chan struct{}),
+		changed:   make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { k.signal() },
+		UpdateFunc: func(interface{}, interface{}) { k.signal() },
+		DeleteFunc: func(interface{}) { k.signal() },
+	}
+	for _, informer := range []cache.SharedIndexInformer{core.Services().Informer(), core.Endpoints().Informer(), core.Pods().Informer()} {
+		informer.AddEventHandler(handler)
+		k.synced = append(k.synced, informer.HasSynced)
+	}
+	return k
+}
+
+// Signalled when the objects change; several changes may be signalled once
+func (k *KubernetesSource) Changes() <-chan struct{} {
+	return k.changed
+}
+
+func (k *KubernetesSource) signal() {
+	select {
+	case k.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Starts the informers and waits until they have listed every resource
+func (k *KubernetesSource) Sync() error {
+	k.factory.Start(k.stop)
+
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(kubeSyncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeout, k.synced...) {
+		return errors.New("Timed out listing the services, endpoints and pods of the cluster")
+	}
+	return nil
+}
+
+// Stops the informers
+func (k *KubernetesSource) Stop() {
+	close(k.stop)
+}
+
+func (k *KubernetesSource) Name() string {
+	return "kubernetes"
+}
+
+// The answers for the objects. Sync first.
+func (k *KubernetesSource) Load() (Answers, error) {
+	return k.GenerateAnswers()
+}
+
+// Relays the changes the informers see for as long as the process runs. Sync first.
+func (k *KubernetesSource) Watch(changed func()) error {
+	go relayChanges(k.Changes(), changed)
+	return nil
+}
+
+// The answers for the objects: A, AAAA, SRV and PTR records for services in the default section,
+// and a section with the search domains of its namespace for each pod
+func (k *KubernetesSource) GenerateAnswers() (Answers, error) {
+	recurse, err := getGlobalRecurse()
+	if err != nil {
+		return nil, err
+	}
+
+	def := ClientAnswers{
+		Recurse:       recurse,
+		Authoritative: []string{k.domain},
+		A:             make(map[string]RecordA),
+		Aaaa:          make(map[string]RecordA),
+		Cname:         make(map[string]RecordCname),
+		Ptr:           make(map[string]RecordPtr),
+		Srv:           make(map[string]RecordSrv),
+	}
+
+	services, err := k.services.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	// In order, so that addresses in several services always get the same PTR record
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	for _, svc := range services {
+		fqdn := strings.ToLower(fmt.Sprintf("%s.%s.svc.%s.", svc.Name, svc.Namespace, k.domain))
+
+		switch {
+		case svc.Spec.Type == v1.ServiceTypeExternalName:
+			if svc.Spec.ExternalName != "" {
+				def.Cname[fqdn] = RecordCname{Answer: strings.ToLower(dns.Fqdn(svc.Spec.ExternalName))}
+			}
+
+		case svc.Spec.ClusterIP == v1.ClusterIPNone:
+			// Endpoints may not have been created yet
+			if endpoints, err := k.endpoints.Endpoints(svc.Namespace).Get(svc.Name); err == nil {
+				addKubeHeadless(&def, fqdn, svc, endpoints)
+			}
+
+		default:
+			if svc.Spec.ClusterIP != "" && addKubeAddress(&def, fqdn, svc.Spec.ClusterIP) {
+				def.Ptr[reverseAddr(svc.Spec.ClusterIP)] = RecordPtr{Answer: fqdn}
+			}
+			for _, port := range svc.Spec.Ports {
+				addKubeSrv(&def, fqdn, port.Name, port.Protocol, SrvTarget{Weight: 100, Port: uint16(port.Port), Target: fqdn})
+			}
+		}
+	}
+	sortKubeAnswers(&def)
+
+	pods, err := k.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	answers := Answers{DEFAULT_KEY: def}
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || pod.Status.PodIP == "" {
+			continue
+		}
+		answers[pod.Status.PodIP] = ClientAnswers{
+			Search: []string{
+				strings.ToLower(fmt.Sprintf("%s.svc.%s", pod.Namespace, k.domain)),
+				"svc." + k.domain,
+				k.domain,
+			},
+		}
+	}
+	return answers, nil
+}
+
+// Headless services resolve to their ready endpoints, and each endpoint has a name under the
+// service: its hostname, or its address with dashes
+func addKubeHeadless(def *ClientAnswers, fqdn string, svc *v1.Service, endpoints *v1.Endpoints) {
+	for _, subset := range endpoints.Subsets {
+		addresses := subset.Addresses
+		if svc.Spec.PublishNotReadyAddresses {
+			addresses = append(addresses[:len(addresses):len(addresses)], subset.NotReadyAddresses...)
+		}
+		for _, address := range addresses {
+			name := address.Hostname
+			if name == "" {
+				name = strings.NewReplacer(".", "-", ":", "-").Replace(address.IP)
+			}
+			endpointFqdn := strings.ToLower(name + "." + fqdn)
+			addKubeAddress(def, fqdn, address.IP)
+			addKubeAddress(def, endpointFqdn, address.IP)
+			if address.Hostname != "" {
+				def.Ptr[reverseAddr(address.IP)] = RecordPtr{Answer: endpointFqdn}
+			}
+			for _, port := range subset.Ports {
+				addKubeSrv(def, fqdn, port.Name, port.Protocol, SrvTarget{Weight: 100, Port: uint16(port.Port), Target: endpointFqdn})
+			}
+		}
+	}
+}
+
+// Adds ip to the A or AAAA record for fqdn, unless it's invalid
+func addKubeAddress(def *ClientAnswers, fqdn string, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		log.Warnf("Invalid address %s for %s", ip, fqdn)
+		return false
+	}
+	records := def.A
+	if parsed.To4() == nil {
+		records = def.Aaaa
+	}
+	rec := records[fqdn]
+	rec.Answer = append(rec.Answer, parsed.String())
+	records[fqdn] = rec
+	return true
+}
+
+// Named ports get an SRV record, as _name._protocol under the service
+func addKubeSrv(def *ClientAnswers, fqdn string, name string, protocol v1.Protocol, target SrvTarget) {
+	if name == "" || target.Port == 0 {
+		return
+	}
+	if protocol == "" {
+		protocol = v1.ProtocolTCP
+	}
+	srvName := strings.ToLower(fmt.Sprintf("_%s._%s.%s", name, protocol, fqdn))
+	rec := def.Srv[srvName]
+	rec.Answer = append(rec.Answer, target)
+	def.Srv[srvName] = rec
+}
+
+func reverseAddr(ip string) string {
+	reverse, _ := dns.ReverseAddr(ip)
+	return reverse
+}
+
+// Sorts the answers, so that the same objects always give the same answers
+func sortKubeAnswers(def *ClientAnswers) {
+	for _, rec := range def.A {
+		sort.Strings(rec.Answer)
+	}
+	for _, rec := range def.Aaaa {
+		sort.Strings(rec.Answer)
+	}
+	for _, rec := range def.Srv {
+		sort.Slice(rec.Answer, func(i, j int) bool {
+			if rec.Answer[i].Target != rec.Answer[j].Target {
+				return rec.Answer[i].Target < rec.Answer[j].Target
+			}
+			return rec.Answer[i].Port < rec.Answer[j].Port
+		})
+	}
+}
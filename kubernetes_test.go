@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+var (
+	kubeWebService = &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: "10.43.0.10", Ports: []v1.ServicePort{
+			{Name: "http", Protocol: v1.ProtocolTCP, Port: 80},
+			{Protocol: v1.ProtocolTCP, Port: 8080},
+		}},
+	}
+	kubeDbService = &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"},
+		Spec:       v1.ServiceSpec{ClusterIP: v1.ClusterIPNone, Ports: []v1.ServicePort{{Name: "mysql", Port: 3306}}},
+	}
+	kubeDbEndpoints = &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.42.0.7", Hostname: "db-0"}, {IP: "10.42.0.8"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.42.0.9", Hostname: "db-2"}},
+			Ports:             []v1.EndpointPort{{Name: "mysql", Protocol: v1.ProtocolTCP, Port: 3306}},
+		}},
+	}
+	kubeMailService = &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "mail", Namespace: "shop"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "Smtp.Example.com"},
+	}
+	kubeWebPod = &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "shop"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.42.0.5"},
+	}
+	kubeNodePod = &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "kube-system"},
+		Spec:       v1.PodSpec{HostNetwork: true},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "192.168.1.10"},
+	}
+)
+
+func TestKubernetesAnswers(t *testing.T) {
+	client := fake.NewSimpleClientset(kubeWebService, kubeDbService, kubeDbEndpoints, kubeMailService, kubeWebPod, kubeNodePod)
+	source := NewKubernetesSource(client, "cluster.local.")
+	defer source.Stop()
+	if err := source.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := source.GenerateAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := answers[DEFAULT_KEY]
+
+	if a := def.A["web.shop.svc.cluster.local."].Answer; len(a) != 1 || a[0] != "10.43.0.10" {
+		t.Fatalf("Unexpected A record for the service [%v]", a)
+	}
+	if srv := def.Srv["_http._tcp.web.shop.svc.cluster.local."].Answer; len(srv) != 1 || srv[0].Port != 80 || srv[0].Target != "web.shop.svc.cluster.local." {
+		t.Fatalf("Unexpected SRV record for the service [%v]", srv)
+	}
+	if len(def.Srv) != 2 {
+		t.Fatalf("Expected SRV records for named ports only [%v]", def.Srv)
+	}
+	if ptr := def.Ptr["10.0.43.10.in-addr.arpa."].Answer; ptr != "web.shop.svc.cluster.local." {
+		t.Fatalf("Unexpected PTR record for the service [%v]", ptr)
+	}
+
+	// Headless services resolve to their ready endpoints
+	if a := def.A["db.shop.svc.cluster.local."].Answer; len(a) != 2 || a[0] != "10.42.0.7" || a[1] != "10.42.0.8" {
+		t.Fatalf("Unexpected A record for the headless service [%v]", a)
+	}
+	if a := def.A["10-42-0-8.db.shop.svc.cluster.local."].Answer; len(a) != 1 {
+		t.Fatalf("Expected a record for the endpoint without a hostname [%v]", def.A)
+	}
+	srv := def.Srv["_mysql._tcp.db.shop.svc.cluster.local."].Answer
+	if len(srv) != 2 || srv[1].Target != "db-0.db.shop.svc.cluster.local." || srv[1].Port != 3306 {
+		t.Fatalf("Unexpected SRV record for the headless service [%v]", srv)
+	}
+	if ptr := def.Ptr["7.0.42.10.in-addr.arpa."].Answer; ptr != "db-0.db.shop.svc.cluster.local." {
+		t.Fatalf("Unexpected PTR record for the endpoint [%v]", ptr)
+	}
+	if _, ok := def.A["db-2.db.shop.svc.cluster.local."]; ok {
+		t.Fatal("Expected no record for the endpoint that isn't ready")
+	}
+	if cname := def.Cname["mail.shop.svc.cluster.local."].Answer; cname != "smtp.example.com." {
+		t.Fatalf("Unexpected CNAME for the external name [%v]", cname)
+	}
+
+	// Pods search their namespace first
+	if search := answers["10.42.0.5"].Search; len(search) != 3 || search[0] != "shop.svc.cluster.local" {
+		t.Fatalf("Unexpected search domains for the pod [%v]", search)
+	}
+	if _, ok := answers["192.168.1.10"]; ok {
+		t.Fatal("Expected no section for pods on the host network")
+	}
+	records, ok := unindexed(answers).Matching(dns.TypeSRV, "10.42.0.5", "_http._tcp.web.shop.svc.cluster.local.", "_http._tcp.web.shop.svc.cluster.local.")
+	if !ok || records[0].(*dns.SRV).Port != 80 {
+		t.Fatalf("Expected the SRV record to be served [%v]", records)
+	}
+	records, ok = unindexed(answers).Addresses("10.42.0.5", "web.", "web.", nil, 1)
+	if !ok || records[0].(*dns.A).A.String() != "10.43.0.10" {
+		t.Fatalf("Expected the service through the pod's search domains [%v]", records)
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	client := fake.NewSimpleClientset(kubeWebService, kubeDbService)
+	// The fake clientset doesn't send events for its objects, each resource gets a watch to send them on
+	watchers := map[string]*watch.FakeWatcher{"services": watch.NewFake(), "endpoints": watch.NewFake(), "pods": watch.NewFake()}
+	for resource, watcher := range watchers {
+		client.PrependWatchReactor(resource, kubetesting.DefaultWatchReactor(watcher, nil))
+	}
+
+	source := NewKubernetesSource(client, "cluster.local")
+	defer source.Stop()
+	if err := source.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Checks the answers every time they change, until they are as expected
+	waitFor := func(what string, expected func(Answers) bool) {
+		timeout := time.After(5 * time.Second)
+		for {
+			answers, err := source.GenerateAnswers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected(answers) {
+				return
+			}
+			select {
+			case <-source.Changes():
+			case <-timeout:
+				t.Fatalf("Expected %s", what)
+			}
+		}
+	}
+
+	watchers["services"].Add(kubeMailService)
+	waitFor("the added service", func(answers Answers) bool {
+		_, ok := answers[DEFAULT_KEY].Cname["mail.shop.svc.cluster.local."]
+		return ok
+	})
+	watchers["services"].Delete(kubeWebService)
+	waitFor("the deleted service to be gone", func(answers Answers) bool {
+		_, ok := answers[DEFAULT_KEY].A["web.shop.svc.cluster.local."]
+		return !ok
+	})
+	watchers["endpoints"].Add(kubeDbEndpoints)
+	waitFor("the endpoints of the headless service", func(answers Answers) bool {
+		return len(answers[DEFAULT_KEY].A["db.shop.svc.cluster.local."].Answer) == 2
+	})
+	watchers["pods"].Add(kubeWebPod)
+	waitFor("the added pod", func(answers Answers) bool {
+		_, ok := answers["10.42.0.5"]
+		return ok
+	})
+}
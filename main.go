@@ -11,11 +11,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -31,6 +31,13 @@ var (
 	listen          = flag.String("listen", ":53", "Address to listen to (TCP and UDP)")
 	listenReload    = flag.String("listenReload", "127.0.0.1:8113", "Address to listen to for reload requests (TCP)")
 	answersFile     = flag.String("answers", "./answers.yaml", "File containing the answers to respond with")
+	checkOnly       = flag.Bool("check", false, "Check the answers file and the files it includes, then exit (non-zero if there are problems)")
+	strictAnswers   = flag.Bool("strict", false, "Refuse to load answers files with problems instead of logging them")
+	dynamicFile     = flag.String("dynamic-records", "/var/lib/rancher-dns/dynamic.json", "File the records added through the API or by UPDATE are kept in, so they survive restarts (empty to keep them in memory only)")
+	generationCount = flag.Uint("generations", 10, "Number of answers generations to keep for rollback")
+	generationsDir  = flag.String("generations-dir", "", "Directory to keep answers generations in, so that they survive restarts (default memory only)")
+	watchFiles      = flag.Bool("watch", true, "Reload when the answers file or a file it includes changes")
+	watchDelay      = flag.Uint("watch-delay", 500, "Time (in milliseconds) to wait for changes to settle before reloading")
 	defaultTtl      = flag.Uint("ttl", 600, "TTL for answers")
 	recurserTimeout = flag.Uint("recurser-timeout", 2, "timeout (in seconds) for recurser")
 	ndots           = flag.Uint("ndots", 0, "Queries with more than this number of dots will not use search paths")
@@ -41,28 +48,78 @@ var (
 	metadataAnswer  = flag.String("rancher-metadata-answer", "169.254.169.250", "Metadata IP address(es), comma-delimited (adds static A records)")
 	neverRecurseTo  = flag.String("never-recurse-to", "169.254.169.250", "Never recurse to IP address(es), comma-delimited")
 	namespace       = flag.String("namespace", "discover.internal", "Global namespace")
-
-	answers                   Answers
+	dnssecValidate  = flag.Bool("dnssec-validate", false, "Validate DNSSEC signatures of recursive answers")
+	trustAnchor     = flag.String("trust-anchor", "", "File with DS or DNSKEY trust anchors for DNSSEC validation (default the root zone KSK)")
+	dnssecKsk       = flag.String("dnssec-ksk", "", "Key signing key file(s) for signing authoritative zones, comma-delimited")
+	dnssecZsk       = flag.String("dnssec-zsk", "", "Zone signing key file(s) for signing authoritative zones, comma-delimited")
+	rpzFiles        = flag.String("rpz", "", "Response policy zone file(s), comma-delimited, in order of precedence")
+	rpzAxfr         = flag.String("rpz-axfr", "", "Response policy zone(s) to transfer, as zone@server, comma-delimited, after the --rpz files")
+	allowQuery      = flag.String("allow-query", "", "CIDRs allowed to query, comma-delimited (default everyone)")
+	allowRecursion  = flag.String("allow-recursion", "", "CIDRs allowed to get answers for names we are not authoritative for, comma-delimited (default everyone)")
+	rrlClientRate   = flag.Uint("rrl-client-rate", 0, "Responses per second per client over UDP (0 for no limit)")
+	rrlNameRate     = flag.Uint("rrl-name-rate", 0, "Responses per second per client for a single name over UDP (0 for no limit)")
+	rrlSlip         = flag.Uint("rrl-slip", 2, "Send every Nth rate limited response truncated instead of dropping it (0 drops all)")
+	rrlPrefixV4     = flag.Uint("rrl-prefix-v4", 24, "IPv4 prefix length unknown clients are rate limited by")
+	rrlPrefixV6     = flag.Uint("rrl-prefix-v6", 56, "IPv6 prefix length unknown clients are rate limited by")
+	anyTcpFull      = flag.Bool("any-tcp-full", false, "Answer ANY queries over TCP with all local records instead of a single RRset")
+	maxAnswers      = flag.Uint("max-answers", 0, "Maximum number of A/AAAA records in an answer (0 for no limit)")
+	ednsUdpSize     = flag.Uint("edns-udp-size", 1232, "EDNS UDP payload size advertised to clients and used for recursive queries")
+	ecsEnabled      = flag.Bool("ecs", false, "Add the client subnet (EDNS Client Subnet) to recursive queries")
+	ecsClientPolicy = flag.String("ecs-client-policy", ECS_POLICY_STRIP, "What to do with client subnets sent by clients: strip or honor")
+	ecsPrefixV4     = flag.Uint("ecs-prefix-v4", 24, "Maximum IPv4 source prefix length sent upstream")
+	ecsPrefixV6     = flag.Uint("ecs-prefix-v6", 56, "Maximum IPv6 source prefix length sent upstream")
+	adminTokens     = flag.String("admin-tokens", "", "File of bearer tokens for the reload listener, one \"name role token\" per line, role read or write")
+	adminTlsCert    = flag.String("admin-tls-cert", "", "Certificate file to serve the reload listener over TLS with")
+	adminTlsKey     = flag.String("admin-tls-key", "", "Key file of --admin-tls-cert")
+	adminClientCa   = flag.String("admin-client-ca", "", "CA file to verify reload listener client certificates with (requires --admin-tls-cert)")
+	adminWriters    = flag.String("admin-writers", "", "Client certificate common names allowed to make changes, comma-delimited (others can only read)")
+	auditLog        = flag.String("audit-log", "", "File to write the audit log of changes made through the reload listener to, as JSON (default the log)")
+	tsigKeys        = flag.String("tsig-key", "", "TSIG key(s) allowed to send dynamic updates, as [algorithm:]name:secret, comma-delimited (default algorithm hmac-sha256)")
+	kubernetesApi   = flag.String("kubernetes", "", "Kubernetes API server URL to build the answers from, or in-cluster to use the pod's service account")
+	clusterDomain   = flag.String("cluster-domain", "cluster.local", "Kubernetes cluster domain")
+	dockerSocket    = flag.String("docker", "", "Docker daemon socket to build the answers from the containers of, e.g. /var/run/docker.sock")
+	overrides       = flag.String("overrides", "", "Answers files layered over the other answers, comma-delimited, later ones taking precedence")
+
+	dynamicRecords            *DynamicRecords
+	generations               = &Generations{limit: 1, next: 1}
 	globalCache               *cache.Cache
 	clientSpecificCaches      map[string]*cache.Cache
 	clientSpecificCachesMutex sync.RWMutex
 	VERSION                   string
-	reloadChan                = make(chan chan error)
+	reloadChan                = make(chan chan reloadResult)
 	serial                    = uint32(1)
-	configGenerator           *ConfigGenerator
+	answerLayers              *AnswerLayers
+	rrl                       = newRateLimiter()
+	allowQueryAcl             []*net.IPNet
+	validator                 *Validator
+	signer                    *Signer
+	allowRecursionAcl         []*net.IPNet
+	tsigSecrets               map[string]string
+	tsigAlgorithms            map[string]string
+	adminAuth                 = &AdminAuth{audit: log.StandardLogger()}
 )
 
 func metadataDriven() bool {
 	return *metadataServer != ""
 }
 
+func kubernetesDriven() bool {
+	return *kubernetesApi != ""
+}
+
+func dockerDriven() bool {
+	return *dockerSocket != ""
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(queryCommand(os.Args[2:]))
+	}
+
 	parseFlags()
 
-	log.Infof("Starting rancher-dns %s", VERSION)
-	err := loadAnswers()
-	if err != nil {
-		log.Fatal("Cannot startup without a valid Answers file")
+	if *checkOnly {
+		os.Exit(checkAnswersFile(*answersFile))
 	}
 
 	if *showVersion {
@@ -70,16 +127,39 @@ func main() {
 		os.Exit(0)
 	}
 
-	if metadataDriven() {
-		configGenerator = &ConfigGenerator{}
-		err = configGenerator.Init(metadataServer)
-		if err != nil {
-			log.Fatalf("Cannot startup: failed to init config generator: %v", err)
-		}
+	log.Infof("Starting rancher-dns %s", VERSION)
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(*dynamicFile); err != nil {
+		log.Fatalf("Cannot startup: failed to load dynamic records: %v", err)
+	}
+	if generations, err = LoadGenerations(int(*generationCount), *generationsDir); err != nil {
+		log.Fatalf("Cannot startup: failed to load answers generations: %v", err)
+	}
+	if answerLayers, err = newAnswerLayers(); err != nil {
+		log.Fatalf("Cannot startup: %v", err)
+	}
+	if _, err = answerLayers.Reload(); err != nil {
+		log.Fatalf("Cannot startup without valid answers: %v", err)
+	}
+
+	if err = reloadPolicies(); err != nil {
+		log.Fatalf("Cannot startup: failed to load policy zones: %v", err)
+	}
+
+	if *adminClientCa != "" && *adminTlsCert == "" {
+		log.Fatal("Cannot startup: --admin-client-ca requires --admin-tls-cert")
+	}
+	if *adminTokens != "" && *adminTlsCert == "" && !loopbackListener(*listenReload) {
+		log.Fatalf("Cannot startup: --admin-tokens on %s requires --admin-tls-cert, tokens would be sent in the clear", *listenReload)
+	}
+	if adminAuth, err = NewAdminAuth(*adminTokens, *adminClientCa != "", splitTrim(*adminWriters, ","), *auditLog); err != nil {
+		log.Fatalf("Cannot startup: failed to set up the reload listener authentication: %v", err)
 	}
 
 	watchSignals()
 	watchHttp()
+	go expireDynamicRecords()
+	go sweepRateLimits()
 
 	seed := time.Now().UTC().UnixNano()
 	log.Debug("Set random seed to ", seed)
@@ -87,8 +167,25 @@ func main() {
 
 	udpServer := &dns.Server{Addr: *listen, Net: "udp"}
 	tcpServer := &dns.Server{Addr: *listen, Net: "tcp"}
+	if len(tsigSecrets) > 0 {
+		udpServer.TsigSecret = tsigSecrets
+		tcpServer.TsigSecret = tsigSecrets
+	}
 
 	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+	if *dnssecValidate {
+		anchors, err := LoadTrustAnchors(*trustAnchor)
+		if err != nil {
+			log.Fatalf("Cannot startup: failed to load trust anchors: %v", err)
+		}
+		validator = NewValidator(anchors)
+	}
+	if *dnssecKsk != "" || *dnssecZsk != "" {
+		signer, err = NewSigner(splitTrim(*dnssecKsk, ","), splitTrim(*dnssecZsk, ","))
+		if err != nil {
+			log.Fatalf("Cannot startup: failed to load DNSSEC keys: %v", err)
+		}
+	}
 	clientSpecificCaches = make(map[string]*cache.Cache)
 
 	dns.HandleFunc(".", route)
@@ -107,6 +204,17 @@ func parseFlags() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if *ecsClientPolicy != ECS_POLICY_STRIP && *ecsClientPolicy != ECS_POLICY_HONOR {
+		log.Fatalf("Invalid ecs-client-policy %s, must be %s or %s", *ecsClientPolicy, ECS_POLICY_STRIP, ECS_POLICY_HONOR)
+	}
+
+	parseAclFlags()
+
+	var err error
+	if tsigSecrets, tsigAlgorithms, err = parseTsigKeys(splitTrim(*tsigKeys, ",")); err != nil {
+		log.Fatal(err)
+	}
+
 	if *logFile != "" {
 		if output, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
 			log.Fatalf("Failed to log to file %s: %v", *logFile, err)
@@ -123,24 +231,66 @@ func parseFlags() {
 	}
 }
 
-func loadAnswersFromMeta(name string) {
-	newAnswers, err := configGenerator.GenerateAnswers()
-	if err != nil {
-		log.Errorf("Failed to generate answers: %v", err)
-		return
+func parseAclFlags() {
+	if *allowQuery != "" {
+		allowQueryAcl = parseAclFlag("allow-query", *allowQuery)
 	}
-	ConvertPtrIps(&newAnswers)
+	if *allowRecursion != "" {
+		allowRecursionAcl = parseAclFlag("allow-recursion", *allowRecursion)
+	}
+}
 
-	if reflect.DeepEqual(newAnswers, answers) {
-		log.Debug("No changes in dns data")
-		return
+// Result of a reload: what changed, or why it failed
+type reloadResult struct {
+	diff AnswersDiff
+	err  error
+}
+
+// The answer sources, lowest precedence first: the sources the answers are built from (or the
+// answers file if there are none), then the overrides
+func newAnswerLayers() (*AnswerLayers, error) {
+	var sources []AnswerSource
+	if metadataDriven() {
+		configGenerator := &ConfigGenerator{}
+		if err := configGenerator.Init(metadataServer); err != nil {
+			return nil, fmt.Errorf("failed to init config generator: %v", err)
+		}
+		sources = append(sources, configGenerator)
 	}
 
-	log.Infof("Reloading answers")
-	clearClientSpecificCaches()
-	answers = newAnswers
-	// write to file (debugging purposes)
-	b, err := json.Marshal(answers)
+	if kubernetesDriven() {
+		client, err := NewKubernetesClient(*kubernetesApi)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init the Kubernetes client: %v", err)
+		}
+		kubernetesSource := NewKubernetesSource(client, *clusterDomain)
+		if err = kubernetesSource.Sync(); err != nil {
+			return nil, err
+		}
+		sources = append(sources, kubernetesSource)
+	}
+
+	if dockerDriven() {
+		dockerSource := NewDockerSource(NewDockerClient(*dockerSocket))
+		if err := dockerSource.Sync(); err != nil {
+			return nil, err
+		}
+		sources = append(sources, dockerSource)
+	}
+
+	if len(sources) == 0 {
+		sources = append(sources, NewFileSource(*answersFile))
+	}
+	for _, path := range splitTrim(*overrides, ",") {
+		sources = append(sources, NewFileSource(path))
+	}
+	return NewAnswerLayers(sources...), nil
+}
+
+// Writes the answers being served to the answers file, when it isn't a source (for debugging
+// purposes)
+func writeAnswersFile() {
+	b, err := json.Marshal(snapshot().Answers)
 	if err != nil {
 		log.Errorf("Failed to marshall answers: %v", err)
 	}
@@ -148,70 +298,144 @@ func loadAnswersFromMeta(name string) {
 	if err != nil {
 		log.Errorf("Failed to write answers to file: %v", err)
 	}
-	log.Infof("Reloaded answers")
 }
 
-func loadAnswers() (err error) {
-	log.Debug("Loading answers")
-	temp, err := ParseAnswers(*answersFile)
-	if err == nil {
-		clearClientSpecificCaches()
-		answers = temp
-		log.Infof("Loaded answers")
-	} else {
-		log.Errorf("Failed to load answers: %v", err)
-	}
+// Serves base, with the dynamic records on top. Returns what changed compared to the previous base.
+func serveAnswers(base Answers) AnswersDiff {
+	previous := publish(base)
+	clearClientSpecificCaches()
+	return DiffAnswers(previous.Base, base)
+}
 
-	return err
+// Serves the current answers again after the dynamic records changed
+func mergeDynamicRecords() {
+	republish()
+	clearClientSpecificCaches()
+}
+
+func reloadPolicies() error {
+	newPolicies, err := loadPolicies()
+	if err != nil {
+		log.Errorf("Failed to load policy zones: %v", err)
+		return err
+	}
+	setPolicies(newPolicies)
+	// Cached recursive answers were checked against the old policies
+	clearGlobalCache()
+	return nil
 }
 
 func watchSignals() {
-	if metadataDriven() {
-		go configGenerator.metaFetcher.OnChange(5, loadAnswersFromMeta)
-	} else {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGHUP)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for _ = range c {
+			log.Info("Received HUP signal")
+			reloadChan <- nil
+		}
+	}()
 
-		go func() {
-			for _ = range c {
-				log.Info("Received HUP signal")
-				reloadChan <- nil
+	go func() {
+		for resp := range reloadChan {
+			diff, err := answerLayers.Reload()
+			if err == nil {
+				err = reloadPolicies()
 			}
-		}()
-
-		go func() {
-			for resp := range reloadChan {
-				err := loadAnswers()
-				if resp != nil {
-					resp <- err
-				}
+			if resp != nil {
+				resp <- reloadResult{diff, err}
 			}
-		}()
-	}
+		}
+	}()
 
+	answerLayers.Watch()
+	watchPolicies()
 }
 
 func watchHttp() {
-	reloadRouter := mux.NewRouter()
-	reloadRouter.HandleFunc("/v1/reload", httpReload).Methods("POST")
+	server := &http.Server{Addr: *listenReload, Handler: newReloadRouter()}
+	if *adminTlsCert != "" {
+		config, err := adminTLSConfig(*adminTlsCert, *adminTlsKey, *adminClientCa)
+		if err != nil {
+			log.Fatalf("Cannot startup: failed to load the reload listener certificate: %v", err)
+		}
+		server.TLSConfig = config
+		log.Info("Listening for Reload on ", *listenReload, " (TLS)")
+		go server.ListenAndServeTLS("", "")
+		return
+	}
+
 	log.Info("Listening for Reload on ", *listenReload)
-	go http.ListenAndServe(*listenReload, reloadRouter)
+	go server.ListenAndServe()
+}
+
+func newReloadRouter() *mux.Router {
+	reloadRouter := mux.NewRouter()
+	reloadRouter.HandleFunc("/v1/reload", adminAuth.Require(ROLE_WRITE, httpReload)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/generations", adminAuth.Require(ROLE_READ, httpListGenerations)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/generations/{from}/diff/{to}", adminAuth.Require(ROLE_READ, httpDiffGenerations)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/generations/{number}/pin", adminAuth.Require(ROLE_WRITE, httpServeGeneration)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/generations/{number}/rollback", adminAuth.Require(ROLE_WRITE, httpServeGeneration)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/generations/pin", adminAuth.Require(ROLE_WRITE, httpUnpinGeneration)).Methods("DELETE")
+	reloadRouter.HandleFunc("/v1/sources", adminAuth.Require(ROLE_READ, httpListSources)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/sources/records", adminAuth.Require(ROLE_READ, httpListRecordOrigins)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/explain", adminAuth.Require(ROLE_READ, httpExplain)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/records", adminAuth.Require(ROLE_READ, httpListRecords)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/records", adminAuth.Require(ROLE_WRITE, httpPutRecord)).Methods("POST")
+	reloadRouter.HandleFunc("/v1/records/{client}/{type}/{name}", adminAuth.Require(ROLE_READ, httpGetRecord)).Methods("GET")
+	reloadRouter.HandleFunc("/v1/records/{client}/{type}/{name}", adminAuth.Require(ROLE_WRITE, httpPutRecord)).Methods("PUT")
+	reloadRouter.HandleFunc("/v1/records/{client}/{type}/{name}", adminAuth.Require(ROLE_WRITE, httpDeleteRecord)).Methods("DELETE")
+	return reloadRouter
 }
 
 func httpReload(w http.ResponseWriter, req *http.Request) {
 	log.Debugf("Received HTTP reload request")
-	respChan := make(chan error)
+	respChan := make(chan reloadResult)
 	reloadChan <- respChan
-	err := <-respChan
+	result := <-respChan
 
-	if err == nil {
-		io.WriteString(w, "OK")
+	if result.err == nil {
+		writeJSON(w, http.StatusOK, reloadResponse{Status: "OK", Changes: result.diff})
 	} else {
 		w.WriteHeader(500)
-		io.WriteString(w, err.Error())
+		io.WriteString(w, result.err.Error())
 	}
 }
 
+type reloadResponse struct {
+	Status  string      `json:"status"`
+	Changes AnswersDiff `json:"changes"`
+}
+
+func httpExplain(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	name := params.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := params.Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, "unknown type "+t, http.StatusBadRequest)
+			return
+		}
+	}
+	// The client is an address or a client UUID. Without an address, the ACLs are those of the caller.
+	client, section := params.Get("client"), ""
+	if isUUID(client) {
+		client, section = "", client
+	}
+	if client == "" {
+		client, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+
+	msg, trace := snapshot().Explain(client, section, name, qtype)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewExplanation(msg, trace))
+}
+
 func isUUID(uuid string) bool {
 	r := regexp.MustCompile("^[a-fA-F0-9]{8}-[a-fA-F0-9]{3}$")
 	return r.MatchString(uuid)
@@ -257,6 +481,14 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 
 	clientIp, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 
+	if req.Opcode == dns.OpcodeUpdate {
+		handleUpdate(w, req)
+		return
+	}
+
+	// The same answers throughout the request, whatever reloads happen meanwhile
+	answers := snapshot()
+
 	// One question at a time please
 	if len(req.Question) != 1 {
 		dns.HandleFailed(w, req)
@@ -284,14 +516,12 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	// ANY queries are bad, mmmkay...
-	if question.Qtype == dns.TypeANY {
+	// Only EDNS version 0 is defined
+	if badEdnsVersion(req) {
 		m.Authoritative = false
-		m.RecursionDesired = false
-		m.RecursionAvailable = false
-		m.Rcode = dns.RcodeNotImplemented
-		w.WriteMsg(m)
-		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID}).Warn("Rejected ANY query")
+		m.Rcode = dns.RcodeBadVers
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID}).Warn("Rejected unknown EDNS version")
 		return
 	}
 
@@ -302,84 +532,86 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 
 	log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID, "proto": proto}).Debug("Request")
 
-	if msg, exp := clientSpecificCacheHit(clientUUID, req); msg != nil {
-		update(msg, exp)
-		Respond(w, req, msg)
-		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent client-specific cached response")
+	if rateLimited(w, req, &answers.Answers, clientIp, fqdn) {
 		return
 	}
 
-	// A records may return CNAME answer(s) plus A answer(s)
-	if question.Qtype == dns.TypeA {
-		// ipv4
-		found, ok := answers.Addresses(clientUUID, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
-		if ok && len(found) > 0 {
-			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered locally")
-			m.Answer = found
-			addToClientSpecificCache(clientUUID, req, m)
-			Respond(w, req, m)
-			return
-		}
-	} else if question.Qtype == dns.TypeAAAA {
-		// ipv6
-		_, ok := answers.Addresses(clientUUID, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
-		if ok {
-			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Answered locally, no error and empty answer")
-			m.Authoritative = true
-			m.Rcode = dns.RcodeSuccess
-			addToClientSpecificCache(clientUUID, req, m)
-			Respond(w, req, m)
-			return
-		}
-	} else {
-		// Specific request for another kind of record
-		keys := []string{clientUUID, DEFAULT_KEY}
-		for _, key := range keys {
-			// Client-specific answers
-			found, ok := answers.Matching(question.Qtype, key, formatFqdn(clientUUID, fqdn), fqdn)
-			if ok {
-				log.WithFields(log.Fields{"client": key, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered from config for ", key)
-				m.Answer = found
-				addToClientSpecificCache(clientUUID, req, m)
-				Respond(w, req, m)
-				return
-			}
+	d := answers.decide(&query{req: req, clientIp: clientIp, clientUUID: clientUUID, fqdn: fqdn, tcp: isTcp(w)}, m)
+	fields := log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}
+	switch d.action {
+	case DECISION_REFUSED:
+		Respond(w, req, m)
+		log.WithFields(fields).Debug("Refused query")
+		return
+	case DECISION_ANSWER:
+		Respond(w, req, m)
+		log.WithFields(fields).Debug(d.reason)
+		return
+	case DECISION_CLIENT_CACHE:
+		update(d.msg, d.exp)
+		Respond(w, req, d.msg)
+		log.WithFields(fields).Debug("Sent client-specific cached response")
+		return
+	case DECISION_LOCAL:
+		if d.deny && signing(req) {
+			signer.Deny(&answers.Answers, clientUUID, m, fqdn, answers.Types(clientUUID, formatFqdn(clientUUID, fqdn)))
 		}
-
-		log.Debug("No match found in config")
-	}
-
-	if msg, exp := globalCacheHit(req); msg != nil {
-		update(msg, exp)
-		Respond(w, req, msg)
-		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent globally cached response")
+		addToClientSpecificCache(clientUUID, req, m)
+		Respond(w, req, m)
+		log.WithFields(fields).WithField("answers", len(m.Answer)).Debug("Answered locally")
 		return
-	}
-
-	// If we are authoritative for a suffix the label has, there's no point trying the recursive DNS
-	authoritativeFor := answers.AuthoritativeSuffixes()
-	for _, suffix := range authoritativeFor {
-		if strings.HasSuffix(fqdn, suffix) {
-			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debugf("Not answered locally, but I am authoritative for %s", suffix)
-			m.Authoritative = true
-			m.RecursionAvailable = false
-			m.Rcode = dns.RcodeNameError
-			me := strings.TrimLeft(suffix, ".")
-			hdr := dns.RR_Header{Name: me, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
-			serial++
-			record := &dns.SOA{Hdr: hdr, Ns: me, Mbox: me, Serial: serial, Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
-			m.Ns = append(m.Ns, record)
-			Respond(w, req, m)
-			return
+	case DECISION_RECURSION_REFUSED:
+		Respond(w, req, m)
+		log.WithFields(fields).Debug("Refused recursion")
+		return
+	case DECISION_POLICY:
+		applyPolicy(w, req, m, d.rule, &answers.Answers, clientUUID)
+		return
+	case DECISION_GLOBAL_CACHE:
+		update(d.msg, d.exp)
+		echoClientSubnet(req, d.msg, stripClientSubnet(d.msg))
+		Respond(w, req, d.msg)
+		log.WithFields(fields).Debug("Sent globally cached response")
+		return
+	case DECISION_NXDOMAIN:
+		if signing(req) {
+			// Black lies: NODATA with an NSEC record for just this name instead of NXDOMAIN
+			signer.Deny(&answers.Answers, clientUUID, m, fqdn, answers.Types(clientUUID, formatFqdn(clientUUID, fqdn)))
 		}
+		Respond(w, req, m)
+		log.WithFields(fields).Debug(d.reason)
+		return
 	}
 
 	// Phone a friend - Forward original query
-	msg, err := ResolveTryAll(req, answers.Recursers(clientUUID))
+	recursers := answers.Recursers(clientUUID)
+	msg, err := ResolveTryAll(upstreamRequest(req, d.subnet), recursers)
 	if err == nil && msg != nil {
 		msg.Compress = true
 		msg.Id = req.Id
 
+		if validating(req) {
+			switch validator.Validate(msg, recursers) {
+			case VALIDATION_BOGUS:
+				log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Warn("Bogus recursive response")
+				m.Rcode = dns.RcodeServerFailure
+				m.Authoritative = false
+				Respond(w, req, m)
+				return
+			case VALIDATION_SECURE:
+				msg.AuthenticatedData = true
+			default:
+				msg.AuthenticatedData = false
+			}
+		}
+
+		// Response policy zones, by the addresses in the answer
+		if !d.passthru {
+			if rule := d.policies.Response(msg); rule != nil && applyPolicy(w, req, m, rule, &answers.Answers, clientUUID) {
+				return
+			}
+		}
+
 		// We don't support AAAA, but an NXDOMAIN from the recursive resolver
 		// doesn't necessarily mean there are never any records for that domain,
 		// so rewrite the response code to NOERROR.
@@ -388,14 +620,22 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 			msg.Rcode = dns.RcodeSuccess
 		}
 
-		addToGlobalCache(req, msg)
-		if msg, exp := globalCacheHit(req); msg != nil {
+		if d.passthru {
+			echoClientSubnet(req, msg, stripClientSubnet(msg))
+			Respond(w, req, msg)
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response, passed through the policies")
+			return
+		}
+		addToGlobalCache(req, msg, d.subnet)
+		if msg, exp := globalCacheHit(req, d.subnet); msg != nil {
 			update(msg, exp)
+			echoClientSubnet(req, msg, stripClientSubnet(msg))
 			Respond(w, req, msg)
 			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
 			return
 		}
 		// For very small TTLs, globalCacheHit above could fail despite adding - respond with the original msg.
+		echoClientSubnet(req, msg, stripClientSubnet(msg))
 		Respond(w, req, msg)
 		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
 		return
@@ -406,6 +646,13 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	dns.HandleFailed(w, req)
 }
 
+// SOA record for negative answers in a zone we are authoritative for. The serial only changes
+// when new answers are published, so signatures over it stay valid in between.
+func authoritativeSOA(zone string) *dns.SOA {
+	hdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+	return &dns.SOA{Hdr: hdr, Ns: zone, Mbox: zone, Serial: atomic.LoadUint32(&serial), Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
+}
+
 func isTcp(w dns.ResponseWriter) bool {
 	_, ok := w.RemoteAddr().(*net.TCPAddr)
 	return ok
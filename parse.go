@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -20,28 +21,70 @@ func ParseAnswers(path string) (out Answers, err error) {
 		return nil, err
 	}
 
-	if yaml.Unmarshal(data, &out); err != nil {
+	problems := CheckAnswers(data)
+	for _, problem := range problems {
+		log.Warnf("%s: %v", path, problem)
+	}
+	if *strictAnswers && len(problems) > 0 {
+		return nil, fmt.Errorf("%d problem(s) found in %s", len(problems), path)
+	}
+
+	return parseAnswers(data)
+}
+
+func parseAnswers(data []byte) (out Answers, err error) {
+	out = make(Answers)
+	if err = yaml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	if err = validateAcls(out); err != nil {
 		return nil, err
 	}
 
-	ConvertPtrIps(&out)
+	out = ConvertPtrIps(out)
+	if err := MergeHosts(&out); err != nil {
+		return nil, err
+	}
+	if err := MergeZones(&out); err != nil {
+		return nil, err
+	}
 	return out, nil
 }
 
-func ConvertPtrIps(answers *Answers) {
-	// Convert PTR keys that are IP addresses into "4.3.2.1.in-addr.arpa." form.
-	for _, client := range *answers {
+// Returns answers with PTR keys that are IP addresses converted into "4.3.2.1.in-addr.arpa." form.
+// The answers passed in are left alone: sections with PTR records to convert get new maps.
+func ConvertPtrIps(answers Answers) Answers {
+	converted := make(Answers, len(answers))
+	for key, client := range answers {
+		converted[key] = client
+		if !hasIpPtrKeys(client.Ptr) {
+			continue
+		}
+
+		ptr := make(map[string]RecordPtr, len(client.Ptr))
 		for origKey, val := range client.Ptr {
-			if !strings.HasSuffix(origKey, "in-addr.arpa.") {
-				newKey := "in-addr.arpa."
-				for _, i := range strings.Split(origKey, ".") {
-					newKey = i + "." + newKey
-				}
-
-				delete(client.Ptr, origKey)
-				client.Ptr[newKey] = val
-				log.Debug("Transformed PTR for ", origKey, " to ", newKey, " => ", val.Answer)
+			if strings.HasSuffix(origKey, ".arpa.") {
+				ptr[origKey] = val
+				continue
+			}
+			newKey := "in-addr.arpa."
+			for _, i := range strings.Split(origKey, ".") {
+				newKey = i + "." + newKey
 			}
+			ptr[newKey] = val
+			log.Debug("Transformed PTR for ", origKey, " to ", newKey, " => ", val.Answer)
+		}
+		client.Ptr = ptr
+		converted[key] = client
+	}
+	return converted
+}
+
+func hasIpPtrKeys(ptr map[string]RecordPtr) bool {
+	for key := range ptr {
+		if !strings.HasSuffix(key, ".arpa.") {
+			return true
 		}
 	}
+	return false
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// rancher-dns query [options] name [type]: shows the answer a client would get from an answers
+// file and how it was found, without listening or sending any queries.
+func queryCommand(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	client := fs.String("client", "127.0.0.1", "IP address of the client making the query")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s query [options] name [type]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	qtype := dns.TypeA
+	if fs.NArg() == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(fs.Arg(1))]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown type %s\n", fs.Arg(1))
+			return 2
+		}
+		qtype = t
+	}
+
+	log.SetLevel(log.WarnLevel)
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+	parseAclFlags()
+
+	simulated, err := ParseAnswers(*answersFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load answers: %v\n", err)
+		return 1
+	}
+	dynamic, err := LoadDynamicRecords(*dynamicFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load dynamic records: %v\n", err)
+		return 1
+	}
+	simulated = dynamic.Merge(simulated)
+	if *rpzAxfr != "" {
+		fmt.Fprintln(os.Stderr, "Policy zone transfers (--rpz-axfr) are not simulated")
+		*rpzAxfr = ""
+	}
+	loaded, err := loadPolicies()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load policy zones: %v\n", err)
+		return 1
+	}
+	setPolicies(loaded)
+
+	msg, trace := unindexed(simulated).Explain(*client, "", fs.Arg(0), qtype)
+	printExplanation(os.Stdout, msg, trace)
+	return 0
+}
+
+// Prints a response like dig does, preceded by the trace
+func printExplanation(w io.Writer, msg *dns.Msg, trace *Trace) {
+	fmt.Fprintf(w, "; <<>> rancher-dns query <<>> %s %s (client %s)\n", trace.Question, trace.Type, trace.Client)
+	fmt.Fprintln(w, ";; TRACE:")
+	for _, step := range trace.Steps {
+		fmt.Fprintf(w, ";; %-13s %s\n", step.Step, step.Detail)
+	}
+	if len(trace.Upstream) > 0 {
+		fmt.Fprintf(w, ";; The answer depends on the recursers for: %s\n", strings.Join(trace.Upstream, ", "))
+	}
+	fmt.Fprintln(w)
+
+	if msg == nil {
+		if trace.Recurse {
+			fmt.Fprintf(w, ";; No local answer, the query would be sent to: %s\n", strings.Join(trace.Recursers, ", "))
+		} else {
+			fmt.Fprintln(w, ";; No local answer, the response would come from a response policy")
+		}
+		return
+	}
+	fmt.Fprintln(w, msg.String())
+}
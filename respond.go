@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 )
@@ -11,8 +13,19 @@ func Respond(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg) {
 	tcp := isTcp(w)
 
 	if o := req.IsEdns0(); o != nil {
+		// Never more than we advertise ourselves, to stay clear of fragmentation
 		bufsize = o.UDPSize()
+		if bufsize > ednsBufferSize() {
+			bufsize = ednsBufferSize()
+		}
 	}
+	setResponseEdns(req, m)
+	// Capped before signing, as a signature covers the whole RRset
+	capAddresses(m, int(*maxAnswers))
+	if signing(req) {
+		signer.Sign(m)
+	}
+	setResponseDnssec(req, m)
 
 	if tcp {
 		bufsize = dns.MaxMsgSize - 1
@@ -20,20 +33,22 @@ func Respond(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg) {
 		bufsize = 512
 	}
 
-	// Make sure the payload fits the buffer size. If the message is too large we strip the Extra section.
-	// If it's still too large we return a truncated message for UDP queries and ServerFailure for TCP queries.
+	// Make sure the payload fits the buffer size. If the message is too large we strip the Extra section,
+	// then keep as many whole RRsets as fit. UDP responses that lost answers are marked truncated.
 	if m.Len() > int(bufsize) {
 		fqdn := dns.Fqdn(req.Question[0].Name)
-		log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response too big, dropping Authority and Extra")
+		log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response too big, dropping Extra")
+		opt := removeEdns0(m)
 		m.Extra = nil
+		if opt != nil {
+			m.Extra = append(m.Extra, opt)
+		}
 		if m.Len() > int(bufsize) {
+			truncated := fitAnswer(m, int(bufsize))
 			if tcp {
-				log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return ServerFailure")
-				m = new(dns.Msg)
-				m.SetRcode(req, dns.RcodeServerFailure)
+				log.WithFields(log.Fields{"fqdn": fqdn, "answers": len(m.Answer), "dropped": truncated}).Debug("Response still too big, capped TCP answer")
 			} else {
-				log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return truncated message")
-				m.Answer = nil
+				log.WithFields(log.Fields{"fqdn": fqdn, "answers": len(m.Answer), "dropped": truncated}).Debug("Response still too big, return truncated message")
 				m.Truncated = true
 			}
 		}
@@ -43,5 +58,81 @@ func Respond(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg) {
 	if err != nil {
 		log.Warn("Failed to return reply: ", err, m.Len())
 	}
+}
+
+// Keeps at most max A and AAAA records in the answer section, leaving CNAMEs and
+// other records alone. A max of 0 means no limit. Signed answers are left whole: dropping a
+// record from an RRset would break its signature.
+func capAddresses(m *dns.Msg, max int) {
+	if max <= 0 {
+		return
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return
+		}
+	}
+	count := 0
+	answer := m.Answer[:0]
+	for _, rr := range m.Answer {
+		t := rr.Header().Rrtype
+		if t == dns.TypeA || t == dns.TypeAAAA {
+			if count >= max {
+				continue
+			}
+			count++
+		}
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+}
 
+// Splits an answer section into units that must be kept or dropped together: each RRset, with
+// the CNAMEs leading up to it, so that a chain is never returned without its target, and the
+// signatures that follow it.
+func answerUnits(answer []dns.RR) [][]dns.RR {
+	var units [][]dns.RR
+	var current []dns.RR
+	for i, rr := range answer {
+		current = append(current, rr)
+		if i+1 < len(answer) {
+			next := answer[i+1].Header()
+			hdr := rr.Header()
+			// Signatures count as the type they cover
+			covered := hdr.Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				covered = sig.TypeCovered
+			}
+			if covered == dns.TypeCNAME || (next.Name == hdr.Name && next.Rrtype == hdr.Rrtype && next.Class == hdr.Class) {
+				continue
+			}
+			if sig, ok := answer[i+1].(*dns.RRSIG); ok && sig.TypeCovered == covered && strings.EqualFold(next.Name, hdr.Name) {
+				continue
+			}
+		}
+		units = append(units, current)
+		current = nil
+	}
+	return units
+}
+
+// Drops answer units (and then the authority section) from m until it fits in size bytes.
+// Returns the number of answer records that were dropped.
+func fitAnswer(m *dns.Msg, size int) int {
+	units := answerUnits(m.Answer)
+	total := len(m.Answer)
+
+	m.Answer = nil
+	for _, unit := range units {
+		m.Answer = append(m.Answer, unit...)
+		if m.Len() > size {
+			m.Answer = m.Answer[:len(m.Answer)-len(unit)]
+			break
+		}
+	}
+
+	if m.Len() > size {
+		m.Ns = nil
+	}
+	return total - len(m.Answer)
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFitAnswerKeepsCnameChains(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Answer = append(m.Answer, testRR(t, "www.example.com. 60 IN CNAME web.example.com."))
+	for i := 0; i < 100; i++ {
+		m.Answer = append(m.Answer, testRR(t, fmt.Sprintf("web.example.com. 60 IN A 10.0.0.%d", i)))
+	}
+
+	units := answerUnits(m.Answer)
+	if len(units) != 1 || len(units[0]) != 101 {
+		t.Fatalf("Expected the CNAME and its A records as one unit, got %d units", len(units))
+	}
+
+	dropped := fitAnswer(m, 512)
+	if dropped != 101 || len(m.Answer) != 0 {
+		t.Fatalf("Expected the whole chain to be dropped, dropped %d, kept %v", dropped, m.Answer)
+	}
+}
+
+func TestFitAnswerKeepsWholeRRsets(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeTXT)
+	m.Answer = append(m.Answer, testRR(t, "a.example.com. 60 IN A 10.0.0.1"))
+	for i := 0; i < 50; i++ {
+		m.Answer = append(m.Answer, testRR(t, fmt.Sprintf("b.example.com. 60 IN A 10.0.1.%d", i)))
+	}
+
+	fitAnswer(m, 512)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Name != "a.example.com." {
+		t.Fatalf("Expected only the first RRset to fit [%v]", m.Answer)
+	}
+}
+
+func TestCapAddresses(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = append(m.Answer, testRR(t, "www.example.com. 60 IN CNAME web.example.com."))
+	for i := 0; i < 10; i++ {
+		m.Answer = append(m.Answer, testRR(t, fmt.Sprintf("web.example.com. 60 IN A 10.0.0.%d", i)))
+	}
+
+	capAddresses(m, 3)
+	if len(m.Answer) != 4 || m.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("Expected the CNAME and 3 A records [%v]", m.Answer)
+	}
+
+	capAddresses(m, 0)
+	if len(m.Answer) != 4 {
+		t.Fatalf("A limit of 0 should not drop anything [%v]", m.Answer)
+	}
+}
+
+func TestSignedAnswers(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = append(m.Answer, testRR(t, "www.example.com. 60 IN CNAME web.example.com."))
+	m.Answer = append(m.Answer, testRR(t, "www.example.com. 60 IN RRSIG CNAME 13 3 60 20300101000000 20200101000000 1 example.com. AAAA"))
+	for i := 0; i < 10; i++ {
+		m.Answer = append(m.Answer, testRR(t, fmt.Sprintf("web.example.com. 60 IN A 10.0.0.%d", i)))
+	}
+	m.Answer = append(m.Answer, testRR(t, "web.example.com. 60 IN RRSIG A 13 3 60 20300101000000 20200101000000 1 example.com. AAAA"))
+	m.Answer = append(m.Answer, testRR(t, "mail.example.com. 60 IN A 10.0.1.1"))
+
+	capAddresses(m, 3)
+	if len(m.Answer) != 14 {
+		t.Fatalf("Expected a signed answer to be left whole [%v]", m.Answer)
+	}
+
+	for i := 0; i < 20; i++ {
+		shuffle(&m.Answer)
+		if m.Answer[1].Header().Rrtype != dns.TypeRRSIG || m.Answer[12].Header().Rrtype != dns.TypeRRSIG || m.Answer[13].Header().Name != "mail.example.com." {
+			t.Fatalf("Expected only the A records of an RRset to move [%v]", m.Answer)
+		}
+	}
+
+	units := answerUnits(m.Answer)
+	if len(units) != 2 || len(units[0]) != 13 {
+		t.Fatalf("Expected the signed chain as one unit, got %v", units)
+	}
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", s, err)
+	}
+	return rr
+}
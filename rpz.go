@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Response Policy Zone (RPZ) actions
+const (
+	RPZ_NXDOMAIN = iota
+	RPZ_NODATA
+	RPZ_PASSTHRU
+	RPZ_DROP
+	RPZ_DATA
+)
+
+var rpzActionNames = map[int]string{
+	RPZ_NXDOMAIN: "NXDOMAIN",
+	RPZ_NODATA:   "NODATA",
+	RPZ_PASSTHRU: "PASSTHRU",
+	RPZ_DROP:     "DROP",
+	RPZ_DATA:     "local data",
+}
+
+// Special owner name labels for IP triggers
+const (
+	RPZ_IP        = "rpz-ip"
+	RPZ_CLIENT_IP = "rpz-client-ip"
+)
+
+type rpzRule struct {
+	action  int
+	data    []dns.RR // local data for RPZ_DATA, owner names are replaced by the query name
+	trigger string
+	zone    string
+}
+
+type rpzIpRule struct {
+	network *net.IPNet
+	rule    *rpzRule
+}
+
+type rpzZone struct {
+	name        string
+	qnames      map[string]*rpzRule
+	wildcards   map[string]*rpzRule
+	clientIps   []rpzIpRule
+	responseIps []rpzIpRule
+}
+
+// Policy zones, in order of precedence
+type Policies []*rpzZone
+
+// The policy zones in use, replaced as a whole by reloads while queries read them
+var activePolicies atomic.Value
+
+func currentPolicies() Policies {
+	policies, _ := activePolicies.Load().(Policies)
+	return policies
+}
+
+func setPolicies(policies Policies) {
+	activePolicies.Store(policies)
+}
+
+func newRpzZone(name string) *rpzZone {
+	return &rpzZone{
+		name:      strings.ToLower(dns.Fqdn(name)),
+		qnames:    make(map[string]*rpzRule),
+		wildcards: make(map[string]*rpzRule),
+	}
+}
+
+// Loads a policy zone from a zone file. The zone's origin is taken from its SOA record.
+func LoadPolicyFile(path string) (*rpzZone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	for t := range dns.ParseZone(f, "", path) {
+		if t.Error != nil {
+			return nil, t.Error
+		}
+		rrs = append(rrs, t.RR)
+	}
+	return buildRpzZone(rrs, path)
+}
+
+// Loads a policy zone by AXFR, from a "zone@server" spec
+func LoadPolicyAxfr(spec string) (*rpzZone, error) {
+	parts := strings.SplitN(spec, "@", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid policy zone transfer %s, expected zone@server", spec)
+	}
+	server := parts[1]
+	if !strings.Contains(server, ":") {
+		server = server + ":53"
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(parts[0]))
+	env, err := new(dns.Transfer).In(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return buildRpzZone(rrs, spec)
+}
+
+func buildRpzZone(rrs []dns.RR, source string) (*rpzZone, error) {
+	var zone *rpzZone
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone = newRpzZone(soa.Hdr.Name)
+			break
+		}
+	}
+	if zone == nil {
+		return nil, fmt.Errorf("Policy zone %s has no SOA record", source)
+	}
+
+	rules := make(map[string]*rpzRule)
+	var owners []string
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		owner := strings.ToLower(hdr.Name)
+		if owner == zone.name || !dns.IsSubDomain(zone.name, owner) {
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, "."+zone.name)
+
+		rule, ok := rules[trigger]
+		if !ok {
+			rule = &rpzRule{action: RPZ_DATA, trigger: trigger, zone: zone.name}
+			rules[trigger] = rule
+			owners = append(owners, trigger)
+		}
+
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				rule.action = RPZ_NXDOMAIN
+				continue
+			case "*.":
+				rule.action = RPZ_NODATA
+				continue
+			case "rpz-passthru.":
+				rule.action = RPZ_PASSTHRU
+				continue
+			case "rpz-drop.":
+				rule.action = RPZ_DROP
+				continue
+			}
+		}
+		rule.data = append(rule.data, rr)
+	}
+
+	for _, trigger := range owners {
+		rule := rules[trigger]
+		labels := dns.SplitDomainName(trigger)
+		last := labels[len(labels)-1]
+		switch {
+		case last == RPZ_IP || last == RPZ_CLIENT_IP:
+			network, err := rpzNetwork(labels[:len(labels)-1])
+			if err != nil {
+				log.Warnf("Ignoring policy %s in %s: %v", trigger, source, err)
+				continue
+			}
+			if last == RPZ_IP {
+				zone.responseIps = append(zone.responseIps, rpzIpRule{network, rule})
+			} else {
+				zone.clientIps = append(zone.clientIps, rpzIpRule{network, rule})
+			}
+		case labels[0] == "*":
+			zone.wildcards[strings.TrimPrefix(trigger, "*.")+"."] = rule
+		default:
+			zone.qnames[trigger+"."] = rule
+		}
+	}
+
+	log.Infof("Loaded policy zone %s from %s: %d names, %d wildcards, %d client IPs, %d response IPs",
+		zone.name, source, len(zone.qnames), len(zone.wildcards), len(zone.clientIps), len(zone.responseIps))
+	return zone, nil
+}
+
+// Parses the labels of an IP trigger: prefix length followed by the address in reverse order,
+// with "zz" standing for a run of zero words in IPv6 addresses.
+func rpzNetwork(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("Invalid IP trigger")
+	}
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, err
+	}
+
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	var cidr string
+	if len(parts) == 4 && !strings.Contains(strings.Join(parts, ""), "zz") {
+		cidr = strings.Join(parts, ".")
+	} else {
+		cidr = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(cidr, ":") {
+			cidr = ":" + cidr
+		}
+		if strings.HasSuffix(cidr, ":") {
+			cidr = cidr + ":"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr + "/" + strconv.Itoa(prefix))
+	return network, err
+}
+
+func matchIpRules(rules []rpzIpRule, ip net.IP) *rpzRule {
+	var found *rpzIpRule
+	for i, r := range rules {
+		if !r.network.Contains(ip) {
+			continue
+		}
+		ones, _ := r.network.Mask.Size()
+		if found != nil {
+			best, _ := found.network.Mask.Size()
+			if best >= ones {
+				continue
+			}
+		}
+		found = &rules[i]
+	}
+	if found == nil {
+		return nil
+	}
+	return found.rule
+}
+
+func (zone *rpzZone) matchQname(fqdn string) *rpzRule {
+	if rule, ok := zone.qnames[fqdn]; ok {
+		return rule
+	}
+	// Longest matching wildcard
+	labels := dns.SplitDomainName(fqdn)
+	for i := 1; i < len(labels); i++ {
+		if rule, ok := zone.wildcards[strings.Join(labels[i:], ".")+"."]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// The policy for a query, by client IP and then by query name
+func (policies Policies) Query(fqdn string, clientIp string) *rpzRule {
+	ip := net.ParseIP(clientIp)
+	for _, zone := range policies {
+		if ip != nil {
+			if rule := matchIpRules(zone.clientIps, ip); rule != nil {
+				return rule
+			}
+		}
+		if rule := zone.matchQname(fqdn); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// The policy for a recursive response, by the addresses in its answer
+func (policies Policies) Response(msg *dns.Msg) *rpzRule {
+	for _, zone := range policies {
+		if len(zone.responseIps) == 0 {
+			continue
+		}
+		for _, rr := range msg.Answer {
+			var ip net.IP
+			switch t := rr.(type) {
+			case *dns.A:
+				ip = t.A
+			case *dns.AAAA:
+				ip = t.AAAA
+			default:
+				continue
+			}
+			if rule := matchIpRules(zone.responseIps, ip); rule != nil {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// Answers req according to a policy rule. Returns false if the query should carry on
+// as usual (PASSTHRU).
+func applyPolicy(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg, rule *rpzRule, answers *Answers, clientUUID string) bool {
+	question := req.Question[0]
+	fields := log.Fields{"client": clientUUID, "question": question.Name, "zone": rule.zone, "trigger": rule.trigger}
+
+	m.Authoritative = false
+	m.Answer = nil
+	m.Ns = nil
+
+	switch rule.action {
+	case RPZ_PASSTHRU:
+		log.WithFields(fields).Debug("Policy passthru")
+		return false
+	case RPZ_DROP:
+		log.WithFields(fields).Info("Policy dropped query")
+		return true
+	case RPZ_NXDOMAIN:
+		log.WithFields(fields).Info("Policy answered NXDOMAIN")
+		m.Rcode = dns.RcodeNameError
+	case RPZ_NODATA:
+		log.WithFields(fields).Info("Policy answered NODATA")
+		m.Rcode = dns.RcodeSuccess
+	case RPZ_DATA:
+		log.WithFields(fields).Info("Policy answered with local data")
+		m.Rcode = dns.RcodeSuccess
+		for _, rr := range rule.data {
+			hdr := rr.Header()
+			if hdr.Rrtype != question.Qtype && hdr.Rrtype != dns.TypeCNAME {
+				continue
+			}
+			rewritten := dns.Copy(rr)
+			rewritten.Header().Name = question.Name
+			m.Answer = append(m.Answer, rewritten)
+
+			// Rewrites to another name are resolved as usual
+			if cname, ok := rewritten.(*dns.CNAME); ok && question.Qtype != dns.TypeCNAME {
+				r := new(dns.Msg)
+				r.SetQuestion(dns.Fqdn(cname.Target), question.Qtype)
+				if msg, err := ResolveTryAll(upstreamRequest(r, nil), answers.Recursers(clientUUID)); err == nil {
+					m.Answer = append(m.Answer, msg.Answer...)
+				}
+				break
+			}
+		}
+	}
+
+	Respond(w, req, m)
+	return true
+}
+
+// Reloads the policy zones when their files change, unless --watch is off. Transferred zones are
+// only reloaded on a full reload.
+func watchPolicies() {
+	var files []string
+	for _, path := range splitTrim(*rpzFiles, ",") {
+		if path != "" {
+			files = append(files, path)
+		}
+	}
+	if !*watchFiles || len(files) == 0 {
+		return
+	}
+	reload := func() { reloadPolicies() }
+	if _, err := NewFileWatcher(func() []string { return files }, time.Duration(*watchDelay)*time.Millisecond, reload); err != nil {
+		log.Errorf("Failed to watch the policy zone files, changes need a reload: %v", err)
+	}
+}
+
+// Loads the policy zones given on the command line
+func loadPolicies() (Policies, error) {
+	var policies Policies
+	for _, path := range splitTrim(*rpzFiles, ",") {
+		if path == "" {
+			continue
+		}
+		zone, err := LoadPolicyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, zone)
+	}
+	for _, spec := range splitTrim(*rpzAxfr, ",") {
+		if spec == "" {
+			continue
+		}
+		zone, err := LoadPolicyAxfr(spec)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, zone)
+	}
+	return policies, nil
+}
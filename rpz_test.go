@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+const testPolicyZone = `$ORIGIN rpz.local.
+$TTL 60
+@                          SOA localhost. root.localhost. 1 3600 600 86400 60
+bad.example.com            CNAME .
+*.ads.example.com          CNAME *.
+portal.example.com         A     10.1.2.3
+good.ads.example.com       CNAME rpz-passthru.
+32.7.2.0.192.rpz-ip        CNAME .
+24.0.0.42.10.rpz-client-ip CNAME rpz-drop.
+48.zz.1.db8.2001.rpz-ip    CNAME *.
+`
+
+func loadTestPolicies(t *testing.T) Policies {
+	f, err := ioutil.TempFile("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testPolicyZone)
+	f.Close()
+
+	zone, err := LoadPolicyFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Policies{zone}
+}
+
+func TestPolicyQuery(t *testing.T) {
+	policies := loadTestPolicies(t)
+
+	tests := []struct {
+		fqdn     string
+		clientIp string
+		action   int
+	}{
+		{"bad.example.com.", "192.0.2.1", RPZ_NXDOMAIN},
+		{"tracker.ads.example.com.", "192.0.2.1", RPZ_NODATA},
+		{"deep.tracker.ads.example.com.", "192.0.2.1", RPZ_NODATA},
+		{"good.ads.example.com.", "192.0.2.1", RPZ_PASSTHRU},
+		{"portal.example.com.", "192.0.2.1", RPZ_DATA},
+		{"example.com.", "10.42.0.5", RPZ_DROP},
+	}
+	for _, test := range tests {
+		rule := policies.Query(test.fqdn, test.clientIp)
+		if rule == nil || rule.action != test.action {
+			t.Fatalf("Expected action %d for %s from %s, got %v", test.action, test.fqdn, test.clientIp, rule)
+		}
+	}
+
+	if rule := policies.Query("ads.example.com.", "192.0.2.1"); rule != nil {
+		t.Fatalf("Wildcards should not match their parent [%v]", rule)
+	}
+	if rule := policies.Query("www.example.com.", "192.0.2.1"); rule != nil {
+		t.Fatalf("Expected no policy [%v]", rule)
+	}
+}
+
+func TestPolicyResponse(t *testing.T) {
+	policies := loadTestPolicies(t)
+
+	msg := &dns.Msg{Answer: []dns.RR{testRR(t, "www.example.com. 60 IN A 192.0.2.7")}}
+	if rule := policies.Response(msg); rule == nil || rule.action != RPZ_NXDOMAIN {
+		t.Fatalf("Expected a response IP match [%v]", rule)
+	}
+
+	msg = &dns.Msg{Answer: []dns.RR{testRR(t, "www.example.com. 60 IN AAAA 2001:db8:1::5")}}
+	if rule := policies.Response(msg); rule == nil || rule.action != RPZ_NODATA {
+		t.Fatalf("Expected an IPv6 response IP match [%v]", rule)
+	}
+
+	msg = &dns.Msg{Answer: []dns.RR{testRR(t, "www.example.com. 60 IN A 192.0.2.8")}}
+	if rule := policies.Response(msg); rule != nil {
+		t.Fatalf("Expected no response IP match [%v]", rule)
+	}
+}
+
+// An upstream server answering every A query with addr
+func fakeUpstream(t *testing.T, addr string) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{testRR(t, req.Question[0].Name+" 60 IN A "+addr)}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestPassthruResponsesNotCached(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldGlobal, oldPolicies := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, globalCache, currentPolicies()
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, globalCache = oldDynamic, oldClients, oldGenerations, oldGlobal
+		setPolicies(oldPolicies)
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	globalCache = cache.New(100, 60)
+	setPolicies(loadTestPolicies(t))
+
+	// The upstream answer is blocked by the rpz-ip rule, unless the name is passed through
+	upstream, stop := fakeUpstream(t, "192.0.2.7")
+	defer stop()
+	setAnswers(Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{upstream}}}, "test")
+
+	req := new(dns.Msg)
+	req.SetQuestion("good.ads.example.com.", dns.TypeA)
+	w := &recordingWriter{}
+	route(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("Expected the passed through answer [%v]", w.msg)
+	}
+	if msg, _ := globalCacheHit(req, nil); msg != nil {
+		t.Fatal("Expected the passed through answer not to be cached for other clients")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Buckets that have been idle this long are full again and can be forgotten. Idle buckets are
+// swept this often too.
+const RRL_IDLE = time.Minute
+
+// Most buckets kept. Keys include query names clients choose, so the least recently used bucket
+// is forgotten to make room for a new one.
+const RRL_MAX_BUCKETS = 100000
+
+// What to do with a response
+const (
+	RRL_ALLOW = iota
+	RRL_DROP
+	RRL_SLIP
+)
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	last    time.Time
+	limited uint
+}
+
+// Token-bucket response rate limiter. Each key may get rate responses per second, with bursts of up to
+// one second's worth.
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*list.Element
+	// Of *tokenBucket, the most recently used first
+	lru *list.List
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Takes a token for key, returning what to do with the response. Every slip-th limited response
+// is slipped through truncated, the others are dropped. A slip of 0 drops all of them.
+func (r *rateLimiter) take(key string, rate uint, slip uint, now time.Time) int {
+	if rate == 0 {
+		return RRL_ALLOW
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	var b *tokenBucket
+	if e, ok := r.buckets[key]; ok {
+		b = e.Value.(*tokenBucket)
+		r.lru.MoveToFront(e)
+	} else {
+		if len(r.buckets) >= RRL_MAX_BUCKETS {
+			r.remove(r.lru.Back())
+		}
+		b = &tokenBucket{key: key, tokens: float64(rate), last: now}
+		r.buckets[key] = r.lru.PushFront(b)
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return RRL_ALLOW
+	}
+
+	b.limited++
+	if slip > 0 && b.limited%slip == 0 {
+		return RRL_SLIP
+	}
+	return RRL_DROP
+}
+
+// Forgets the buckets that have been idle, least recently used first
+func (r *rateLimiter) sweep(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for e := r.lru.Back(); e != nil && now.Sub(e.Value.(*tokenBucket).last) > RRL_IDLE; e = r.lru.Back() {
+		r.remove(e)
+	}
+}
+
+// Must be called with the lock held
+func (r *rateLimiter) remove(e *list.Element) {
+	delete(r.buckets, r.lru.Remove(e).(*tokenBucket).key)
+}
+
+func sweepRateLimits() {
+	for now := range time.Tick(RRL_IDLE) {
+		rrl.sweep(now)
+	}
+}
+
+// The key a client is rate limited by: clients with a section for their address by that address,
+// everyone else by the prefix of their source address. Never by the UUID in the query name, which
+// clients choose themselves.
+func rateLimitClientKey(answers *Answers, clientIp string) string {
+	if _, ok := (*answers)[clientIp]; ok {
+		return clientIp
+	}
+
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return clientIp
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(int(*rrlPrefixV4), 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(int(*rrlPrefixV6), 128)).String()
+}
+
+// Applies response rate limiting to a UDP query. Returns true if the query was handled here, either
+// by dropping it or by sending a truncated response so that the client retries over TCP.
+func rateLimited(w dns.ResponseWriter, req *dns.Msg, answers *Answers, clientIp string, fqdn string) bool {
+	if isTcp(w) {
+		return false
+	}
+
+	limits := answers.RateLimits(clientIp)
+	clientKey := rateLimitClientKey(answers, clientIp)
+	now := time.Now()
+
+	action := rrl.take(clientKey, limits.clientRate(), limits.slip(), now)
+	if action == RRL_ALLOW {
+		action = rrl.take(clientKey+"/"+fqdn, limits.nameRate(), limits.slip(), now)
+	}
+
+	switch action {
+	case RRL_DROP:
+		log.WithFields(log.Fields{"client": clientKey, "question": fqdn}).Debug("Rate limited, dropped response")
+		return true
+	case RRL_SLIP:
+		log.WithFields(log.Fields{"client": clientKey, "question": fqdn}).Debug("Rate limited, sent truncated response")
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		setResponseEdns(req, m)
+		w.WriteMsg(m)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSlip(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if action := r.take("client", 5, 2, now); action != RRL_ALLOW {
+			t.Fatalf("Response %d should be allowed within the burst, got %d", i, action)
+		}
+	}
+
+	expected := []int{RRL_DROP, RRL_SLIP, RRL_DROP, RRL_SLIP}
+	for i, e := range expected {
+		if action := r.take("client", 5, 2, now); action != e {
+			t.Fatalf("Limited response %d: expected %d, got %d", i, e, action)
+		}
+	}
+
+	// Tokens come back over time
+	if action := r.take("client", 5, 2, now.Add(time.Second/5)); action != RRL_ALLOW {
+		t.Fatalf("Response should be allowed after refill, got %d", action)
+	}
+
+	// Other keys are not affected
+	if action := r.take("other", 5, 2, now); action != RRL_ALLOW {
+		t.Fatalf("Other client should be allowed, got %d", action)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := newRateLimiter()
+	for i := 0; i < 100; i++ {
+		if action := r.take("client", 0, 2, time.Now()); action != RRL_ALLOW {
+			t.Fatalf("A rate of 0 should never limit, got %d", action)
+		}
+	}
+	if len(r.buckets) != 0 {
+		t.Fatal("No buckets should be kept without a limit")
+	}
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	answers := &Answers{"10.42.1.5": ClientAnswers{}, "abcdef01-123": ClientAnswers{}}
+	if key := rateLimitClientKey(answers, "10.42.1.5"); key != "10.42.1.5" {
+		t.Fatalf("Expected the address of a known client, got %s", key)
+	}
+	if key := rateLimitClientKey(answers, "192.0.2.77"); key != "192.0.2.0" {
+		t.Fatalf("Expected the source prefix, got %s", key)
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Now()
+	r.take("idle", 5, 2, now)
+	r.take("busy", 5, 2, now)
+	r.take("busy", 5, 2, now.Add(RRL_IDLE))
+
+	// Idle buckets are swept, the others kept
+	r.sweep(now.Add(RRL_IDLE + time.Second))
+	if _, ok := r.buckets["idle"]; ok || len(r.buckets) != 1 || r.lru.Len() != 1 {
+		t.Fatalf("Expected only the busy bucket to be kept, %d buckets", len(r.buckets))
+	}
+
+	// The least recently used bucket makes room for new ones
+	for i := 0; i < RRL_MAX_BUCKETS; i++ {
+		r.take("client/"+strconv.Itoa(i)+".example.", 5, 2, now.Add(RRL_IDLE))
+	}
+	if _, ok := r.buckets["busy"]; ok || len(r.buckets) != RRL_MAX_BUCKETS || r.lru.Len() != RRL_MAX_BUCKETS {
+		t.Fatalf("Expected the buckets to be capped, %d buckets", len(r.buckets))
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+// How long signatures are valid for, and how long before expiry they are replaced
+const (
+	SIGNATURE_VALIDITY = 7 * 24 * time.Hour
+	SIGNATURE_REFRESH  = 24 * time.Hour
+	SIGNATURE_SKEW     = time.Hour
+)
+
+type signingKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+type signedZone struct {
+	name string
+	ksk  []signingKey
+	zsk  []signingKey
+}
+
+// Signs local answers on the fly for the zones we have keys for
+type Signer struct {
+	zones      map[string]*signedZone
+	signatures *cache.Cache
+}
+
+// Reads a key pair from BIND-style <base>.key and <base>.private files
+func readSigningKey(base string) (signingKey, error) {
+	base = strings.TrimSuffix(strings.TrimSuffix(base, ".key"), ".private")
+
+	pub, err := os.Open(base + ".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, base+".key")
+	if err != nil {
+		return signingKey{}, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.key does not contain a DNSKEY", base)
+	}
+
+	priv, err := os.Open(base + ".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer priv.Close()
+	p, err := key.ReadPrivateKey(priv, base+".private")
+	if err != nil {
+		return signingKey{}, err
+	}
+	signer, ok := p.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s.private can not be used for signing", base)
+	}
+
+	key.Hdr.Name = strings.ToLower(dns.Fqdn(key.Hdr.Name))
+	return signingKey{key: key, priv: signer}, nil
+}
+
+// Loads key signing and zone signing keys from lists of key file names. Zones that only have
+// a key signing key use it for everything.
+func NewSigner(kskFiles []string, zskFiles []string) (*Signer, error) {
+	s := &Signer{
+		zones:      make(map[string]*signedZone),
+		signatures: cache.New(int(*cacheCapacity), int(*defaultTtl)),
+	}
+
+	for i, files := range [][]string{kskFiles, zskFiles} {
+		for _, file := range files {
+			if file == "" {
+				continue
+			}
+			k, err := readSigningKey(file)
+			if err != nil {
+				return nil, err
+			}
+			zone, ok := s.zones[k.key.Hdr.Name]
+			if !ok {
+				zone = &signedZone{name: k.key.Hdr.Name}
+				s.zones[zone.name] = zone
+			}
+			if i == 0 {
+				zone.ksk = append(zone.ksk, k)
+			} else {
+				zone.zsk = append(zone.zsk, k)
+			}
+			log.Infof("Loaded DNSSEC key %d for %s", k.key.KeyTag(), zone.name)
+		}
+	}
+
+	for _, zone := range s.zones {
+		if len(zone.ksk) == 0 {
+			return nil, fmt.Errorf("No key signing key for %s", zone.name)
+		}
+		if len(zone.zsk) == 0 {
+			zone.zsk = zone.ksk
+		}
+	}
+	return s, nil
+}
+
+// The signed zone a name belongs to, if any
+func (s *Signer) zoneFor(name string) *signedZone {
+	var found *signedZone
+	name = strings.ToLower(name)
+	for zone, z := range s.zones {
+		if dns.IsSubDomain(zone, name) && (found == nil || len(zone) > len(found.name)) {
+			found = z
+		}
+	}
+	return found
+}
+
+// The DNSKEY set of a zone apex, or nil if we don't sign it
+func (s *Signer) Keys(name string) []dns.RR {
+	zone, ok := s.zones[strings.ToLower(name)]
+	if !ok {
+		return nil
+	}
+	var keys []dns.RR
+	for _, k := range append(zone.ksk, zone.zsk...) {
+		key := *k.key
+		key.Hdr.Ttl = uint32(*defaultTtl)
+		if !containsKey(keys, &key) {
+			keys = append(keys, &key)
+		}
+	}
+	return keys
+}
+
+func containsKey(keys []dns.RR, key *dns.DNSKEY) bool {
+	for _, k := range keys {
+		if k.(*dns.DNSKEY).KeyTag() == key.KeyTag() {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds signatures to the RRsets of m that belong to zones we sign and aren't signed yet
+func (s *Signer) Sign(m *dns.Msg) {
+	m.Answer = s.signSection(m.Answer)
+	m.Ns = s.signSection(m.Ns)
+}
+
+// Signs the RRsets of a section that aren't signed yet, and puts each signature right after the
+// RRset it covers, so that truncation keeps them together
+func (s *Signer) signSection(rrs []dns.RR) []dns.RR {
+	rrsets, sigs := splitRRsets(rrs)
+	signed := make([]dns.RR, 0, len(rrs))
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		key := rrsetKey(hdr.Name, hdr.Rrtype)
+		signed = append(signed, rrset...)
+		if len(sigs[key]) > 0 {
+			for _, sig := range sigs[key] {
+				signed = append(signed, sig)
+			}
+			delete(sigs, key)
+			continue
+		}
+		zone := s.zoneFor(hdr.Name)
+		if zone == nil {
+			continue
+		}
+
+		keys := zone.zsk
+		if hdr.Rrtype == dns.TypeDNSKEY {
+			keys = zone.ksk
+		}
+		for _, k := range keys {
+			sig, err := s.signature(zone, k, rrset)
+			if err != nil {
+				log.WithFields(log.Fields{"name": hdr.Name, "type": dns.Type(hdr.Rrtype).String()}).Warn("Failed to sign: ", err)
+				continue
+			}
+			signed = append(signed, sig)
+		}
+	}
+
+	// Signatures without their RRset, and OPT records, stay at the end
+	for _, rr := range rrs {
+		switch t := rr.(type) {
+		case *dns.RRSIG:
+			if _, ok := sigs[rrsetKey(t.Hdr.Name, t.TypeCovered)]; ok {
+				signed = append(signed, rr)
+			}
+		case *dns.OPT:
+			signed = append(signed, rr)
+		}
+	}
+	return signed
+}
+
+// A signature for rrset, from the cache if there is one that's not about to expire
+func (s *Signer) signature(zone *signedZone, k signingKey, rrset []dns.RR) (*dns.RRSIG, error) {
+	key := cache.KeyRRset(rrset) + fmt.Sprintf("/%d", k.key.KeyTag())
+	if msg, exp, ok := s.signatures.Search(key); ok && time.Until(exp) > SIGNATURE_REFRESH {
+		return msg.Answer[0].(*dns.RRSIG), nil
+	}
+	s.signatures.Remove(key)
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: zone.name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(now.Add(-SIGNATURE_SKEW).Unix()),
+		Expiration: uint32(now.Add(SIGNATURE_VALIDITY).Unix()),
+	}
+	if err := sig.Sign(k.priv, rrset); err != nil {
+		return nil, err
+	}
+	s.signatures.InsertSignature(key, sig)
+	return sig, nil
+}
+
+// Replaces a negative answer in a signed zone with a "black lie": a NODATA response whose NSEC
+// record only covers the queried name, listing the given types as the ones that exist. The SOA
+// comes from the client's section of answers.
+func (s *Signer) Deny(answers *Answers, clientUUID string, m *dns.Msg, fqdn string, types []uint16) {
+	zone := s.zoneFor(fqdn)
+	if zone == nil {
+		return
+	}
+
+	bitmap := append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, types...)
+	if strings.ToLower(fqdn) == zone.name {
+		bitmap = append(bitmap, dns.TypeDNSKEY)
+	}
+	sort.Sort(uint16Slice(bitmap))
+
+	hdr := dns.RR_Header{Name: fqdn, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+	m.Rcode = dns.RcodeSuccess
+	if !hasType(m.Ns, dns.TypeSOA) {
+		m.Ns = append(m.Ns, answers.SOA(clientUUID, zone.name))
+	}
+	m.Ns = append(m.Ns, &dns.NSEC{Hdr: hdr, NextDomain: "\\000." + fqdn, TypeBitMap: bitmap})
+}
+
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+type uint16Slice []uint16
+
+func (p uint16Slice) Len() int           { return len(p) }
+func (p uint16Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint16Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Whether local answers to req should be signed
+func signing(req *dns.Msg) bool {
+	if signer == nil {
+		return false
+	}
+	o := req.IsEdns0()
+	return o != nil && o.Do()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func writeTestKey(t *testing.T, dir string, zone string, flags uint16) string {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := ioutil.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return base
+}
+
+func TestSignerRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ksk := writeTestKey(t, dir, "discover.internal.", 257)
+	s, err := NewSigner([]string{ksk}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := s.Keys("discover.internal.")
+	if len(keys) != 1 {
+		t.Fatalf("Expected one DNSKEY at the apex [%v]", keys)
+	}
+	if s.Keys("foo.discover.internal.") != nil {
+		t.Fatal("DNSKEY should only be served at the apex")
+	}
+
+	m := &dns.Msg{Answer: []dns.RR{testRR(t, "web.discover.internal. 600 IN A 10.42.1.2")}}
+	s.Sign(m)
+	if len(m.Answer) != 2 || m.Answer[1].Header().Rrtype != dns.TypeRRSIG {
+		t.Fatalf("Expected a signed answer [%v]", m.Answer)
+	}
+
+	// Signatures are reused for the same records, with the same TTL since it is signed too
+	again := &dns.Msg{Answer: []dns.RR{testRR(t, "web.discover.internal. 600 IN A 10.42.1.2")}}
+	s.Sign(again)
+	if again.Answer[1].(*dns.RRSIG).Signature != m.Answer[1].(*dns.RRSIG).Signature {
+		t.Fatal("Expected the cached signature to be reused")
+	}
+	shorter := &dns.Msg{Answer: []dns.RR{testRR(t, "web.discover.internal. 300 IN A 10.42.1.2")}}
+	s.Sign(shorter)
+	if sig := shorter.Answer[1].(*dns.RRSIG); sig.Signature == m.Answer[1].(*dns.RRSIG).Signature || sig.OrigTtl != 300 {
+		t.Fatalf("Expected a new signature for another TTL [%v]", sig)
+	}
+
+	// Records that only differ in the SRV port or TXT string boundaries have their own signatures
+	for _, pair := range [][2]string{
+		{"_http._tcp.discover.internal. 600 IN SRV 10 5 80 web.discover.internal.", "_http._tcp.discover.internal. 600 IN SRV 10 5 8080 web.discover.internal."},
+		{`txt.discover.internal. 600 IN TXT "ab" "c"`, `txt.discover.internal. 600 IN TXT "a" "bc"`},
+	} {
+		first, second := &dns.Msg{Answer: []dns.RR{testRR(t, pair[0])}}, &dns.Msg{Answer: []dns.RR{testRR(t, pair[1])}}
+		s.Sign(first)
+		s.Sign(second)
+		if first.Answer[1].(*dns.RRSIG).Signature == second.Answer[1].(*dns.RRSIG).Signature {
+			t.Fatalf("Expected different signatures for %s and %s", pair[0], pair[1])
+		}
+	}
+
+	// A validator trusting the key accepts the answer
+	v := NewValidator(keys)
+	v.exchange = func(req *dns.Msg, resolvers []string) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(req)
+		r.Answer = s.Keys(req.Question[0].Name)
+		s.Sign(r)
+		return r, nil
+	}
+	if result := v.Validate(m, nil); result != VALIDATION_SECURE {
+		t.Fatalf("Expected the signed answer to validate, got %d", result)
+	}
+
+	// Names outside the zone are left alone
+	other := &dns.Msg{Answer: []dns.RR{testRR(t, "example.com. 600 IN A 10.0.0.1")}}
+	s.Sign(other)
+	if len(other.Answer) != 1 {
+		t.Fatalf("Expected no signature outside the zone [%v]", other.Answer)
+	}
+}
+
+func TestSignerDeny(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSigner([]string{writeTestKey(t, dir, "discover.internal.", 257)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("nothere.discover.internal.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	s.Deny(&Answers{}, DEFAULT_KEY, m, "nothere.discover.internal.", nil)
+
+	if m.Rcode != dns.RcodeSuccess || len(m.Ns) != 2 {
+		t.Fatalf("Expected a NODATA answer with SOA and NSEC [%v]", m)
+	}
+	nsec := m.Ns[1].(*dns.NSEC)
+	if nsec.NextDomain != "\\000.nothere.discover.internal." {
+		t.Fatalf("Incorrect NSEC next name %s", nsec.NextDomain)
+	}
+	if _, err := m.Pack(); err != nil {
+		t.Fatalf("Failed to pack denial: %v", err)
+	}
+}
+
+func TestSignedDenialsCachedApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldSigner := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, signer
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, signer = oldDynamic, oldClients, oldGenerations, oldSigner
+	}()
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	if signer, err = NewSigner([]string{writeTestKey(t, dir, "discover.internal.", 257)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	setAnswers(Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"discover.internal."},
+		A:             map[string]RecordA{"web.discover.internal.": {Answer: []string{"10.42.1.2"}}},
+	}}, "test")
+
+	// A NODATA answer cached for a client without DO doesn't keep the NSEC from later DO clients
+	query := func(do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("web.discover.internal.", dns.TypeAAAA)
+		req.SetEdns0(1232, do)
+		w := &recordingWriter{}
+		route(w, req)
+		return w.msg
+	}
+	if m := query(false); m == nil || hasType(m.Ns, dns.TypeNSEC) {
+		t.Fatalf("Expected an unsigned NODATA answer [%v]", m)
+	}
+	if m := query(true); m == nil || !hasType(m.Ns, dns.TypeNSEC) || !hasType(m.Ns, dns.TypeSOA) {
+		t.Fatalf("Expected a signed NODATA answer with NSEC and SOA [%v]", m)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A version of the answers being served. Snapshots are immutable once published: every change
+// publishes a new one, so a request that took a snapshot sees consistent answers throughout.
+// Queries are answered through the snapshot, which looks records up in its index.
+type Snapshot struct {
+	Answers         // served, with the dynamic records merged in
+	Base    Answers // before the dynamic records are merged in
+	index   *AnswersIndex
+}
+
+func newSnapshot(base Answers) *Snapshot {
+	served := dynamicRecords.Merge(base)
+	return &Snapshot{Answers: served, Base: base, index: compileIndex(served)}
+}
+
+// Looks up answers that aren't published, like files being checked, without an index
+func unindexed(answers Answers) *Snapshot {
+	return &Snapshot{Answers: answers, Base: answers}
+}
+
+var (
+	currentSnapshot atomic.Value // *Snapshot
+	// Serializes publishing, so that concurrent changes don't lose each other
+	publishMutex sync.Mutex
+)
+
+// The snapshot last published, or nil
+func loadSnapshot() *Snapshot {
+	s, _ := currentSnapshot.Load().(*Snapshot)
+	return s
+}
+
+func storeSnapshot(s *Snapshot) {
+	currentSnapshot.Store(s)
+}
+
+// The answers being served. Take a snapshot once per request and use it throughout.
+func snapshot() *Snapshot {
+	if s := loadSnapshot(); s != nil {
+		return s
+	}
+	return &Snapshot{}
+}
+
+// Publishes base with the dynamic records merged in, with a new serial for the generated SOA
+// records. Returns the previous snapshot.
+func publish(base Answers) *Snapshot {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	previous := snapshot()
+	atomic.AddUint32(&serial, 1)
+	storeSnapshot(newSnapshot(base))
+	return previous
+}
+
+// Publishes the current base again, after the dynamic records changed
+func republish() {
+	publishMutex.Lock()
+	defer publishMutex.Unlock()
+	atomic.AddUint32(&serial, 1)
+	storeSnapshot(newSnapshot(snapshot().Base))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+type recordingWriter struct {
+	msg *dns.Msg
+}
+
+func (w *recordingWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *recordingWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 42, 1, 5), Port: 40000}
+}
+func (w *recordingWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *recordingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recordingWriter) Close() error                { return nil }
+func (w *recordingWriter) TsigStatus() error           { return nil }
+func (w *recordingWriter) TsigTimersOnly(bool)         {}
+func (w *recordingWriter) Hijack()                     {}
+
+// Run with -race: queries are answered while the answers are reloaded and dynamic records change
+func TestSnapshotsUnderConcurrentReloads(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldGlobal := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, globalCache
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, globalCache = oldDynamic, oldClients, oldGenerations, oldGlobal
+	}()
+
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	globalCache = cache.New(100, 60)
+
+	version := func(i int) Answers {
+		a, err := parseAnswers([]byte(fmt.Sprintf(`
+default:
+  authoritative: ["lab.example."]
+  a:
+    web.lab.example.:
+      answer: ["10.1.0.%d"]
+  ptr:
+    10.1.0.%d:
+      answer: web.lab.example.
+`, i, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	setAnswers(version(1), "test")
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			setAnswers(version(i%250+1), "test")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			dynamicRecords.Put(DynamicRecord{Type: "A", Name: "db.lab.example.", Answer: answerList{{fmt.Sprintf("10.2.0.%d", i%250+1)}}}, true)
+			mergeDynamicRecords()
+		}
+	}()
+
+	errors := make(chan error, 4)
+	for q := 0; q < 4; q++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				req := new(dns.Msg)
+				req.SetQuestion("web.lab.example.", dns.TypeA)
+				w := &recordingWriter{}
+				route(w, req)
+				if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+					errors <- fmt.Errorf("Unexpected response %v", w.msg)
+					return
+				}
+
+				// Negative answers of the authoritative zone carry the SOA of the zone
+				req.SetQuestion("nope.lab.example.", dns.TypeA)
+				w = &recordingWriter{}
+				route(w, req)
+				if w.msg == nil || w.msg.Rcode != dns.RcodeNameError || len(w.msg.Ns) != 1 {
+					errors <- fmt.Errorf("Unexpected negative response %v", w.msg)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Fatal(err)
+	}
+}
+
+func TestGeneratedSerialStableBetweenPublishes(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients := loadSnapshot(), dynamicRecords, clientSpecificCaches
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches = oldDynamic, oldClients
+	}()
+
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	clientSpecificCaches = make(map[string]*cache.Cache)
+
+	answers, err := parseAnswers([]byte(`
+default:
+  authoritative: ["lab.example."]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveAnswers(answers)
+
+	negative := func() uint32 {
+		req := new(dns.Msg)
+		req.SetQuestion("nope.lab.example.", dns.TypeA)
+		w := &recordingWriter{}
+		route(w, req)
+		if w.msg == nil || len(w.msg.Ns) != 1 {
+			t.Fatalf("Unexpected negative response %v", w.msg)
+		}
+		return w.msg.Ns[0].(*dns.SOA).Serial
+	}
+
+	first := negative()
+	if again := negative(); again != first {
+		t.Fatalf("Expected the serial to stay %d between publishes, got %d", first, again)
+	}
+	serveAnswers(answers)
+	if reloaded := negative(); reloaded == first {
+		t.Fatalf("Expected a new serial after publishing, got %d again", reloaded)
+	}
+}
+
+func TestConvertPtrIps(t *testing.T) {
+	ptr := map[string]RecordPtr{
+		"10.1.0.1":               {Answer: "web."},
+		"2.0.1.10.in-addr.arpa.": {Answer: "db."},
+	}
+	original := Answers{DEFAULT_KEY: ClientAnswers{Ptr: ptr}}
+
+	converted := ConvertPtrIps(original)
+	if _, ok := converted[DEFAULT_KEY].Ptr["1.0.1.10.in-addr.arpa."]; !ok || len(converted[DEFAULT_KEY].Ptr) != 2 {
+		t.Fatalf("Expected the IP to be converted [%v]", converted[DEFAULT_KEY].Ptr)
+	}
+	if _, ok := ptr["10.1.0.1"]; !ok || len(ptr) != 2 {
+		t.Fatalf("The original answers should be left alone [%v]", ptr)
+	}
+}
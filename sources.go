@@ -0,0 +1,410 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A place answers come from, like the answers file, Rancher metadata, or the Kubernetes API
+type AnswerSource interface {
+	// Names the source in logs, generations and the origins of records
+	Name() string
+	// The current answers of the source
+	Load() (Answers, error)
+	// Starts calling changed whenever the answers may have changed
+	Watch(changed func()) error
+}
+
+// Which source each record came from: by section, then by type and name like "A web.example."
+type Origins map[string]map[string]string
+
+// The origin of a record, or "" if it's not known
+func (o Origins) Of(client string, rrtype string, name string) string {
+	return o[client][strings.ToUpper(rrtype)+" "+name]
+}
+
+// Merges the answers of several sources, each taking precedence over the ones before it:
+//
+//   - Records replace the records of lower layers with the same section, type and name as a whole,
+//     so an RRset always comes from a single source.
+//   - A CNAME can't share its name with other records. A layer's CNAME removes the other records
+//     of lower layers with its name, and its other records remove the lower layers' CNAME.
+//   - Settings, like search domains or recursive servers, come from the highest layer that sets
+//     them.
+//   - Sections, records and settings only some layers have are kept.
+//
+// names are the names of the sources, for the origins of the merged records.
+func MergeAnswers(names []string, layers []Answers) (Answers, Origins) {
+	merged := make(Answers)
+	origins := make(Origins)
+	for i, layer := range layers {
+		for key, client := range layer {
+			section := merged[key]
+			if origins[key] == nil {
+				origins[key] = make(map[string]string)
+			}
+			removeCnameConflicts(&section, client, origins[key])
+			mergeSection(&section, client, names[i], origins[key])
+			merged[key] = section
+		}
+	}
+	return merged, origins
+}
+
+// Record fields are the maps of ClientAnswers; the merged section gets its own maps, so that no
+// source's answers are modified
+func mergeSection(into *ClientAnswers, from ClientAnswers, source string, origins map[string]string) {
+	v := reflect.ValueOf(into).Elem()
+	layer := reflect.ValueOf(from)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		field, value := v.Field(i), layer.Field(i)
+		if f.Type.Kind() != reflect.Map {
+			if !isEmptyValue(value) {
+				field.Set(value)
+			}
+			continue
+		}
+
+		if value.Len() == 0 {
+			continue
+		}
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(f.Type))
+		}
+		rrtype := strings.ToUpper(f.Name)
+		for _, name := range value.MapKeys() {
+			field.SetMapIndex(name, value.MapIndex(name))
+			origins[rrtype+" "+name.String()] = source
+		}
+	}
+}
+
+// Removes the records of lower layers that can't be served together with the records of from
+func removeCnameConflicts(into *ClientAnswers, from ClientAnswers, origins map[string]string) {
+	v := reflect.ValueOf(into).Elem()
+	layer := reflect.ValueOf(from)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Type.Kind() != reflect.Map || f.Name == "Cname" || f.Name == "Soa" {
+			continue
+		}
+		rrtype := strings.ToUpper(f.Name)
+		for name := range from.Cname {
+			if v.Field(i).MapIndex(reflect.ValueOf(name)).IsValid() {
+				v.Field(i).SetMapIndex(reflect.ValueOf(name), reflect.Value{})
+				delete(origins, rrtype+" "+name)
+			}
+		}
+		for _, name := range layer.Field(i).MapKeys() {
+			if _, ok := into.Cname[name.String()]; ok {
+				delete(into.Cname, name.String())
+				delete(origins, "CNAME "+name.String())
+			}
+		}
+	}
+}
+
+// A source and what it last loaded
+type answerLayer struct {
+	source  AnswerSource
+	answers Answers
+	loaded  time.Time
+	err     error
+}
+
+// Answer sources in order of precedence, the last one taking precedence, merged into the answers
+// that are served. The dynamic records are merged on top of them when the answers are published.
+type AnswerLayers struct {
+	sync.Mutex
+	layers  []*answerLayer
+	loaded  bool
+	origins Origins
+	// The generation the origins are of
+	generation uint64
+}
+
+func NewAnswerLayers(sources ...AnswerSource) *AnswerLayers {
+	l := &AnswerLayers{}
+	for _, source := range sources {
+		l.layers = append(l.layers, &answerLayer{source: source})
+	}
+	return l
+}
+
+// The names of the sources, in order of precedence, as the source of generations
+func (l *AnswerLayers) Name() string {
+	names := make([]string, 0, len(l.layers))
+	for _, layer := range l.layers {
+		names = append(names, layer.source.Name())
+	}
+	return strings.Join(names, " + ")
+}
+
+// Loads the answers of a layer's source, without keeping them yet
+func (l *AnswerLayers) fetch(layer *answerLayer) (Answers, error) {
+	answers, err := layer.source.Load()
+	layer.err = err
+	if err != nil {
+		log.Errorf("Failed to load answers from %s: %v", layer.source.Name(), err)
+		return nil, err
+	}
+	return ConvertPtrIps(answers), nil
+}
+
+func (layer *answerLayer) keep(answers Answers) {
+	layer.answers = answers
+	layer.loaded = time.Now().UTC()
+}
+
+// Loads every source again and serves the merged answers. Nothing changes if any source fails,
+// every layer keeps what it loaded before.
+func (l *AnswerLayers) Reload() (AnswersDiff, error) {
+	l.Lock()
+	defer l.Unlock()
+	var err error
+	loaded := make([]Answers, len(l.layers))
+	for i, layer := range l.layers {
+		answers, layerErr := l.fetch(layer)
+		if layerErr != nil && err == nil {
+			err = layerErr
+		}
+		loaded[i] = answers
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, layer := range l.layers {
+		layer.keep(loaded[i])
+	}
+	return l.serve(false), nil
+}
+
+// Loads source number i again and serves the merged answers. The source keeps what it loaded
+// before if it fails.
+func (l *AnswerLayers) ReloadSource(i int) (AnswersDiff, error) {
+	return l.reloadSource(i, false)
+}
+
+// With amend, the answers amend the generation of the previous amending reload
+func (l *AnswerLayers) reloadSource(i int, amend bool) (AnswersDiff, error) {
+	l.Lock()
+	defer l.Unlock()
+	answers, err := l.fetch(l.layers[i])
+	if err != nil {
+		return nil, err
+	}
+	l.layers[i].keep(answers)
+	return l.serve(amend), nil
+}
+
+// Serves the merged answers of the layers, unless they are the same as the latest generation
+func (l *AnswerLayers) serve(amend bool) AnswersDiff {
+	names := make([]string, len(l.layers))
+	answers := make([]Answers, len(l.layers))
+	for i, layer := range l.layers {
+		names[i], answers[i] = layer.source.Name(), layer.answers
+	}
+	merged, origins := MergeAnswers(names, answers)
+
+	if latest, ok := generations.Get(generations.Latest()); ok && l.loaded && reflect.DeepEqual(merged, latest) {
+		log.Debug("No changes in dns data")
+		l.origins = origins
+		return AnswersDiff{}
+	}
+
+	diff := recordAnswers(merged, l.Name(), amend)
+	if metadataDriven() {
+		writeAnswersFile()
+	}
+	l.origins, l.generation = origins, generations.Latest()
+	if !l.loaded {
+		log.Infof("Loaded answers from %s", l.Name())
+		l.loaded = true
+	} else {
+		log.Infof("Reloaded answers from %s", l.Name())
+		diff.Log()
+	}
+	return diff
+}
+
+// Reloads a source whenever it changes. The policy zones are left alone: they have their own
+// watch, and are reloaded with everything else on a full reload. Files change when someone edits
+// them, so each change is a new generation; containers and pods come and go all the time, so their
+// changes amend the generation of the last one.
+func (l *AnswerLayers) Watch() {
+	for i, layer := range l.layers {
+		i := i
+		_, file := layer.source.(*FileSource)
+		if err := layer.source.Watch(func() { l.reloadSource(i, !file) }); err != nil {
+			log.Errorf("Failed to watch %s, changes need a reload: %v", layer.source.Name(), err)
+		}
+	}
+}
+
+// Calls changed for the signals of changes, after letting related changes settle (like a new
+// service and its endpoints)
+func relayChanges(changes <-chan struct{}, changed func()) {
+	for _ = range changes {
+		time.Sleep(time.Duration(*watchDelay) * time.Millisecond)
+		changed()
+	}
+}
+
+// The origins of the records of the latest generation
+func (l *AnswerLayers) Origins() (Origins, uint64) {
+	l.Lock()
+	defer l.Unlock()
+	return l.origins, l.generation
+}
+
+type sourceStatus struct {
+	Name       string     `json:"name"`
+	Precedence int        `json:"precedence"`
+	Loaded     *time.Time `json:"loaded,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Sections   int        `json:"sections"`
+	Records    int        `json:"records"`
+}
+
+// The sources, lowest precedence first, with what they last loaded
+func (l *AnswerLayers) Status() []sourceStatus {
+	l.Lock()
+	defer l.Unlock()
+	list := make([]sourceStatus, 0, len(l.layers))
+	for i, layer := range l.layers {
+		status := sourceStatus{Name: layer.source.Name(), Precedence: i + 1, Sections: len(layer.answers)}
+		if !layer.loaded.IsZero() {
+			loaded := layer.loaded
+			status.Loaded = &loaded
+		}
+		if layer.err != nil {
+			status.Error = layer.err.Error()
+		}
+		for _, client := range layer.answers {
+			records, _ := sectionContents(client)
+			status.Records += len(records)
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// A record being served and the source it came from
+type recordOrigin struct {
+	Client string `json:"client"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// The records being served, with their sources. Records changed through the API come from
+// "dynamic", and the records of a pinned or rolled back generation from that generation.
+func (l *AnswerLayers) RecordOrigins(client string, name string) []recordOrigin {
+	origins, generation := l.Origins()
+	served := snapshot().Answers
+	var stale string
+	if number := generations.Served(); number != generation {
+		stale = "generation " + strconv.FormatUint(number, 10)
+	}
+
+	var list []recordOrigin
+	for key, section := range served {
+		if client != "" && key != client {
+			continue
+		}
+		records, _ := sectionContents(section)
+		for record := range records {
+			parts := strings.SplitN(record, " ", 2)
+			if name != "" && !strings.EqualFold(strings.TrimSuffix(parts[1], "."), strings.TrimSuffix(name, ".")) {
+				continue
+			}
+			source := stale
+			if r, ok := dynamicRecords.Get(key, parts[0], parts[1]); ok && len(r.Answer) > 0 && !r.expired(time.Now()) {
+				source = "dynamic"
+			} else if source == "" {
+				source = origins.Of(key, parts[0], parts[1])
+			}
+			list = append(list, recordOrigin{Client: key, Type: parts[0], Name: parts[1], Source: source})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Client != list[j].Client {
+			return list[i].Client < list[j].Client
+		}
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+func httpListSources(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, answerLayers.Status())
+}
+
+func httpListRecordOrigins(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	writeJSON(w, http.StatusOK, answerLayers.RecordOrigins(params.Get("client"), params.Get("name")))
+}
+
+// The answers file, and the hosts and zone files it includes
+type FileSource struct {
+	path  string
+	mutex sync.Mutex
+	files []string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path, files: []string{path}}
+}
+
+func (f *FileSource) Name() string {
+	return "file " + f.path
+}
+
+func (f *FileSource) Load() (Answers, error) {
+	answers, err := ParseAnswers(f.path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{f.path}
+	for _, client := range answers {
+		for _, hosts := range client.Hosts {
+			files = append(files, hosts.Path)
+		}
+		for _, zone := range client.Zones {
+			files = append(files, zone.Path)
+		}
+	}
+	f.mutex.Lock()
+	f.files = files
+	f.mutex.Unlock()
+	return answers, nil
+}
+
+// The files of the last load
+func (f *FileSource) watchedFiles() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.files
+}
+
+// Watches the files, unless --watch is off
+func (f *FileSource) Watch(changed func()) error {
+	if !*watchFiles {
+		return nil
+	}
+	_, err := NewFileWatcher(f.watchedFiles, time.Duration(*watchDelay)*time.Millisecond, changed)
+	return err
+}
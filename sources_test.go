@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// A source that returns what it's given
+type fakeSource struct {
+	name    string
+	answers Answers
+	err     error
+}
+
+func (f *fakeSource) Name() string               { return f.name }
+func (f *fakeSource) Load() (Answers, error)     { return f.answers, f.err }
+func (f *fakeSource) Watch(changed func()) error { return nil }
+
+func TestMergeAnswers(t *testing.T) {
+	metadata := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8"},
+			Search:  []string{"rancher.internal"},
+			A: map[string]RecordA{
+				"web.":   {Answer: []string{"10.0.0.1", "10.0.0.2"}},
+				"db.":    {Answer: []string{"10.0.0.3"}},
+				"alias.": {Answer: []string{"10.0.0.4"}},
+			},
+			Txt:   map[string]RecordTxt{"alias.": {Answer: []AnswerStrings{{"v=1"}}}},
+			Cname: map[string]RecordCname{"mail.": {Answer: "smtp.example.com."}},
+		},
+		"10.42.0.5": ClientAnswers{A: map[string]RecordA{"db.": {Answer: []string{"10.0.0.9"}}}},
+	}
+	overrides := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"1.1.1.1"},
+			A: map[string]RecordA{
+				"web.":  {Answer: []string{"10.1.0.1"}},
+				"mail.": {Answer: []string{"10.1.0.25"}},
+			},
+			Cname: map[string]RecordCname{"alias.": {Answer: "web."}},
+		},
+	}
+	merged, origins := MergeAnswers([]string{"metadata", "file overrides.yml"}, []Answers{metadata, overrides})
+	def := merged[DEFAULT_KEY]
+
+	// RRsets are replaced as a whole, and kept where only lower layers have them
+	if a := def.A["web."].Answer; len(a) != 1 || a[0] != "10.1.0.1" {
+		t.Fatalf("Expected the overridden RRset [%v]", a)
+	}
+	if o := origins.Of(DEFAULT_KEY, "A", "web."); o != "file overrides.yml" {
+		t.Fatalf("Unexpected origin of the overridden record [%s]", o)
+	}
+	if o := origins.Of(DEFAULT_KEY, "A", "db."); o != "metadata" || len(def.A["db."].Answer) != 1 {
+		t.Fatalf("Expected the lower layer's record to be kept [%s]", o)
+	}
+	if o := origins.Of("10.42.0.5", "A", "db."); o != "metadata" {
+		t.Fatalf("Expected the lower layer's section to be kept [%s]", o)
+	}
+
+	// CNAMEs don't share their names with other records
+	if _, ok := def.A["alias."]; ok {
+		t.Fatalf("Expected the CNAME to remove the lower layer's records [%v]", def.A)
+	}
+	if _, ok := def.Txt["alias."]; ok || origins.Of(DEFAULT_KEY, "TXT", "alias.") != "" {
+		t.Fatalf("Expected the CNAME to remove the lower layer's records [%v]", def.Txt)
+	}
+	if _, ok := def.Cname["mail."]; ok || origins.Of(DEFAULT_KEY, "CNAME", "mail.") != "" {
+		t.Fatalf("Expected the A record to remove the lower layer's CNAME [%v]", def.Cname)
+	}
+
+	// Settings come from the highest layer that sets them
+	if len(def.Recurse) != 1 || def.Recurse[0] != "1.1.1.1" || len(def.Search) != 1 {
+		t.Fatalf("Unexpected settings [%v] [%v]", def.Recurse, def.Search)
+	}
+
+	// The sources' answers are left alone
+	if len(metadata[DEFAULT_KEY].A) != 3 || len(metadata[DEFAULT_KEY].Cname) != 1 || len(overrides[DEFAULT_KEY].A) != 2 {
+		t.Fatal("Expected the sources' answers not to be modified")
+	}
+}
+
+func TestAnswerLayers(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldLayers := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, answerLayers
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, answerLayers = oldDynamic, oldClients, oldGenerations, oldLayers
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	base := &fakeSource{name: "kubernetes", answers: Answers{DEFAULT_KEY: ClientAnswers{
+		A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}}, "db.": {Answer: []string{"10.0.0.2"}}},
+	}}}
+	overrides := &fakeSource{name: "file overrides.yml", answers: Answers{DEFAULT_KEY: ClientAnswers{
+		A: map[string]RecordA{"db.": {Answer: []string{"10.1.0.2"}}},
+	}}}
+	answerLayers = NewAnswerLayers(base, overrides)
+	if _, err = answerLayers.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a := snapshot().Answers[DEFAULT_KEY].A["db."].Answer; len(a) != 1 || a[0] != "10.1.0.2" {
+		t.Fatalf("Expected the overrides to be served [%v]", a)
+	}
+	if list := generations.List(); len(list) != 1 || list[0].Source != "kubernetes + file overrides.yml" {
+		t.Fatalf("Unexpected generations [%+v]", list)
+	}
+
+	// A full reload changes nothing if any source fails
+	base.answers = Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.9"}}}}}
+	overrides.err = errors.New("broken")
+	if _, err = answerLayers.Reload(); err == nil {
+		t.Fatal("Expected the failing source's error")
+	}
+	overrides.err = nil
+	if _, err = answerLayers.ReloadSource(1); err != nil {
+		t.Fatal(err)
+	}
+	if a := snapshot().Answers[DEFAULT_KEY].A["web."].Answer; len(a) != 1 || a[0] != "10.0.0.1" || generations.Latest() != 1 {
+		t.Fatalf("Expected the other sources to keep their answers [%v]", a)
+	}
+
+	// A failing source keeps its last answers, and nothing changes until the others do
+	overrides.err = errors.New("broken")
+	if _, err = answerLayers.ReloadSource(1); err == nil {
+		t.Fatal("Expected the failing source's error")
+	}
+	base.answers = Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"db.": {Answer: []string{"10.0.0.2"}}}}}
+	if _, err = answerLayers.ReloadSource(0); err != nil {
+		t.Fatal(err)
+	}
+	served := snapshot().Answers[DEFAULT_KEY].A
+	if _, ok := served["web."]; ok || served["db."].Answer[0] != "10.1.0.2" {
+		t.Fatalf("Expected the changed source to be merged with the last answers of the others [%v]", served)
+	}
+	if _, err = answerLayers.ReloadSource(0); err != nil || generations.Latest() != 2 {
+		t.Fatalf("Expected unchanged answers not to add a generation, latest %d %v", generations.Latest(), err)
+	}
+
+	router := newReloadRouter()
+	get := func(url string, v interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v: %s", url, err, w.Body.String())
+		}
+	}
+
+	var sources []sourceStatus
+	get("/v1/sources", &sources)
+	if len(sources) != 2 || sources[1].Precedence != 2 || sources[1].Error != "broken" || sources[1].Records != 1 || sources[0].Loaded == nil {
+		t.Fatalf("Unexpected sources [%+v]", sources)
+	}
+
+	// Records changed through the API come from the dynamic records
+	if _, err = dynamicRecords.Put(DynamicRecord{Client: DEFAULT_KEY, Type: "A", Name: "api.", Answer: answerList{{"10.2.0.1"}}}, true); err != nil {
+		t.Fatal(err)
+	}
+	mergeDynamicRecords()
+	var records []recordOrigin
+	get("/v1/sources/records", &records)
+	expected := []recordOrigin{
+		{Client: DEFAULT_KEY, Type: "A", Name: "api.", Source: "dynamic"},
+		{Client: DEFAULT_KEY, Type: "A", Name: "db.", Source: "file overrides.yml"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("Unexpected origins [%+v]", records)
+	}
+
+	// A rolled back generation doesn't come from the sources as they are now
+	if _, err = serveGeneration(1, false); err != nil {
+		t.Fatal(err)
+	}
+	get("/v1/sources/records?name=web", &records)
+	if len(records) != 1 || records[0].Source != "generation 1" {
+		t.Fatalf("Unexpected origins of the rolled back generation [%+v]", records)
+	}
+}
+
+// A source whose changes are signalled by the test
+type watchedSource struct {
+	fakeSource
+	changed func()
+}
+
+func (w *watchedSource) Watch(changed func()) error {
+	w.changed = changed
+	return nil
+}
+
+func TestWatchLeavesPolicies(t *testing.T) {
+	oldSnapshot, oldDynamic, oldClients, oldGenerations, oldPolicies, oldRpz := loadSnapshot(), dynamicRecords, clientSpecificCaches, generations, currentPolicies(), *rpzFiles
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches, generations, *rpzFiles = oldDynamic, oldClients, oldGenerations, oldRpz
+		setPolicies(oldPolicies)
+	}()
+	var err error
+	if dynamicRecords, err = LoadDynamicRecords(""); err != nil {
+		t.Fatal(err)
+	}
+	if generations, err = LoadGenerations(3, ""); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testPolicyZone)
+	f.Close()
+	*rpzFiles = f.Name()
+	setPolicies(nil)
+
+	source := &watchedSource{fakeSource: fakeSource{name: "docker", answers: Answers{DEFAULT_KEY: ClientAnswers{}}}}
+	layers := NewAnswerLayers(source)
+	if _, err = layers.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	layers.Watch()
+	source.changed()
+	if policies := currentPolicies(); len(policies) != 0 {
+		t.Fatalf("Expected the policy zones to be left alone when a source changes [%v]", policies)
+	}
+}
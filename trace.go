@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The steps taken to answer a query, for explaining answers without sending any queries
+type Trace struct {
+	Client    string      `json:"client"`
+	Section   string      `json:"section"`
+	Question  string      `json:"question"`
+	Type      string      `json:"type"`
+	Steps     []TraceStep `json:"steps"`
+	Recurse   bool        `json:"recurse"`
+	Recursers []string    `json:"recursers,omitempty"`
+	Upstream  []string    `json:"upstream,omitempty"` // CNAME targets that would be resolved by the recursers
+}
+
+type TraceStep struct {
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+}
+
+// Adds a step. Tracing is optional, so this does nothing on a nil trace.
+func (t *Trace) add(step string, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{Step: step, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (t *Trace) lookup(qtype uint16, section string, fqdn string, suffix string, records []dns.RR) {
+	if t == nil {
+		return
+	}
+	detail := fmt.Sprintf("%s %s in section %s", dns.Type(qtype).String(), fqdn, section)
+	if suffix != "" {
+		detail += fmt.Sprintf(" (search suffix %s)", suffix)
+	}
+	if len(records) > 0 {
+		detail += fmt.Sprintf(": %d record(s)", len(records))
+	} else {
+		detail += ": no match"
+	}
+	t.add("lookup", "%s", detail)
+}
+
+// Works out the response to a query with the steps route takes, but without sending, caching or rate
+// limiting anything. The response is nil when it would come from the recursers or a response
+// policy. Caches are only consulted on a running server. The section is that of a client UUID, and
+// when empty it's picked from the query name and clientIp, like for queries.
+func (s *Snapshot) Explain(clientIp string, section string, name string, qtype uint16) (*dns.Msg, *Trace) {
+	fqdn := strings.ToLower(dns.Fqdn(name))
+	req := new(dns.Msg)
+	req.SetQuestion(fqdn, qtype)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+
+	clientUUID := getClientUUID(clientIp, fqdn)
+	t := &Trace{Client: clientIp, Question: fqdn, Type: dns.Type(qtype).String()}
+	if clientUUID != clientIp {
+		t.add("section", "client UUID %s taken from the query name", clientUUID)
+	} else if section != "" {
+		clientUUID = section
+		t.add("section", "client UUID %s given", clientUUID)
+	} else {
+		t.add("section", "no client UUID in the query name")
+	}
+	t.Section = clientUUID
+	if _, ok := s.Answers[clientUUID]; ok {
+		t.add("section", "using section %s, then %s", clientUUID, DEFAULT_KEY)
+	} else {
+		t.add("section", "no section for %s, using %s", clientUUID, DEFAULT_KEY)
+	}
+	lookupFqdn := formatFqdn(clientUUID, fqdn)
+	if lookupFqdn != fqdn {
+		t.add("fqdn", "rewrote %s to %s", fqdn, lookupFqdn)
+	} else {
+		t.add("fqdn", "looking up %s", lookupFqdn)
+	}
+
+	d := s.decide(&query{req: req, clientIp: clientIp, clientUUID: clientUUID, fqdn: fqdn, trace: t}, m)
+	switch d.action {
+	case DECISION_CLIENT_CACHE, DECISION_GLOBAL_CACHE:
+		return d.msg, t
+	case DECISION_POLICY:
+		return nil, t
+	case DECISION_RECURSE:
+		t.Recurse = true
+		t.Recursers = s.Recursers(clientUUID)
+		t.add("recurse", "not found locally, would recurse to %s", strings.Join(t.Recursers, ", "))
+		return nil, t
+	}
+	return m, t
+}
+
+// JSON form of an explained query
+type Explanation struct {
+	*Trace
+	Response *ExplainedResponse `json:"response,omitempty"`
+}
+
+type ExplainedResponse struct {
+	Rcode      string   `json:"rcode"`
+	Answer     []string `json:"answer"`
+	Authority  []string `json:"authority,omitempty"`
+	Additional []string `json:"additional,omitempty"`
+}
+
+// The whole seconds until t
+func untilSecond(t time.Time) time.Duration {
+	return time.Until(t) / time.Second * time.Second
+}
+
+func NewExplanation(msg *dns.Msg, trace *Trace) Explanation {
+	e := Explanation{Trace: trace}
+	if msg == nil {
+		return e
+	}
+	e.Response = &ExplainedResponse{Rcode: dns.RcodeToString[msg.Rcode], Answer: []string{}}
+	for _, rr := range msg.Answer {
+		e.Response.Answer = append(e.Response.Answer, rr.String())
+	}
+	for _, rr := range msg.Ns {
+		e.Response.Authority = append(e.Response.Authority, rr.String())
+	}
+	for _, rr := range msg.Extra {
+		e.Response.Additional = append(e.Response.Additional, rr.String())
+	}
+	return e
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestExplain(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse:       []string{"8.8.8.8"},
+			Authoritative: []string{"example.com."},
+			A: map[string]RecordA{
+				"db.discover.internal.": {Answer: []string{"10.1.2.3"}},
+			},
+		},
+		"10.42.1.5": ClientAnswers{
+			Search: []string{"discover.internal."},
+			Cname: map[string]RecordCname{
+				"www.": {Answer: "web."},
+				"ext.": {Answer: "example.org."},
+			},
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.1.2.4"}},
+			},
+		},
+	}
+
+	msg, trace := unindexed(answers).Explain("10.42.1.5", "", "WWW", dns.TypeA)
+	if msg == nil || len(msg.Answer) != 2 || trace.Recurse {
+		t.Fatalf("Expected a local CNAME answer [%v] %v", msg, trace.Steps)
+	}
+	if !hasStep(trace, "cname", "www. -> web.") {
+		t.Fatalf("Expected the CNAME hop in the trace %v", trace.Steps)
+	}
+
+	msg, trace = unindexed(answers).Explain("10.42.1.5", "", "db.", dns.TypeA)
+	if msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("Expected an answer through the search suffix [%v]", msg)
+	}
+	if !hasStep(trace, "lookup", "(search suffix discover.internal.): 1 record(s)") {
+		t.Fatalf("Expected the search suffix in the trace %v", trace.Steps)
+	}
+
+	msg, trace = unindexed(answers).Explain("10.42.1.5", "", "ext.", dns.TypeA)
+	if msg != nil || len(trace.Upstream) != 1 || trace.Upstream[0] != "example.org." || !trace.Recurse {
+		t.Fatalf("Expected the CNAME target to need the recursers [%v] %v", msg, trace)
+	}
+
+	msg, trace = unindexed(answers).Explain("10.42.1.6", "", "nope.example.com.", dns.TypeA)
+	if msg == nil || msg.Rcode != dns.RcodeNameError || trace.Recurse {
+		t.Fatalf("Expected NXDOMAIN in an authoritative zone [%v]", msg)
+	}
+
+	_, trace = unindexed(answers).Explain("10.42.1.6", "", "google.com.", dns.TypeMX)
+	if !trace.Recurse || len(trace.Recursers) != 1 || !hasStep(trace, "section", "no section for 10.42.1.6") {
+		t.Fatalf("Expected recursion [%v]", trace)
+	}
+
+	// ANY is answered like route does, without recursing
+	msg, trace = unindexed(answers).Explain("10.42.1.6", "", "google.com.", dns.TypeANY)
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].Header().Rrtype != dns.TypeHINFO || trace.Recurse {
+		t.Fatalf("Expected HINFO for ANY [%v] %v", msg, trace.Steps)
+	}
+	msg, trace = unindexed(answers).Explain("10.42.1.6", "", "nope.example.com.", dns.TypeANY)
+	if msg == nil || msg.Rcode != dns.RcodeNameError || trace.Recurse {
+		t.Fatalf("Expected NXDOMAIN for ANY in an authoritative zone [%v]", msg)
+	}
+
+	var out bytes.Buffer
+	msg, trace = unindexed(answers).Explain("10.42.1.5", "", "web.", dns.TypeA)
+	printExplanation(&out, msg, trace)
+	if !strings.Contains(out.String(), ";; ANSWER SECTION:") || !strings.Contains(out.String(), "10.1.2.4") {
+		t.Fatalf("Expected dig-style output:\n%s", out.String())
+	}
+}
+
+func TestHttpExplain(t *testing.T) {
+	oldSnapshot, oldGlobal, oldClients := loadSnapshot(), globalCache, clientSpecificCaches
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		globalCache, clientSpecificCaches = oldGlobal, oldClients
+	}()
+	a := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{"web.": {Answer: []string{"10.1.2.4"}}},
+		},
+	}
+	storeSnapshot(&Snapshot{Answers: a, Base: a})
+	globalCache = cache.New(10, 60)
+	clientSpecificCaches = make(map[string]*cache.Cache)
+
+	// Answered locally, then from the client cache
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	for i, status := range []string{"not in the client cache", "client cache hit"} {
+		w := httptest.NewRecorder()
+		httpExplain(w, httptest.NewRequest("GET", "/v1/explain?client=10.42.1.5&name=web&type=a", nil))
+		if w.Code != 200 {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var e struct {
+			Section  string
+			Steps    []TraceStep
+			Response *ExplainedResponse
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Section != "10.42.1.5" || e.Response == nil || len(e.Response.Answer) != 1 || e.Response.Rcode != "NOERROR" {
+			t.Fatalf("Unexpected explanation %d: %s", i, w.Body.String())
+		}
+		if !hasStep(&Trace{Steps: e.Steps}, "cache", status) {
+			t.Fatalf("Expected %q: %s", status, w.Body.String())
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer, _ = unindexed(a).Addresses("10.42.1.5", "web.", "web.", nil, 1)
+		addToClientSpecificCache("10.42.1.5", req, m)
+	}
+
+	// A client UUID picks the section, while the ACLs are those of the caller. Explaining a negative
+	// answer doesn't change the serial of the generated SOA.
+	a = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			AllowQuery:    []string{"192.0.2.0/24"},
+			Authoritative: []string{"lab.example."},
+		},
+		"1a2b3c4d-5e6": ClientAnswers{
+			A: map[string]RecordA{"web.": {Answer: []string{"10.1.2.5"}}},
+		},
+	}
+	storeSnapshot(&Snapshot{Answers: a, Base: a})
+	clientSpecificCaches = make(map[string]*cache.Cache)
+	before := atomic.LoadUint32(&serial)
+	for _, query := range []string{"name=web&type=a", "name=nope.lab.example&type=a"} {
+		w := httptest.NewRecorder()
+		httpExplain(w, httptest.NewRequest("GET", "/v1/explain?client=1a2b3c4d-5e6&"+query, nil))
+		var e Explanation
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Section != "1a2b3c4d-5e6" || e.Response == nil || e.Response.Rcode == "REFUSED" {
+			t.Fatalf("Unexpected explanation of %s: %s", query, w.Body.String())
+		}
+	}
+	if after := atomic.LoadUint32(&serial); after != before {
+		t.Fatalf("Expected explaining to leave the serial at %d, got %d", before, after)
+	}
+
+	w := httptest.NewRecorder()
+	httpExplain(w, httptest.NewRequest("GET", "/v1/explain?name=web&type=bogus", nil))
+	if w.Code != 400 {
+		t.Fatalf("Expected a bad request for an unknown type, got %d", w.Code)
+	}
+}
+
+func hasStep(trace *Trace, step string, detail string) bool {
+	for _, s := range trace.Steps {
+		if s.Step == step && strings.Contains(s.Detail, detail) {
+			return true
+		}
+	}
+	return false
+}
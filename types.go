@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 type RecordA struct {
 	Ttl    *uint32  `json:"-"`
 	Answer []string `json:"answer"`
@@ -16,18 +18,81 @@ type RecordPtr struct {
 }
 
 type RecordTxt struct {
-	Ttl    *uint32  `json:"-"`
-	Answer []string `json:"answer"`
+	Ttl    *uint32         `json:"-"`
+	Answer []AnswerStrings `json:"answer"`
+}
+
+// The strings of one answer: a single value, or the character strings of a TXT record. Written
+// as a plain string when there is just one.
+type AnswerStrings []string
+
+func (a *AnswerStrings) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = AnswerStrings{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a AnswerStrings) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *AnswerStrings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*a = AnswerStrings{s}
+		return nil
+	}
+	return unmarshal((*[]string)(a))
+}
+
+func (a AnswerStrings) MarshalYAML() (interface{}, error) {
+	if len(a) == 1 {
+		return a[0], nil
+	}
+	return []string(a), nil
+}
+
+type SrvTarget struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+type RecordSrv struct {
+	Ttl    *uint32     `json:"-"`
+	Answer []SrvTarget `json:"answer"`
+}
+
+// Response rate limits, unset values fall back to the default section and then the flags
+type RateLimit struct {
+	Client *uint `json:"client"` // responses per second per client
+	Name   *uint `json:"name"`   // responses per second per client for a single name
+	Slip   *uint `json:"slip"`   // every slip-th limited response is sent truncated
 }
 
 type ClientAnswers struct {
-	Search        []string               `json:"search"`
-	Recurse       []string               `json:"recurse"`
-	Authoritative []string               `json:"authorative"`
-	A             map[string]RecordA     `json:"a"`
-	Cname         map[string]RecordCname `json:"cname"`
-	Ptr           map[string]RecordPtr   `json:"-"`
-	Txt           map[string]RecordTxt   `json:"-"`
+	Search         []string               `json:"search"`
+	Recurse        []string               `json:"recurse"`
+	Authoritative  []string               `json:"authorative"`
+	RateLimit      *RateLimit             `json:"ratelimit,omitempty"`
+	AllowQuery     []string               `json:"allow-query,omitempty" yaml:"allow-query"`
+	AllowRecursion []string               `json:"allow-recursion,omitempty" yaml:"allow-recursion"`
+	A              map[string]RecordA     `json:"a"`
+	Aaaa           map[string]RecordA     `json:"aaaa,omitempty"`
+	Cname          map[string]RecordCname `json:"cname"`
+	Ptr            map[string]RecordPtr   `json:"-"`
+	Txt            map[string]RecordTxt   `json:"-"`
+	Srv            map[string]RecordSrv   `json:"srv,omitempty"`
+	Hosts          []HostsFile            `json:"hosts,omitempty"`
+	Zones          []ZoneFile             `json:"zones,omitempty"`
+	Soa            map[string]RecordSoa   `json:"soa,omitempty"`
 }
 
 type Answers map[string]ClientAnswers
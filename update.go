@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Record types that can be changed by UPDATE, the ones the answers can hold
+var updateTypes = []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypePTR, dns.TypeTXT}
+
+// Updates are applied one at a time, so that prerequisites are checked against the data they change
+var updateMutex sync.Mutex
+
+// Parses TSIG keys given as [algorithm:]name:secret, the format of dig -y. The algorithm defaults
+// to hmac-sha256. Returns secrets and algorithms by key name.
+func parseTsigKeys(specs []string) (map[string]string, map[string]string, error) {
+	secrets := make(map[string]string)
+	algorithms := make(map[string]string)
+	for _, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		algorithm := dns.HmacSHA256
+		switch len(parts) {
+		case 2:
+		case 3:
+			algorithm = dns.Fqdn(strings.ToLower(parts[0]))
+			parts = parts[1:]
+		default:
+			return nil, nil, fmt.Errorf("Invalid TSIG key %s, expected [algorithm:]name:secret", spec)
+		}
+		switch algorithm {
+		case dns.HmacMD5, dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+		default:
+			return nil, nil, fmt.Errorf("Unsupported TSIG algorithm %s", algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, fmt.Errorf("Invalid secret for TSIG key %s: %v", parts[0], err)
+		}
+		name := strings.ToLower(dns.Fqdn(parts[0]))
+		secrets[name] = parts[1]
+		algorithms[name] = algorithm
+	}
+	return secrets, algorithms, nil
+}
+
+// Handles an RFC 2136 UPDATE for one of the zones we are authoritative for. Updates must be signed
+// with one of the configured TSIG keys, and the changes land in the dynamic records.
+func handleUpdate(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Opcode = dns.OpcodeUpdate
+
+	updateMutex.Lock()
+	m.Rcode = processUpdate(w, req)
+	updateMutex.Unlock()
+
+	// Sign the response with the key of the request, when it was valid. NOTAUTH responses go
+	// unsigned, signed ones are rejected by the dns package's client.
+	if t := req.IsTsig(); t != nil && w.TsigStatus() == nil && m.Rcode != dns.RcodeNotAuth {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+func processUpdate(w dns.ResponseWriter, req *dns.Msg) int {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zone := strings.ToLower(req.Question[0].Name)
+	fields := log.Fields{"zone": zone, "client": w.RemoteAddr().String()}
+
+	if len(tsigAlgorithms) == 0 {
+		log.WithFields(fields).Info("Refused update, no TSIG keys configured")
+		return dns.RcodeRefused
+	}
+	t := req.IsTsig()
+	if t == nil || w.TsigStatus() != nil || tsigAlgorithms[strings.ToLower(t.Hdr.Name)] != strings.ToLower(t.Algorithm) {
+		log.WithFields(fields).Warn("Refused update without a valid TSIG signature: ", w.TsigStatus())
+		return dns.RcodeNotAuth
+	}
+	fields["key"] = t.Hdr.Name
+
+	// Updates are serialized, so the snapshot stays current until this one is applied
+	current := snapshot()
+	if !current.IsAuthoritativeZone(zone) {
+		log.WithFields(fields).Info("Refused update for a zone we are not authoritative for")
+		return dns.RcodeNotAuth
+	}
+
+	u := newZoneUpdate(zone, current)
+	if rcode := u.checkPrerequisites(req.Answer); rcode != dns.RcodeSuccess {
+		log.WithFields(fields).Info("Update prerequisites not met: ", dns.RcodeToString[rcode])
+		return rcode
+	}
+	if rcode := u.prescan(req.Ns); rcode != dns.RcodeSuccess {
+		log.WithFields(fields).Info("Rejected update: ", dns.RcodeToString[rcode])
+		return rcode
+	}
+	for _, rr := range req.Ns {
+		u.apply(rr)
+	}
+
+	set, remove := u.changes()
+	if len(set) == 0 && len(remove) == 0 {
+		log.WithFields(fields).Debug("Update changed nothing")
+		return dns.RcodeSuccess
+	}
+
+	var baseSerial uint32
+	if rec, ok := current.Base[DEFAULT_KEY].Soa[zone]; ok {
+		baseSerial = rec.Serial
+	}
+	serial, err := dynamicRecords.Apply(set, remove, zone, baseSerial)
+	if err != nil {
+		log.WithFields(fields).Errorf("Failed to save update: %v", err)
+		return dns.RcodeServerFailure
+	}
+	mergeDynamicRecords()
+	// Cached answers of the zone may have come from the recursers before the names existed
+	clearGlobalCache()
+
+	fields["serial"] = serial
+	log.WithFields(fields).Infof("Updated %d RRsets", len(set)+len(remove))
+	return dns.RcodeSuccess
+}
+
+// Whether zone is exactly one of the zones we are authoritative for
+func (s *Snapshot) IsAuthoritativeZone(zone string) bool {
+	for _, suffix := range s.AuthoritativeSuffixes() {
+		if "."+strings.ToLower(zone) == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// The RRsets of a zone as an update changes them
+type zoneUpdate struct {
+	zone    string
+	current *Snapshot
+	rrsets  map[string]*DynamicRecord
+	changed map[string]bool
+}
+
+func newZoneUpdate(zone string, current *Snapshot) *zoneUpdate {
+	return &zoneUpdate{zone: zone, current: current, rrsets: make(map[string]*DynamicRecord), changed: make(map[string]bool)}
+}
+
+// The current RRset, from the answers unless the update already changed it
+func (u *zoneUpdate) rrset(name string, rrtype uint16) *DynamicRecord {
+	name = strings.ToLower(name)
+	key := rrsetKey(name, rrtype)
+	if r, ok := u.rrsets[key]; ok {
+		return r
+	}
+
+	r := &DynamicRecord{Client: DEFAULT_KEY, Type: dns.Type(rrtype).String(), Name: name}
+	records, _ := u.current.MatchingExact(rrtype, DEFAULT_KEY, name, name)
+	for _, rr := range records {
+		ttl := rr.Header().Ttl
+		r.Ttl = &ttl
+		r.Answer = append(r.Answer, rdata(rr))
+	}
+	u.rrsets[key] = r
+	return r
+}
+
+func (u *zoneUpdate) exists(name string, rrtype uint16) bool {
+	return len(u.rrset(name, rrtype).Answer) > 0
+}
+
+func (u *zoneUpdate) nameInUse(name string) bool {
+	for _, rrtype := range updateTypes {
+		if u.exists(name, rrtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// The data of a record, the way the answers hold it. TXT records keep their strings as they are.
+func rdata(rr dns.RR) AnswerStrings {
+	switch t := rr.(type) {
+	case *dns.A:
+		return AnswerStrings{t.A.String()}
+	case *dns.AAAA:
+		return AnswerStrings{t.AAAA.String()}
+	case *dns.CNAME:
+		return AnswerStrings{strings.ToLower(t.Target)}
+	case *dns.PTR:
+		return AnswerStrings{strings.ToLower(t.Ptr)}
+	case *dns.TXT:
+		return append(AnswerStrings(nil), t.Txt...)
+	}
+	return AnswerStrings{""}
+}
+
+func supportedUpdateType(rrtype uint16) bool {
+	for _, t := range updateTypes {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the prerequisite section (RFC 2136 section 3.2)
+func (u *zoneUpdate) checkPrerequisites(prereqs []dns.RR) int {
+	// Value dependent prerequisites are compared by whole RRset
+	expected := make(map[string]answerList)
+	expectedRRsets := make(map[string]dns.RR_Header)
+	for _, rr := range prereqs {
+		hdr := rr.Header()
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(u.zone, strings.ToLower(hdr.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassANY:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if !u.nameInUse(hdr.Name) {
+					return dns.RcodeNameError
+				}
+			} else if !u.exists(hdr.Name, hdr.Rrtype) {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			if hdr.Rrtype == dns.TypeANY {
+				if u.nameInUse(hdr.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if u.exists(hdr.Name, hdr.Rrtype) {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := rrsetKey(hdr.Name, hdr.Rrtype)
+			expected[key] = append(expected[key], rdata(rr))
+			expectedRRsets[key] = *hdr
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, want := range expected {
+		hdr := expectedRRsets[key]
+		if !sameAnswers(want, u.rrset(hdr.Name, hdr.Rrtype).Answer) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Whether two RRsets have the same answers, in any order
+func sameAnswers(a answerList, b answerList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, answer := range a {
+		counts[answerKey(answer)]++
+	}
+	for _, answer := range b {
+		key := answerKey(answer)
+		if counts[key] == 0 {
+			return false
+		}
+		counts[key]--
+	}
+	return true
+}
+
+// Compares answers by all their strings and where each one ends
+func answerKey(answer AnswerStrings) string {
+	return fmt.Sprintf("%q", []string(answer))
+}
+
+// Checks the update section before anything is changed (RFC 2136 section 3.4.1)
+func (u *zoneUpdate) prescan(updates []dns.RR) int {
+	for _, rr := range updates {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(u.zone, strings.ToLower(hdr.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch hdr.Class {
+		case dns.ClassINET:
+			if !supportedUpdateType(hdr.Rrtype) {
+				// The zone's SOA and NS records are not ours to change, nor are other types the answers can't hold
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if hdr.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// Applies one record of the update section (RFC 2136 section 3.4.2)
+func (u *zoneUpdate) apply(rr dns.RR) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+
+	switch hdr.Class {
+	case dns.ClassINET:
+		// A CNAME can't coexist with other data
+		if hdr.Rrtype == dns.TypeCNAME {
+			for _, rrtype := range updateTypes {
+				if rrtype != dns.TypeCNAME && u.exists(name, rrtype) {
+					return
+				}
+			}
+		} else if u.exists(name, dns.TypeCNAME) {
+			return
+		}
+
+		r := u.rrset(name, hdr.Rrtype)
+		data := rdata(rr)
+		if hdr.Rrtype == dns.TypeCNAME || hdr.Rrtype == dns.TypePTR {
+			r.Answer = answerList{data}
+		} else if !containsAnswer(r.Answer, data) {
+			r.Answer = append(r.Answer, data)
+		}
+		ttl := hdr.Ttl
+		r.Ttl = &ttl
+		u.changed[rrsetKey(name, hdr.Rrtype)] = true
+
+	case dns.ClassANY:
+		rrtypes := []uint16{hdr.Rrtype}
+		if hdr.Rrtype == dns.TypeANY {
+			rrtypes = updateTypes
+		}
+		for _, rrtype := range rrtypes {
+			if u.exists(name, rrtype) {
+				u.rrset(name, rrtype).Answer = nil
+				u.changed[rrsetKey(name, rrtype)] = true
+			}
+		}
+
+	case dns.ClassNONE:
+		r := u.rrset(name, hdr.Rrtype)
+		data := rdata(rr)
+		for i, answer := range r.Answer {
+			if answerKey(answer) == answerKey(data) {
+				r.Answer = append(r.Answer[:i:i], r.Answer[i+1:]...)
+				u.changed[rrsetKey(name, hdr.Rrtype)] = true
+				break
+			}
+		}
+	}
+}
+
+func containsAnswer(list answerList, answer AnswerStrings) bool {
+	for _, item := range list {
+		if answerKey(item) == answerKey(answer) {
+			return true
+		}
+	}
+	return false
+}
+
+// The dynamic records to set and remove for the changed RRsets. Deleted RRsets that the answers
+// file doesn't have are removed rather than hidden.
+func (u *zoneUpdate) changes() (set []DynamicRecord, remove []DynamicRecord) {
+	keys := make([]string, 0, len(u.changed))
+	for key := range u.changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		r := *u.rrsets[key]
+		if len(r.Answer) == 0 {
+			rrtype := dns.StringToType[r.Type]
+			if _, ok := unindexed(u.current.Base).MatchingExact(rrtype, DEFAULT_KEY, r.Name, r.Name); !ok {
+				remove = append(remove, r)
+				continue
+			}
+		}
+		set = append(set, r)
+	}
+	return set, remove
+}
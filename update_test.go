@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDynamicUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldSnapshot, oldDynamic, oldClients := loadSnapshot(), dynamicRecords, clientSpecificCaches
+	oldSecrets, oldAlgorithms := tsigSecrets, tsigAlgorithms
+	defer func() {
+		storeSnapshot(oldSnapshot)
+		dynamicRecords, clientSpecificCaches = oldDynamic, oldClients
+		tsigSecrets, tsigAlgorithms = oldSecrets, oldAlgorithms
+	}()
+
+	if tsigSecrets, tsigAlgorithms, err = parseTsigKeys([]string{"ddns-key:c2VjcmV0LXNlY3JldA=="}); err != nil {
+		t.Fatal(err)
+	}
+	if dynamicRecords, err = LoadDynamicRecords(filepath.Join(dir, "dynamic.json")); err != nil {
+		t.Fatal(err)
+	}
+	setAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Authoritative: []string{"lab.example."},
+			A:             map[string]RecordA{"web.lab.example.": {Answer: []string{"10.1.0.1"}}},
+			Soa:           map[string]RecordSoa{"lab.example.": {Ns: "ns.lab.example.", Mbox: "admin.lab.example.", Serial: 7}},
+		},
+	}, "test")
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(handleUpdate), TsigSecret: tsigSecrets, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	client := &dns.Client{TsigSecret: tsigSecrets}
+	send := func(m *dns.Msg, sign bool) int {
+		m = m.Copy()
+		if sign {
+			m.SetTsig("ddns-key.", dns.HmacSHA256, 300, time.Now().Unix())
+		}
+		r, _, err := client.Exchange(m, pc.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Opcode != dns.OpcodeUpdate {
+			t.Fatalf("Expected an UPDATE response, got opcode %d", r.Opcode)
+		}
+		return r.Rcode
+	}
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate("lab.example.")
+	m.Insert([]dns.RR{rr("db.lab.example. 60 IN A 10.1.0.9")})
+	if rcode := send(m, false); rcode != dns.RcodeNotAuth {
+		t.Fatalf("Expected an unsigned update to be refused, got %s", dns.RcodeToString[rcode])
+	}
+	if _, ok := snapshot().MatchingExact(dns.TypeA, DEFAULT_KEY, "db.lab.example.", "db.lab.example."); ok {
+		t.Fatal("Unsigned update should not have been applied")
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate("other.example.")
+	m.Insert([]dns.RR{rr("db.other.example. 60 IN A 10.1.0.9")})
+	if rcode := send(m, true); rcode != dns.RcodeNotAuth {
+		t.Fatalf("Expected an update for a zone we are not authoritative for to be refused, got %s", dns.RcodeToString[rcode])
+	}
+
+	// Add only if the name is not in use yet
+	m = new(dns.Msg)
+	m.SetUpdate("lab.example.")
+	m.NameNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "db.lab.example."}}})
+	m.Insert([]dns.RR{rr("db.lab.example. 60 IN A 10.1.0.9"), rr("db.lab.example. 60 IN A 10.1.0.10"), rr("db.lab.example. 60 IN TXT \"role=primary\"")})
+	if rcode := send(m, true); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeA, DEFAULT_KEY, "db.lab.example.", "db.lab.example."); !ok || len(records) != 2 || records[0].Header().Ttl != 60 {
+		t.Fatalf("Expected the added A records [%v]", records)
+	}
+	if soa := snapshot().Answers.SOA(DEFAULT_KEY, "lab.example."); soa.Serial != 8 || soa.Ns != "ns.lab.example." {
+		t.Fatalf("Expected the serial to be bumped [%v]", soa)
+	}
+	if rcode := send(m, true); rcode != dns.RcodeYXDomain {
+		t.Fatalf("Expected the prerequisite to fail, got %s", dns.RcodeToString[rcode])
+	}
+
+	// Remove a single record and replace the RRset of the answers file
+	m = new(dns.Msg)
+	m.SetUpdate("lab.example.")
+	m.Used([]dns.RR{rr("web.lab.example. 0 IN A 10.1.0.1")})
+	// The dns package's Remove and Insert each replace the update section
+	m.Ns = []dns.RR{
+		rr("db.lab.example. 0 NONE A 10.1.0.9"),
+		&dns.ANY{Hdr: dns.RR_Header{Name: "web.lab.example.", Rrtype: dns.TypeA, Class: dns.ClassANY}},
+		rr("web.lab.example. 30 IN CNAME db.lab.example."),
+	}
+	if rcode := send(m, true); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeA, DEFAULT_KEY, "db.lab.example.", "db.lab.example."); !ok || len(records) != 1 || records[0].(*dns.A).A.String() != "10.1.0.10" {
+		t.Fatalf("Expected a single A record left [%v]", records)
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeA, DEFAULT_KEY, "web.lab.example.", "web.lab.example."); ok {
+		t.Fatalf("Expected the A records of the answers file to be deleted [%v]", records)
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeCNAME, DEFAULT_KEY, "web.lab.example.", "web.lab.example."); !ok || records[0].(*dns.CNAME).Target != "db.lab.example." {
+		t.Fatalf("Expected the added CNAME [%v]", records)
+	}
+	if soa := snapshot().Answers.SOA(DEFAULT_KEY, "lab.example."); soa.Serial != 9 {
+		t.Fatalf("Expected the serial to be bumped [%v]", soa)
+	}
+	if _, ok := snapshot().Base[DEFAULT_KEY].A["web.lab.example."]; !ok {
+		t.Fatal("The base answers should be left alone")
+	}
+
+	// Value dependent prerequisite no longer holds
+	if rcode := send(m, true); rcode != dns.RcodeNXRrset {
+		t.Fatalf("Expected the prerequisite to fail, got %s", dns.RcodeToString[rcode])
+	}
+
+	// TXT records keep their strings
+	m = new(dns.Msg)
+	m.SetUpdate("lab.example.")
+	m.Insert([]dns.RR{rr("dkim.lab.example. 60 IN TXT \"v=DKIM1; \" \"p=abc\"")})
+	if rcode := send(m, true); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeTXT, DEFAULT_KEY, "dkim.lab.example.", "dkim.lab.example."); !ok || len(records) != 1 || len(records[0].(*dns.TXT).Txt) != 2 {
+		t.Fatalf("Expected a TXT record with two strings [%v]", records)
+	}
+	m = new(dns.Msg)
+	m.SetUpdate("lab.example.")
+	m.Used([]dns.RR{rr("dkim.lab.example. 0 IN TXT \"v=DKIM1; p=abc\"")})
+	m.Remove([]dns.RR{rr("dkim.lab.example. 0 IN TXT \"v=DKIM1; \" \"p=abc\"")})
+	if rcode := send(m, true); rcode != dns.RcodeNXRrset {
+		t.Fatalf("Expected a single string not to match two, got %s", dns.RcodeToString[rcode])
+	}
+	m.Used([]dns.RR{rr("dkim.lab.example. 0 IN TXT \"v=DKIM1; \" \"p=abc\"")})
+	m.Remove([]dns.RR{rr("dkim.lab.example. 0 IN TXT \"v=DKIM1; \" \"p=abc\"")})
+	if rcode := send(m, true); rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", dns.RcodeToString[rcode])
+	}
+	if records, ok := snapshot().MatchingExact(dns.TypeTXT, DEFAULT_KEY, "dkim.lab.example.", "dkim.lab.example."); ok {
+		t.Fatalf("Expected the TXT record to be removed [%v]", records)
+	}
+
+	// The changes are persistent
+	reloaded, err := LoadDynamicRecords(filepath.Join(dir, "dynamic.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := reloaded.Merge(snapshot().Base)
+	if _, ok := merged[DEFAULT_KEY].A["web.lab.example."]; ok {
+		t.Fatal("Expected the deletion to be persisted")
+	}
+	if soa := merged.SOA(DEFAULT_KEY, "lab.example."); soa.Serial != 11 {
+		t.Fatalf("Expected the serial to be persisted [%v]", soa)
+	}
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+// The root zone KSK-2017 trust anchor, used when no --trust-anchor file is given
+const ROOT_TRUST_ANCHOR = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// Results of validating a response
+const (
+	VALIDATION_INSECURE = iota
+	VALIDATION_SECURE
+	VALIDATION_BOGUS
+)
+
+var (
+	errInsecure     = errors.New("no chain of trust")
+	errBogus        = errors.New("chain of trust does not validate")
+	errNoDelegation = errors.New("not a zone cut")
+)
+
+// Validates recursive answers against a set of trust anchors, chasing DS and DNSKEY records
+// through the recursive servers.
+type Validator struct {
+	anchors  map[string][]*dns.DS
+	keys     *cache.Cache
+	exchange func(req *dns.Msg, resolvers []string) (*dns.Msg, error)
+}
+
+func NewValidator(anchors []dns.RR) *Validator {
+	v := &Validator{
+		anchors:  make(map[string][]*dns.DS),
+		keys:     cache.New(int(*cacheCapacity), int(*defaultTtl)),
+		exchange: ResolveTryAll,
+	}
+
+	for _, rr := range anchors {
+		var ds *dns.DS
+		switch t := rr.(type) {
+		case *dns.DS:
+			ds = t
+		case *dns.DNSKEY:
+			ds = t.ToDS(dns.SHA256)
+		}
+		if ds != nil {
+			zone := strings.ToLower(dns.Fqdn(ds.Hdr.Name))
+			v.anchors[zone] = append(v.anchors[zone], ds)
+		}
+	}
+
+	return v
+}
+
+// Reads trust anchors (DS or DNSKEY records) from a zone-format file, or the root
+// trust anchor if path is empty.
+func LoadTrustAnchors(path string) ([]dns.RR, error) {
+	if path == "" {
+		rr, err := dns.NewRR(ROOT_TRUST_ANCHOR)
+		return []dns.RR{rr}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var anchors []dns.RR
+	for t := range dns.ParseZone(f, ".", path) {
+		if t.Error != nil {
+			return nil, t.Error
+		}
+		anchors = append(anchors, t.RR)
+	}
+	return anchors, nil
+}
+
+// Whether answers for req should be validated
+func validating(req *dns.Msg) bool {
+	return validator != nil && !req.CheckingDisabled
+}
+
+// Validates every RRset in the answer and authority sections of msg. Unsigned RRsets make the
+// response insecure if they are proven to be outside of any signed zone, and bogus otherwise (a
+// forwarder that strips signatures must not turn secure answers into insecure ones); signatures
+// that don't chain up to a trust anchor make it bogus. NXDOMAIN and NODATA answers for names in
+// signed zones are bogus unless validated NSEC or NSEC3 records prove them.
+func (v *Validator) Validate(msg *dns.Msg, resolvers []string) int {
+	insecure, validated := false, false
+	proofs := &denial{}
+	for i, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		rrsets, sigs := splitRRsets(section)
+		for _, rrset := range rrsets {
+			hdr := rrset[0].Header()
+			covering := sigs[rrsetKey(hdr.Name, hdr.Rrtype)]
+			if len(covering) == 0 {
+				fields := log.Fields{"name": hdr.Name, "type": dns.Type(hdr.Rrtype).String()}
+				if err := v.insecure(strings.ToLower(dns.Fqdn(hdr.Name)), resolvers); err != nil {
+					log.WithFields(fields).Warn("Bogus RRset: unsigned in a signed zone: ", err)
+					return VALIDATION_BOGUS
+				}
+				log.WithFields(fields).Debug("Unsigned RRset in an unsigned zone")
+				insecure = true
+				continue
+			}
+
+			err := v.verify(rrset, covering, resolvers)
+			if err == errInsecure {
+				insecure = true
+				continue
+			} else if err != nil {
+				log.WithFields(log.Fields{"name": hdr.Name, "type": dns.Type(hdr.Rrtype).String()}).Warn("Bogus RRset: ", err)
+				return VALIDATION_BOGUS
+			}
+			validated = true
+			if i == 1 {
+				proofs.add(rrset)
+			}
+		}
+	}
+
+	name, qtype, negative := negativeAnswer(msg)
+	if !negative {
+		if insecure || !validated {
+			return VALIDATION_INSECURE
+		}
+		return VALIDATION_SECURE
+	}
+
+	// Whatever else the response holds, a denial is only as good as its proof
+	if v.insecure(name, resolvers) == nil {
+		return VALIDATION_INSECURE
+	}
+	result := proofs.deny(name, qtype, msg.Rcode == dns.RcodeNameError)
+	if result == VALIDATION_BOGUS {
+		log.WithFields(log.Fields{"name": name, "type": dns.Type(qtype).String(), "rcode": dns.RcodeToString[msg.Rcode]}).Warn("Bogus denial: no proof from NSEC or NSEC3 records")
+		return result
+	}
+	if insecure {
+		return VALIDATION_INSECURE
+	}
+	return result
+}
+
+// The name and type a response ends up answering, after the CNAMEs in its answer section, and
+// whether it denies that they exist
+func negativeAnswer(msg *dns.Msg) (name string, qtype uint16, negative bool) {
+	if len(msg.Question) == 0 {
+		return "", 0, false
+	}
+	name, qtype = strings.ToLower(msg.Question[0].Name), msg.Question[0].Qtype
+
+	if qtype != dns.TypeCNAME {
+		for range msg.Answer {
+			next := ""
+			for _, rr := range msg.Answer {
+				if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+					next = strings.ToLower(cname.Target)
+				}
+			}
+			if next == "" {
+				break
+			}
+			name = next
+		}
+	}
+
+	switch msg.Rcode {
+	case dns.RcodeNameError:
+		return name, qtype, true
+	case dns.RcodeSuccess:
+		for _, rr := range msg.Answer {
+			hdr := rr.Header()
+			if strings.EqualFold(hdr.Name, name) && (hdr.Rrtype == qtype || qtype == dns.TypeANY) {
+				return name, qtype, false
+			}
+		}
+		return name, qtype, true
+	}
+	return name, qtype, false
+}
+
+// Validated NSEC and NSEC3 records from the authority section of a response
+type denial struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func (d *denial) add(rrset []dns.RR) {
+	for _, rr := range rrset {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			d.nsec = append(d.nsec, t)
+		case *dns.NSEC3:
+			d.nsec3 = append(d.nsec3, t)
+		}
+	}
+}
+
+// Whether the records prove that name doesn't exist (nxdomain), or that it has no records of type
+// qtype: secure if they do, bogus if they don't, and insecure for names in an NSEC3 opt-out range,
+// which may be unsigned delegations.
+func (d *denial) deny(name string, qtype uint16, nxdomain bool) int {
+	if len(d.nsec) > 0 {
+		return d.denyNsec(name, qtype, nxdomain)
+	}
+	if len(d.nsec3) > 0 {
+		return d.denyNsec3(name, qtype, nxdomain)
+	}
+	return VALIDATION_BOGUS
+}
+
+func (d *denial) denyNsec(name string, qtype uint16, nxdomain bool) int {
+	if nsec := d.nsecAt(name); nsec != nil {
+		if !nxdomain && lacksType(nsec.TypeBitMap, qtype) {
+			return VALIDATION_SECURE
+		}
+		return VALIDATION_BOGUS
+	}
+	covering := d.nsecCovering(name)
+	if covering == nil {
+		return VALIDATION_BOGUS
+	}
+	// A name before the next one's ancestors is an empty non-terminal, which exists
+	if next := strings.ToLower(covering.NextDomain); dns.IsSubDomain(name, next) {
+		if nxdomain {
+			return VALIDATION_BOGUS
+		}
+		return VALIDATION_SECURE
+	}
+
+	// The closest encloser is the longest ancestor the name shares with the covering record
+	encloser := dns.CompareDomainName(name, covering.Hdr.Name)
+	if n := dns.CompareDomainName(name, covering.NextDomain); n > encloser {
+		encloser = n
+	}
+	wildcard := wildcardOf(ancestor(name, encloser))
+	if nxdomain {
+		if d.nsecCovering(wildcard) == nil {
+			return VALIDATION_BOGUS
+		}
+		return VALIDATION_SECURE
+	}
+	if nsec := d.nsecAt(wildcard); nsec != nil && lacksType(nsec.TypeBitMap, qtype) {
+		return VALIDATION_SECURE
+	}
+	return VALIDATION_BOGUS
+}
+
+func (d *denial) denyNsec3(name string, qtype uint16, nxdomain bool) int {
+	if nsec3 := d.nsec3At(name); nsec3 != nil {
+		if !nxdomain && lacksType(nsec3.TypeBitMap, qtype) {
+			return VALIDATION_SECURE
+		}
+		return VALIDATION_BOGUS
+	}
+
+	// The closest encloser proof: an ancestor that exists, and its child on the way to name that
+	// doesn't
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := ancestor(name, len(labels)-i)
+		if d.nsec3At(encloser) == nil {
+			continue
+		}
+		covering := d.nsec3Covering(ancestor(name, len(labels)-i+1))
+		if covering == nil {
+			return VALIDATION_BOGUS
+		}
+		if covering.Flags&1 == 1 {
+			return VALIDATION_INSECURE
+		}
+		wildcard := wildcardOf(encloser)
+		if nxdomain && d.nsec3Covering(wildcard) != nil {
+			return VALIDATION_SECURE
+		}
+		if nsec3 := d.nsec3At(wildcard); !nxdomain && nsec3 != nil && lacksType(nsec3.TypeBitMap, qtype) {
+			return VALIDATION_SECURE
+		}
+		return VALIDATION_BOGUS
+	}
+	return VALIDATION_BOGUS
+}
+
+func (d *denial) nsecAt(name string) *dns.NSEC {
+	for _, nsec := range d.nsec {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsecCovering(name string) *dns.NSEC {
+	for _, nsec := range d.nsec {
+		if !strings.EqualFold(nsec.Hdr.Name, name) && nsecCovers(nsec.Hdr.Name, nsec.NextDomain, name) {
+			return nsec
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3At(name string) *dns.NSEC3 {
+	for _, nsec3 := range d.nsec3 {
+		if nsec3Zone(nsec3, name) && nsec3Hash(nsec3) == dns.HashName(name, nsec3.Hash, nsec3.Iterations, nsec3.Salt) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func (d *denial) nsec3Covering(name string) *dns.NSEC3 {
+	for _, nsec3 := range d.nsec3 {
+		if nsec3Zone(nsec3, name) && hashCovers(nsec3Hash(nsec3), strings.ToUpper(nsec3.NextDomain), dns.HashName(name, nsec3.Hash, nsec3.Iterations, nsec3.Salt)) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// Whether name is in the zone of an NSEC3 record, the parent of its owner
+func nsec3Zone(rr *dns.NSEC3, name string) bool {
+	labels := dns.SplitDomainName(rr.Hdr.Name)
+	return len(labels) > 0 && dns.IsSubDomain(dns.Fqdn(strings.Join(labels[1:], ".")), name)
+}
+
+// Whether a type bitmap denies qtype, and a CNAME that would have answered it instead
+func lacksType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype || t == dns.TypeCNAME {
+			return false
+		}
+	}
+	return true
+}
+
+// The ancestor of name with its last n labels
+func ancestor(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// Verifies an RRset with any of its signatures and the validated keys of the signer
+func (v *Validator) verify(rrset []dns.RR, sigs []*dns.RRSIG, resolvers []string) error {
+	err := errBogus
+	for _, sig := range sigs {
+		signer := strings.ToLower(dns.Fqdn(sig.SignerName))
+		if !dns.IsSubDomain(signer, strings.ToLower(rrset[0].Header().Name)) {
+			continue
+		}
+
+		keys, kerr := v.keysFor(signer, resolvers)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		if verifyWith(rrset, sig, keys) {
+			return nil
+		}
+	}
+	return err
+}
+
+func verifyWith(rrset []dns.RR, sig *dns.RRSIG, keys []*dns.DNSKEY) bool {
+	if !sig.ValidityPeriod(time.Now()) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Proves that name is not in a signed zone: walks down from the closest trust anchor, and
+// returns nil once a delegation is proven to have no DS records. Any zone on the way that has
+// validated DS records keeps the chain of trust going, so that unsigned data in it is bogus.
+func (v *Validator) insecure(name string, resolvers []string) error {
+	anchor := ""
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) >= dns.CountLabel(anchor) {
+			anchor = zone
+		}
+	}
+	if anchor == "" {
+		return nil
+	}
+
+	labels := dns.SplitDomainName(name)
+	for n := dns.CountLabel(anchor) + 1; n <= len(labels); n++ {
+		zone := dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+		switch _, err := v.trustedDS(zone, resolvers); err {
+		case errInsecure:
+			return nil
+		case nil, errNoDelegation:
+			// A signed zone, or a name inside its parent: the chain of trust goes on
+		default:
+			return err
+		}
+	}
+	return errBogus
+}
+
+// The validated DNSKEY set of a zone
+func (v *Validator) keysFor(zone string, resolvers []string) ([]*dns.DNSKEY, error) {
+	q := dns.Question{Name: zone, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET}
+	if msg, _ := v.keys.Hit(q, true, false, 0); msg != nil {
+		return dnskeys(msg.Answer), nil
+	}
+
+	ds, err := v.trustedDS(zone, resolvers)
+	if err == errNoDelegation {
+		// Signatures must be made by the keys of a zone
+		return nil, errBogus
+	} else if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, sigs := splitRRsets(resp.Answer)
+	var keySet []dns.RR
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY && strings.ToLower(rrset[0].Header().Name) == zone {
+			keySet = rrset
+		}
+	}
+	keys := dnskeys(keySet)
+
+	// The key set must be signed by a key the parent (or a trust anchor) vouches for
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, d := range ds {
+			if matchesDS(key, d) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+	for _, sig := range sigs[rrsetKey(zone, dns.TypeDNSKEY)] {
+		if verifyWith(keySet, sig, trusted) {
+			log.WithFields(log.Fields{"zone": zone, "keys": len(keys)}).Debug("Validated DNSKEY set")
+			m := &dns.Msg{Answer: keySet}
+			v.keys.InsertMessage(cache.Key(q, true, false), m, time.Duration(keySet[0].Header().Ttl)*time.Second)
+			return keys, nil
+		}
+	}
+
+	return nil, errBogus
+}
+
+// The DS records of a zone, validated by its parent, or by a trust anchor. When there are none,
+// the parent must prove it with a validated NSEC or NSEC3 record: errInsecure means the zone is an
+// unsigned delegation, and errNoDelegation that the name isn't a zone cut at all. Without a proof
+// the DS records may have been stripped, which is bogus.
+func (v *Validator) trustedDS(zone string, resolvers []string) ([]*dns.DS, error) {
+	if ds, ok := v.anchors[zone]; ok {
+		return ds, nil
+	}
+	if zone == "." || !v.underAnchor(zone) {
+		return nil, errInsecure
+	}
+
+	// Validated DS answers and denials are kept like DNSKEY sets
+	q := dns.Question{Name: zone, Qtype: dns.TypeDS, Qclass: dns.ClassINET}
+	if msg, _ := v.keys.Hit(q, true, false, 0); msg != nil {
+		return provenDS(zone, msg)
+	}
+
+	resp, err := v.query(zone, dns.TypeDS, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	validated := new(dns.Msg)
+	rrsets, sigs := splitRRsets(append(append([]dns.RR{}, resp.Answer...), resp.Ns...))
+	for _, rrset := range rrsets {
+		hdr := rrset[0].Header()
+		switch hdr.Rrtype {
+		case dns.TypeDS, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		switch err := v.verify(rrset, sigs[rrsetKey(hdr.Name, hdr.Rrtype)], resolvers); {
+		case err == errInsecure:
+			// The parent itself is unsigned
+			return nil, errInsecure
+		case err != nil && hdr.Rrtype == dns.TypeDS:
+			return nil, err
+		case err == nil && hdr.Rrtype == dns.TypeDS:
+			validated.Answer = append(validated.Answer, rrset...)
+		case err == nil:
+			validated.Ns = append(validated.Ns, rrset...)
+		}
+	}
+
+	ds, err := provenDS(zone, validated)
+	if err != errBogus {
+		ttl := uint32(*defaultTtl)
+		for _, rr := range append(validated.Answer, validated.Ns...) {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		v.keys.InsertMessage(cache.Key(q, true, false), validated, time.Duration(ttl)*time.Second)
+	}
+	return ds, err
+}
+
+// What a validated DS response for zone proves: its DS records, that it is an unsigned delegation
+// (errInsecure), that it isn't a delegation (errNoDelegation), or nothing (errBogus)
+func provenDS(zone string, msg *dns.Msg) ([]*dns.DS, error) {
+	var ds []*dns.DS
+	for _, rr := range msg.Answer {
+		if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) > 0 {
+		return ds, nil
+	}
+
+	for _, rr := range msg.Ns {
+		switch t := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(t.Hdr.Name, zone) {
+				return denialOfDS(t.TypeBitMap)
+			}
+			if nsecCovers(t.Hdr.Name, t.NextDomain, zone) {
+				return nil, errNoDelegation
+			}
+		case *dns.NSEC3:
+			hash, zoneHash := nsec3Hash(t), dns.HashName(zone, t.Hash, t.Iterations, t.Salt)
+			if hash == zoneHash {
+				return denialOfDS(t.TypeBitMap)
+			}
+			if hashCovers(hash, strings.ToUpper(t.NextDomain), zoneHash) {
+				// Opt-out ranges may hold unsigned delegations
+				if t.Flags&1 == 1 {
+					return nil, errInsecure
+				}
+				return nil, errNoDelegation
+			}
+		}
+	}
+	return nil, errBogus
+}
+
+// What the types at a name prove about its DS records
+func denialOfDS(types []uint16) ([]*dns.DS, error) {
+	hasNS := false
+	for _, t := range types {
+		switch t {
+		case dns.TypeDS:
+			// Denies the denial
+			return nil, errBogus
+		case dns.TypeNS:
+			hasNS = true
+		}
+	}
+	if hasNS {
+		return nil, errInsecure
+	}
+	return nil, errNoDelegation
+}
+
+// Whether name is between owner and next in canonical order, the last NSEC of a zone wrapping
+// around to its apex
+func nsecCovers(owner string, next string, name string) bool {
+	afterOwner := canonicalCompare(owner, name) < 0
+	beforeNext := canonicalCompare(name, next) < 0
+	if canonicalCompare(owner, next) < 0 {
+		return afterOwner && beforeNext
+	}
+	return afterOwner || beforeNext
+}
+
+func hashCovers(hash string, next string, nameHash string) bool {
+	if hash < next {
+		return hash < nameHash && nameHash < next
+	}
+	return hash < nameHash || nameHash < next
+}
+
+// The hash of the owner name of an NSEC3 record, its first label
+func nsec3Hash(rr *dns.NSEC3) string {
+	return strings.ToUpper(dns.SplitDomainName(rr.Hdr.Name)[0])
+}
+
+// Orders names canonically (RFC 4034 section 6.1): by their labels from the right, lowercased
+func canonicalCompare(a string, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func (v *Validator) underAnchor(zone string) bool {
+	for anchor := range v.anchors {
+		if dns.IsSubDomain(anchor, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Validator) query(name string, qtype uint16, resolvers []string) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(ednsBufferSize(), true)
+	req.CheckingDisabled = true
+	return v.exchange(req, resolvers)
+}
+
+func matchesDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	d := key.ToDS(ds.DigestType)
+	return d != nil && strings.EqualFold(d.Digest, ds.Digest)
+}
+
+func dnskeys(rrs []dns.RR) []*dns.DNSKEY {
+	var keys []*dns.DNSKEY
+	for _, rr := range rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(name) + "/" + dns.Type(rrtype).String()
+}
+
+// Groups records into RRsets, with the signatures keyed by the RRset they cover
+func splitRRsets(rrs []dns.RR) (rrsets [][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	sigs = make(map[string][]*dns.RRSIG)
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey(hdr.Name, hdr.Rrtype)
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+	return
+}
+
+// Removes DNSSEC records from responses to clients that didn't ask for them, and only
+// keeps the AD bit for clients that understand it.
+func setResponseDnssec(req, m *dns.Msg) {
+	do := false
+	if o := req.IsEdns0(); o != nil {
+		do = o.Do()
+	}
+	if !do && !req.AuthenticatedData {
+		m.AuthenticatedData = false
+	}
+	if do {
+		return
+	}
+
+	qtype := req.Question[0].Qtype
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	m.Answer = strip(m.Answer)
+	m.Ns = strip(m.Ns)
+	m.Extra = strip(m.Extra)
+}
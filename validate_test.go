@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+// A validator for "example." with a signed delegation to "sub.example." and an unsigned one to
+// "insecure.example.", answering from a fixed set of records
+func testValidator(t *testing.T) (*Validator, *testZone) {
+	parent := newTestZone(t, "example.")
+	child := newTestZone(t, "sub.example.")
+
+	ds := child.key.ToDS(dns.SHA256)
+	ds.Hdr = dns.RR_Header{Name: "sub.example.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+
+	records := map[string][]dns.RR{
+		rrsetKey("example.", dns.TypeDNSKEY):     parent.sign(t, parent.key),
+		rrsetKey("sub.example.", dns.TypeDNSKEY): child.sign(t, child.key),
+		rrsetKey("sub.example.", dns.TypeDS):     parent.sign(t, ds),
+	}
+	// Proofs that DS records don't exist, in the authority section
+	denials := map[string][]dns.RR{
+		rrsetKey("insecure.example.", dns.TypeDS): parent.sign(t, testRR(t, "insecure.example. 3600 IN NSEC sub.example. NS RRSIG NSEC")),
+		rrsetKey("www.sub.example.", dns.TypeDS):  child.sign(t, testRR(t, "www.sub.example. 3600 IN NSEC sub.example. A RRSIG NSEC")),
+	}
+
+	v := NewValidator([]dns.RR{parent.key})
+	v.exchange = func(req *dns.Msg, resolvers []string) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = records[rrsetKey(req.Question[0].Name, req.Question[0].Qtype)]
+		m.Ns = denials[rrsetKey(req.Question[0].Name, req.Question[0].Qtype)]
+		return m, nil
+	}
+	return v, child
+}
+
+func TestValidateSecure(t *testing.T) {
+	v, child := testValidator(t)
+
+	a := testRR(t, "www.sub.example. 300 IN A 10.0.0.1")
+	msg := &dns.Msg{Answer: child.sign(t, a)}
+	if result := v.Validate(msg, nil); result != VALIDATION_SECURE {
+		t.Fatalf("Expected a secure answer, got %d", result)
+	}
+}
+
+func TestValidateBogus(t *testing.T) {
+	v, child := testValidator(t)
+
+	a := testRR(t, "www.sub.example. 300 IN A 10.0.0.1")
+	signed := child.sign(t, a)
+	signed[0].(*dns.A).A = testRR(t, "x. IN A 10.6.6.6").(*dns.A).A
+	if result := v.Validate(&dns.Msg{Answer: signed}, nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected a bogus answer for tampered data, got %d", result)
+	}
+
+	// Signed by a key the parent doesn't vouch for
+	rogue := newTestZone(t, "sub.example.")
+	if result := v.Validate(&dns.Msg{Answer: rogue.sign(t, a)}, nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected a bogus answer for an unknown key, got %d", result)
+	}
+}
+
+func TestValidateInsecure(t *testing.T) {
+	v, _ := testValidator(t)
+
+	msg := &dns.Msg{Answer: []dns.RR{testRR(t, "www.insecure.example. 300 IN A 10.0.0.1")}}
+	if result := v.Validate(msg, nil); result != VALIDATION_INSECURE {
+		t.Fatalf("Expected an insecure answer for unsigned data under an unsigned delegation, got %d", result)
+	}
+
+	// Stripped signatures don't make data in a signed zone insecure
+	msg = &dns.Msg{Answer: []dns.RR{testRR(t, "www.sub.example. 300 IN A 10.0.0.1")}}
+	if result := v.Validate(msg, nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected a bogus answer for unsigned data in a signed zone, got %d", result)
+	}
+	msg = &dns.Msg{Answer: []dns.RR{testRR(t, "www.unproven.example. 300 IN A 10.0.0.1")}}
+	if result := v.Validate(msg, nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected a bogus answer for unsigned data without a proof the DS doesn't exist, got %d", result)
+	}
+
+	other := newTestZone(t, "other.")
+	msg = &dns.Msg{Answer: other.sign(t, testRR(t, "www.other. 300 IN A 10.0.0.1"))}
+	if result := v.Validate(msg, nil); result != VALIDATION_INSECURE {
+		t.Fatalf("Expected an insecure answer outside the trust anchor, got %d", result)
+	}
+}
+
+func TestValidateDenial(t *testing.T) {
+	v, child := testValidator(t)
+	soa := testRR(t, "sub.example. 300 IN SOA ns.sub.example. admin.sub.example. 1 3600 600 86400 300")
+	nxdomain := func(name string, ns ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		m.Ns = ns
+		return m
+	}
+
+	if result := v.Validate(nxdomain("nope.sub.example."), nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected an empty NXDOMAIN to be bogus, got %d", result)
+	}
+	if result := v.Validate(nxdomain("nope.sub.example.", child.sign(t, soa)...), nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected an NXDOMAIN with only a SOA to be bogus, got %d", result)
+	}
+
+	// The NSEC record covers both the name and the wildcard of its closest encloser
+	nsec := child.sign(t, testRR(t, "sub.example. 300 IN NSEC www.sub.example. NS SOA RRSIG NSEC DNSKEY"))
+	msg := nxdomain("nope.sub.example.", append(child.sign(t, soa), nsec...)...)
+	if result := v.Validate(msg, nil); result != VALIDATION_SECURE {
+		t.Fatalf("Expected an NXDOMAIN with an NSEC proof to be secure, got %d", result)
+	}
+	if result := v.Validate(nxdomain("www.sub.example.", nsec...), nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected an NXDOMAIN for a name that exists to be bogus, got %d", result)
+	}
+
+	// NODATA needs the name's own NSEC record without the type
+	msg = new(dns.Msg)
+	msg.SetQuestion("www.sub.example.", dns.TypeAAAA)
+	msg.Ns = child.sign(t, testRR(t, "www.sub.example. 300 IN NSEC sub.example. A RRSIG NSEC"))
+	if result := v.Validate(msg, nil); result != VALIDATION_SECURE {
+		t.Fatalf("Expected NODATA with an NSEC proof to be secure, got %d", result)
+	}
+	msg.Question[0].Qtype = dns.TypeA
+	if result := v.Validate(msg, nil); result != VALIDATION_BOGUS {
+		t.Fatalf("Expected NODATA for a type the NSEC record lists to be bogus, got %d", result)
+	}
+
+	// A single NSEC3 record matches the apex, the closest encloser, and covers every other hash
+	hash := dns.HashName("sub.example.", dns.SHA1, 0, "")
+	nsec3 := child.sign(t, &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: hash + ".sub.example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: hash,
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+	})
+	if result := v.Validate(nxdomain("nope.sub.example.", nsec3...), nil); result != VALIDATION_SECURE {
+		t.Fatalf("Expected an NXDOMAIN with an NSEC3 proof to be secure, got %d", result)
+	}
+
+	if result := v.Validate(nxdomain("nope.insecure.example."), nil); result != VALIDATION_INSECURE {
+		t.Fatalf("Expected an NXDOMAIN under an unsigned delegation to be insecure, got %d", result)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Watches a set of files and reloads when their content changes. The directories holding the
+// files are watched rather than the files themselves, so that files replaced by renaming a new
+// one over them (as editors and config management tools do) keep being watched.
+type FileWatcher struct {
+	files  func() []string
+	delay  time.Duration
+	reload func()
+	sums   map[string]string
+	notify chan struct{}
+	dirs   *dirWatcher
+}
+
+// Starts watching the files returned by files. reload is called once changes have settled for
+// delay, and files is called again after each reload since the set of files may have changed.
+func NewFileWatcher(files func() []string, delay time.Duration, reload func()) (*FileWatcher, error) {
+	w := &FileWatcher{
+		files:  files,
+		delay:  delay,
+		reload: reload,
+		notify: make(chan struct{}, 1),
+	}
+
+	var err error
+	if w.dirs, err = newDirWatcher(w.notify); err != nil {
+		return nil, err
+	}
+	if err = w.watch(); err != nil {
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Watches the directories of the current set of files and remembers their content
+func (w *FileWatcher) watch() error {
+	files := w.files()
+	w.sums = checksums(files)
+
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = true
+	}
+	return w.dirs.Watch(dirs)
+}
+
+func (w *FileWatcher) run() {
+	for range w.notify {
+		// Wait for a quiet period, writes often come as several events
+		timer := time.NewTimer(w.delay)
+		for settled := false; !settled; {
+			select {
+			case <-w.notify:
+				timer.Reset(w.delay)
+			case <-timer.C:
+				settled = true
+			}
+		}
+		w.check()
+	}
+}
+
+// Reloads when the set of files that exist or their content changed. Files that are missing are
+// left for the reload to report; if they were only being replaced, their return is another change.
+func (w *FileWatcher) check() {
+	sums := checksums(w.files())
+	if reflect.DeepEqual(sums, w.sums) {
+		log.Debug("Watched files changed without changing their content")
+		return
+	}
+
+	log.Info("Watched files changed, reloading")
+	w.reload()
+	if err := w.watch(); err != nil {
+		log.Errorf("Failed to watch files: %v", err)
+	}
+}
+
+// The hashes of the files that can be read
+func checksums(files []string) map[string]string {
+	sums := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		sums[file] = fmt.Sprintf("%x", sha256.Sum256(data))
+	}
+	return sums
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Events in a watched directory that may change one of the files we care about
+const INOTIFY_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// Watches directories with inotify
+type dirWatcher struct {
+	fd     int
+	wds    map[string]int
+	notify chan<- struct{}
+}
+
+func newDirWatcher(notify chan<- struct{}) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	d := &dirWatcher{fd: fd, wds: make(map[string]int), notify: notify}
+	go d.read()
+	return d, nil
+}
+
+// Watches dirs, and stops watching directories that are not in dirs anymore
+func (d *dirWatcher) Watch(dirs map[string]bool) error {
+	for dir, wd := range d.wds {
+		if !dirs[dir] {
+			syscall.InotifyRmWatch(d.fd, uint32(wd))
+			delete(d.wds, dir)
+		}
+	}
+	for dir := range dirs {
+		if _, ok := d.wds[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(d.fd, dir, INOTIFY_MASK)
+		if err != nil {
+			return err
+		}
+		d.wds[dir] = wd
+		log.Debugf("Watching %s", dir)
+	}
+	return nil
+}
+
+func (d *dirWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		// The events themselves don't matter, the files are compared after each batch
+		_, err := syscall.Read(d.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Failed to read file changes: %v", err)
+			return
+		}
+		select {
+		case d.notify <- struct{}{}:
+		default:
+		}
+	}
+}
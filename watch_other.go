@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"time"
+)
+
+// How often files are checked for changes where inotify is not available
+const WATCH_POLL_INTERVAL = 2 * time.Second
+
+// Checks directories periodically
+type dirWatcher struct{}
+
+func newDirWatcher(notify chan<- struct{}) (*dirWatcher, error) {
+	go func() {
+		for range time.Tick(WATCH_POLL_INTERVAL) {
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return &dirWatcher{}, nil
+}
+
+func (d *dirWatcher) Watch(dirs map[string]bool) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "answers.yaml")
+	ioutil.WriteFile(file, []byte("default: {}\n"), 0644)
+
+	reloads := make(chan struct{}, 10)
+	_, err = NewFileWatcher(func() []string { return []string{file} }, 50*time.Millisecond, func() {
+		reloads <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(reload bool, msg string) {
+		timeout := time.Second
+		if reload {
+			timeout = 5 * time.Second
+		}
+		select {
+		case <-reloads:
+			if !reload {
+				t.Fatalf("Unexpected reload: %s", msg)
+			}
+		case <-time.After(timeout):
+			if reload {
+				t.Fatalf("Expected a reload: %s", msg)
+			}
+		}
+	}
+
+	// Rewriting the same content isn't a change
+	ioutil.WriteFile(file, []byte("default: {}\n"), 0644)
+	expect(false, "same content")
+
+	// Atomic replace, as config management tools do, with a burst of writes first
+	tmp := filepath.Join(dir, ".answers.yaml.tmp")
+	for i := 0; i < 5; i++ {
+		ioutil.WriteFile(tmp, []byte("default:\n  search: [\"a.\"]\n"), 0644)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "renamed over")
+	expect(false, "changes should be debounced")
+
+	// Still watched after the rename
+	ioutil.WriteFile(file, []byte("default:\n  search: [\"b.\"]\n"), 0644)
+	expect(true, "written in place")
+
+	// A file removed for good is a change too, loading reports it
+	os.Remove(file)
+	expect(true, "removed")
+	ioutil.WriteFile(file, []byte("default:\n  search: [\"b.\"]\n"), 0644)
+	expect(true, "recreated")
+}
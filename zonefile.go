@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// An RFC 1035 zone file whose records are merged into a section of the answers
+type ZoneFile struct {
+	Path   string `json:"path"`
+	Origin string `json:"origin"`
+}
+
+// SOA record of a zone we are authoritative for
+type RecordSoa struct {
+	Ttl     *uint32 `json:"ttl"`
+	Ns      string  `json:"ns"`
+	Mbox    string  `json:"mbox"`
+	Serial  uint32  `json:"serial"`
+	Refresh uint32  `json:"refresh"`
+	Retry   uint32  `json:"retry"`
+	Expire  uint32  `json:"expire"`
+	Minttl  uint32  `json:"minttl"`
+}
+
+// Reads the records of a zone file. Names are relative to origin unless the file sets its own $ORIGIN.
+func ParseZoneFile(path string, origin string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if origin != "" {
+		origin = dns.Fqdn(origin)
+	}
+
+	var rrs []dns.RR
+	for t := range dns.ParseZone(f, origin, path) {
+		if t.Error != nil {
+			return nil, t.Error
+		}
+		rrs = append(rrs, t.RR)
+	}
+	return rrs, nil
+}
+
+// Adds the records of the zone files listed in each section to that section. Records that are
+// already in the section itself take precedence over zone file records.
+func MergeZones(answers *Answers) error {
+	for key, client := range *answers {
+		if len(client.Zones) == 0 {
+			continue
+		}
+
+		zoneClient := ClientAnswers{
+			A:     make(map[string]RecordA),
+			Aaaa:  make(map[string]RecordA),
+			Cname: make(map[string]RecordCname),
+			Ptr:   make(map[string]RecordPtr),
+			Txt:   make(map[string]RecordTxt),
+			Srv:   make(map[string]RecordSrv),
+			Soa:   make(map[string]RecordSoa),
+		}
+		for _, file := range client.Zones {
+			rrs, err := ParseZoneFile(file.Path, file.Origin)
+			if err != nil {
+				return err
+			}
+			for _, rr := range rrs {
+				addZoneRecord(&zoneClient, rr, file.Path)
+			}
+			log.Debugf("Loaded %d records from zone file %s into %s", len(rrs), file.Path, key)
+		}
+
+		client.A = mergeRecordsA(client.A, zoneClient.A)
+		client.Aaaa = mergeRecordsA(client.Aaaa, zoneClient.Aaaa)
+		if client.Cname == nil {
+			client.Cname = make(map[string]RecordCname)
+		}
+		for name, rec := range zoneClient.Cname {
+			if _, ok := client.Cname[name]; !ok {
+				client.Cname[name] = rec
+			}
+		}
+		if client.Ptr == nil {
+			client.Ptr = make(map[string]RecordPtr)
+		}
+		for name, rec := range zoneClient.Ptr {
+			if _, ok := client.Ptr[name]; !ok {
+				client.Ptr[name] = rec
+			}
+		}
+		if client.Txt == nil {
+			client.Txt = make(map[string]RecordTxt)
+		}
+		for name, rec := range zoneClient.Txt {
+			if _, ok := client.Txt[name]; !ok {
+				client.Txt[name] = rec
+			}
+		}
+		if client.Srv == nil {
+			client.Srv = make(map[string]RecordSrv)
+		}
+		for name, rec := range zoneClient.Srv {
+			if _, ok := client.Srv[name]; !ok {
+				client.Srv[name] = rec
+			}
+		}
+		if client.Soa == nil {
+			client.Soa = make(map[string]RecordSoa)
+		}
+		for name, rec := range zoneClient.Soa {
+			if _, ok := client.Soa[name]; !ok {
+				client.Soa[name] = rec
+			}
+		}
+		(*answers)[key] = client
+	}
+
+	return nil
+}
+
+func addZoneRecord(client *ClientAnswers, rr dns.RR, path string) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	ttl := hdr.Ttl
+
+	switch t := rr.(type) {
+	case *dns.A:
+		rec := client.A[name]
+		if rec.Ttl == nil {
+			rec.Ttl = &ttl
+		}
+		rec.Answer = append(rec.Answer, t.A.String())
+		client.A[name] = rec
+	case *dns.AAAA:
+		rec := client.Aaaa[name]
+		if rec.Ttl == nil {
+			rec.Ttl = &ttl
+		}
+		rec.Answer = append(rec.Answer, t.AAAA.String())
+		client.Aaaa[name] = rec
+	case *dns.CNAME:
+		client.Cname[name] = RecordCname{Ttl: &ttl, Answer: strings.ToLower(t.Target)}
+	case *dns.PTR:
+		client.Ptr[name] = RecordPtr{Ttl: &ttl, Answer: t.Ptr}
+	case *dns.TXT:
+		rec := client.Txt[name]
+		if rec.Ttl == nil {
+			rec.Ttl = &ttl
+		}
+		rec.Answer = append(rec.Answer, AnswerStrings(t.Txt))
+		client.Txt[name] = rec
+	case *dns.SRV:
+		rec := client.Srv[name]
+		if rec.Ttl == nil {
+			rec.Ttl = &ttl
+		}
+		rec.Answer = append(rec.Answer, SrvTarget{Priority: t.Priority, Weight: t.Weight, Port: t.Port, Target: strings.ToLower(t.Target)})
+		client.Srv[name] = rec
+	case *dns.SOA:
+		client.Soa[name] = RecordSoa{
+			Ttl:     &ttl,
+			Ns:      t.Ns,
+			Mbox:    t.Mbox,
+			Serial:  t.Serial,
+			Refresh: t.Refresh,
+			Retry:   t.Retry,
+			Expire:  t.Expire,
+			Minttl:  t.Minttl,
+		}
+	case *dns.NS:
+		// Delegations and apex NS records have no local meaning
+	default:
+		log.Warnf("Ignoring unsupported %s record for %s in %s", dns.Type(hdr.Rrtype).String(), name, path)
+	}
+}
+
+// SOA record for negative answers in a zone we are authoritative for, from a zone file if one
+// was loaded for it into the client's section or the default section
+func (answers *Answers) SOA(clientUUID string, zone string) *dns.SOA {
+	zone = dns.Fqdn(zone)
+	for _, key := range []string{clientUUID, DEFAULT_KEY} {
+		client, ok := (*answers)[key]
+		rec, found := client.Soa[strings.ToLower(zone)]
+		if !ok || !found {
+			continue
+		}
+		ttl := uint32(*defaultTtl)
+		if rec.Ttl != nil {
+			ttl = *rec.Ttl
+		}
+		hdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl}
+		return &dns.SOA{Hdr: hdr, Ns: rec.Ns, Mbox: rec.Mbox, Serial: rec.Serial, Refresh: rec.Refresh, Retry: rec.Retry, Expire: rec.Expire, Minttl: rec.Minttl}
+	}
+
+	return authoritativeSOA(zone)
+}
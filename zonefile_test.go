@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zone := filepath.Join(dir, "example.zone")
+	ioutil.WriteFile(zone, []byte(`
+$TTL 300
+@       IN SOA  ns1 hostmaster 2024010101 3600 600 86400 60
+        IN NS   ns1
+ns1     IN A    10.1.2.1
+db      IN A    10.1.2.3
+db      IN A    10.1.2.4
+        IN AAAA fd00::3
+www 60  IN CNAME db
+_spf    IN TXT  "v=spf1 -all"
+mail    IN MX   10 db
+_ldap._tcp IN SRV 10 60 389 db
+`), 0644)
+
+	clientZone := filepath.Join(dir, "client.zone")
+	ioutil.WriteFile(clientZone, []byte(`
+$TTL 300
+@       IN SOA  ns2 hostmaster 2024020202 3600 600 86400 60
+db      IN A    10.1.3.3
+`), 0644)
+
+	answersFile := filepath.Join(dir, "answers.yaml")
+	ioutil.WriteFile(answersFile, []byte(`
+default:
+  authoritative: ["example.com."]
+  a:
+    ns1.example.com.:
+      answer: ["192.0.2.1"]
+  zones:
+  - path: `+zone+`
+    origin: example.com
+10.42.1.5:
+  zones:
+  - path: `+clientZone+`
+    origin: client.example.com
+`), 0644)
+
+	answers, err := ParseAnswers(answersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := answers[DEFAULT_KEY]
+
+	if a := def.A["db.example.com."]; len(a.Answer) != 2 || a.Ttl == nil || *a.Ttl != 300 {
+		t.Fatalf("Incorrect A record for db.example.com. [%v]", a)
+	}
+	if a := def.A["ns1.example.com."]; len(a.Answer) != 1 || a.Answer[0] != "192.0.2.1" {
+		t.Fatalf("Records in the answers file should take precedence [%v]", a)
+	}
+	if a := def.Aaaa["db.example.com."]; len(a.Answer) != 1 || a.Answer[0] != "fd00::3" {
+		t.Fatalf("Incorrect AAAA record [%v]", a)
+	}
+	if c := def.Cname["www.example.com."]; c.Answer != "db.example.com." || *c.Ttl != 60 {
+		t.Fatalf("Incorrect CNAME record [%v]", c)
+	}
+	if txt := def.Txt["_spf.example.com."]; len(txt.Answer) != 1 || len(txt.Answer[0]) != 1 || txt.Answer[0][0] != "v=spf1 -all" {
+		t.Fatalf("Incorrect TXT record [%v]", txt)
+	}
+
+	if srv := def.Srv["_ldap._tcp.example.com."]; len(srv.Answer) != 1 || srv.Answer[0] != (SrvTarget{Priority: 10, Weight: 60, Port: 389, Target: "db.example.com."}) {
+		t.Fatalf("Incorrect SRV record [%v]", srv)
+	}
+
+	soa := answers.SOA(DEFAULT_KEY, "example.com.")
+	if soa.Serial != 2024010101 || soa.Ns != "ns1.example.com." || soa.Minttl != 60 {
+		t.Fatalf("Incorrect SOA record [%v]", soa)
+	}
+	if soa := answers.SOA(DEFAULT_KEY, "other.com."); soa.Ns != "other.com." {
+		t.Fatalf("Expected a generated SOA for zones without a file [%v]", soa)
+	}
+	if soa := answers.SOA("10.42.1.5", "client.example.com."); soa.Serial != 2024020202 || soa.Ns != "ns2.client.example.com." {
+		t.Fatalf("Expected the SOA of the zone file in the client section [%v]", soa)
+	}
+	if soa := answers.SOA("10.42.1.6", "client.example.com."); soa.Ns != "client.example.com." {
+		t.Fatalf("Expected other clients to get a generated SOA [%v]", soa)
+	}
+
+	records, ok := unindexed(answers).Addresses("10.1.2.2", "www.example.com.", "www.example.com.", nil, 1)
+	if !ok || len(records) != 3 || records[0].Header().Rrtype != dns.TypeCNAME {
+		t.Fatalf("Expected the CNAME and its addresses [%v]", records)
+	}
+}